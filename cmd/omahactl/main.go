@@ -0,0 +1,307 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// omahactl crafts and sends Omaha requests for debugging update servers.
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/satori/go.uuid"
+
+	"github.com/coreos/go-omaha/omaha"
+	"github.com/coreos/go-omaha/omaha/client"
+)
+
+// Exit codes, intended to be checked by scripts.
+const (
+	exitSuccess  = 0 // update available, event acknowledged, file valid
+	exitFailure  = 1 // request failed or file is invalid
+	exitUsage    = 2 // bad command line
+	exitNoUpdate = 3 // update check succeeded but there is no update
+)
+
+const usage = `Usage: omahactl <command> [flags]
+
+Commands:
+  check     send an update check and print the response
+  event     send an event and print the response
+  validate  check that an XML file matches the protocol structures
+
+Run 'omahactl <command> -h' for the command's flags.
+`
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return exitUsage
+	}
+
+	switch args[0] {
+	case "check":
+		return runCheck(args[1:], stdout, stderr)
+	case "event":
+		return runEvent(args[1:], stdout, stderr)
+	case "validate":
+		return runValidate(args[1:], stdout, stderr)
+	case "-h", "-help", "--help", "help":
+		fmt.Fprint(stdout, usage)
+		return exitSuccess
+	default:
+		fmt.Fprintf(stderr, "omahactl: unknown command %q\n", args[0])
+		fmt.Fprint(stderr, usage)
+		return exitUsage
+	}
+}
+
+// appOptions are the flags shared by commands that talk to a server.
+type appOptions struct {
+	server  string
+	userID  string
+	appID   string
+	version string
+	track   string
+	json    bool
+}
+
+func (o *appOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.server, "server", "", "Omaha server URL")
+	fs.StringVar(&o.userID, "user-id", "", "client user/machine id (default random)")
+	fs.StringVar(&o.appID, "app-id", "", "application id")
+	fs.StringVar(&o.version, "version", "", "current application version")
+	fs.StringVar(&o.track, "track", "", "application update track")
+	fs.BoolVar(&o.json, "json", false, "print the response as JSON")
+}
+
+// appClient creates the client used to construct and send requests.
+func (o *appOptions) appClient() (*client.AppClient, error) {
+	if o.server == "" {
+		return nil, errors.New("--server is required")
+	}
+	if o.appID == "" {
+		return nil, errors.New("--app-id is required")
+	}
+	if o.version == "" {
+		return nil, errors.New("--version is required")
+	}
+
+	userID := o.userID
+	if userID == "" {
+		userID = uuid.NewV4().String()
+	}
+
+	ac, err := client.NewAppClient(o.server, userID, o.appID, o.version)
+	if err != nil {
+		return nil, err
+	}
+	if err := ac.SetClientVersion("omahactl"); err != nil {
+		return nil, err
+	}
+
+	if o.track != "" {
+		if err := ac.SetTrack(o.track); err != nil {
+			return nil, err
+		}
+	}
+
+	return ac, nil
+}
+
+// appElement names the element when printing an AppResponse as XML.
+type appElement struct {
+	XMLName xml.Name `xml:"app" json:"-"`
+	*omaha.AppResponse
+}
+
+// checkRequest constructs an update check with a ping, the same shape
+// AppClient.UpdateCheck sends minus CoreUpdate's completion event.
+func checkRequest(ac *client.AppClient) *omaha.Request {
+	req := ac.NewAppRequest()
+	app := req.Apps[0]
+	app.AddPing()
+	app.AddUpdateCheck()
+	return req
+}
+
+// eventRequest constructs a request reporting a single event.
+func eventRequest(ac *client.AppClient, event *omaha.EventRequest) *omaha.Request {
+	req := ac.NewAppRequest()
+	app := req.Apps[0]
+	app.Events = append(app.Events, event)
+	return req
+}
+
+func runCheck(args []string, stdout, stderr io.Writer) int {
+	var opts appOptions
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	opts.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	ac, err := opts.appClient()
+	if err != nil {
+		fmt.Fprintf(stderr, "omahactl: %v\n", err)
+		return exitUsage
+	}
+
+	appResp, err := ac.SendAppRequest(checkRequest(ac))
+	if err != nil {
+		fmt.Fprintf(stderr, "omahactl: %v\n", err)
+		return exitFailure
+	}
+
+	if err := printValue(stdout, appElement{AppResponse: appResp}, opts.json); err != nil {
+		fmt.Fprintf(stderr, "omahactl: %v\n", err)
+		return exitFailure
+	}
+
+	if appResp.UpdateCheck == nil {
+		fmt.Fprintln(stderr, "omahactl: update check missing from response")
+		return exitFailure
+	}
+
+	switch appResp.UpdateCheck.Status {
+	case omaha.UpdateOK:
+		return exitSuccess
+	case omaha.NoUpdate:
+		return exitNoUpdate
+	default:
+		return exitFailure
+	}
+}
+
+func runEvent(args []string, stdout, stderr io.Writer) int {
+	var (
+		opts    appOptions
+		evType  int
+		evRes   int
+		evError int
+		prevVer string
+	)
+	fs := flag.NewFlagSet("event", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	opts.register(fs)
+	fs.IntVar(&evType, "event-type", -1, "numeric event type, e.g. 3 for update complete")
+	fs.IntVar(&evRes, "event-result", int(omaha.EventResultSuccess), "numeric event result")
+	fs.IntVar(&evError, "error-code", 0, "numeric error code")
+	fs.StringVar(&prevVer, "previous-version", "", "version prior to the update")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	if evType < 0 {
+		fmt.Fprintln(stderr, "omahactl: --event-type is required")
+		return exitUsage
+	}
+
+	ac, err := opts.appClient()
+	if err != nil {
+		fmt.Fprintf(stderr, "omahactl: %v\n", err)
+		return exitUsage
+	}
+
+	event := &omaha.EventRequest{
+		Type:            omaha.EventType(evType),
+		Result:          omaha.EventResult(evRes),
+		ErrorCode:       omaha.ErrorCode(evError),
+		PreviousVersion: prevVer,
+	}
+	fmt.Fprintln(stderr, client.EventString(event))
+
+	appResp, err := ac.SendAppRequest(eventRequest(ac, event))
+	if err != nil {
+		fmt.Fprintf(stderr, "omahactl: %v\n", err)
+		return exitFailure
+	}
+
+	if err := printValue(stdout, appElement{AppResponse: appResp}, opts.json); err != nil {
+		fmt.Fprintf(stderr, "omahactl: %v\n", err)
+		return exitFailure
+	}
+
+	return exitSuccess
+}
+
+func runValidate(args []string, stdout, stderr io.Writer) int {
+	var asJSON bool
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.BoolVar(&asJSON, "json", false, "print the parsed document as JSON")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	if fs.NArg() != 1 {
+		fmt.Fprintln(stderr, "omahactl: validate requires exactly one file")
+		return exitUsage
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(stderr, "omahactl: %v\n", err)
+		return exitFailure
+	}
+	defer f.Close()
+
+	doc, unknown, err := validate(f)
+	if err != nil {
+		fmt.Fprintf(stderr, "omahactl: %v\n", err)
+		return exitFailure
+	}
+
+	if err := printValue(stdout, doc, asJSON); err != nil {
+		fmt.Fprintf(stderr, "omahactl: %v\n", err)
+		return exitFailure
+	}
+
+	for _, u := range unknown {
+		fmt.Fprintf(stderr, "omahactl: dropped %s\n", u)
+	}
+	if len(unknown) != 0 {
+		return exitFailure
+	}
+
+	return exitSuccess
+}
+
+// printValue writes v as indented XML or JSON.
+func printValue(w io.Writer, v interface{}, asJSON bool) error {
+	var (
+		raw []byte
+		err error
+	)
+	if asJSON {
+		raw, err = json.MarshalIndent(v, "", "  ")
+	} else {
+		raw, err = xml.MarshalIndent(v, "", "  ")
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "%s\n", raw)
+	return err
+}
@@ -0,0 +1,170 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/coreos/go-omaha/omaha"
+)
+
+const (
+	testAppID  = "{27BD862E-8AE8-4886-A055-F7F1A6460627}"
+	testUserID = "8b10fc6d-30ca-49b2-b1a2-8185f03d522b"
+
+	sampleRequest = `<?xml version="1.0" encoding="UTF-8"?>
+<request protocol="3.0" version="ChromeOSUpdateEngine-0.1.0.0" updaterversion="ChromeOSUpdateEngine-0.1.0.0" installsource="ondemandupdate" ismachine="1">
+<os version="Indy" platform="Chrome OS" sp="ForcedUpdate_x86_64"></os>
+<app appid="{87efface-864d-49a5-9bb3-4b050a7c227a}" version="ForcedUpdate" track="dev-channel" hardware_class="" delta_okay="false" >
+<ping active="1" a="-1" r="-1"></ping>
+<updatecheck targetversionprefix=""></updatecheck>
+<extra><nested/></extra>
+</app>
+</request>
+`
+)
+
+func testOptions() *appOptions {
+	return &appOptions{
+		server:  "http://localhost:8000",
+		userID:  testUserID,
+		appID:   testAppID,
+		version: "1.0.0",
+		track:   "stable",
+	}
+}
+
+func TestAppOptionsRequired(t *testing.T) {
+	for _, clear := range []func(o *appOptions){
+		func(o *appOptions) { o.server = "" },
+		func(o *appOptions) { o.appID = "" },
+		func(o *appOptions) { o.version = "" },
+	} {
+		o := testOptions()
+		clear(o)
+		if _, err := o.appClient(); err == nil {
+			t.Errorf("incomplete options accepted: %#v", o)
+		}
+	}
+}
+
+func TestCheckRequest(t *testing.T) {
+	ac, err := testOptions().appClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := checkRequest(ac)
+	if req.UserID != testUserID {
+		t.Errorf("unexpected user id %q", req.UserID)
+	}
+	if len(req.Apps) != 1 {
+		t.Fatalf("expected 1 app, not %d", len(req.Apps))
+	}
+
+	app := req.Apps[0]
+	if app.ID != testAppID || app.Version != "1.0.0" || app.Track != "stable" {
+		t.Errorf("unexpected app: %#v", app)
+	}
+	if app.Ping == nil || app.UpdateCheck == nil {
+		t.Error("expected a ping and an update check")
+	}
+	if len(app.Events) != 0 {
+		t.Errorf("expected no events, not %d", len(app.Events))
+	}
+}
+
+func TestEventRequest(t *testing.T) {
+	ac, err := testOptions().appClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := &omaha.EventRequest{
+		Type:            omaha.EventTypeUpdateComplete,
+		Result:          omaha.EventResultSuccessReboot,
+		PreviousVersion: "0.9.0",
+	}
+	req := eventRequest(ac, event)
+
+	app := req.Apps[0]
+	if app.Ping != nil || app.UpdateCheck != nil {
+		t.Error("expected only an event")
+	}
+	if len(app.Events) != 1 || !reflect.DeepEqual(app.Events[0], event) {
+		t.Errorf("unexpected events: %#v", app.Events)
+	}
+}
+
+func TestUnknownFields(t *testing.T) {
+	_, unknown, err := validate(strings.NewReader(sampleRequest))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []string{
+		"element request/app/extra",
+	}
+	if !reflect.DeepEqual(unknown, expect) {
+		t.Errorf("unexpected unknown fields: %q", unknown)
+	}
+}
+
+func TestRunCheck(t *testing.T) {
+	s, err := omaha.NewTrivialServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Destroy()
+	go s.Serve()
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"check",
+		"--server", "http://" + s.Addr().String(),
+		"--app-id", testAppID,
+		"--version", "1.0.0",
+		"--json",
+	}, &stdout, &stderr)
+	if code != exitNoUpdate {
+		t.Fatalf("unexpected exit code %d: %s", code, stderr.String())
+	}
+
+	var appResp omaha.AppResponse
+	if err := json.Unmarshal(stdout.Bytes(), &appResp); err != nil {
+		t.Fatal(err)
+	}
+	if appResp.UpdateCheck == nil || appResp.UpdateCheck.Status != omaha.NoUpdate {
+		t.Errorf("unexpected response: %s", stdout.String())
+	}
+}
+
+func TestRunUsage(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	for _, args := range [][]string{
+		nil,
+		{"bogus"},
+		{"check", "--server", "http://localhost"},
+		{"event", "--server", "http://localhost", "--app-id", "a", "--version", "1"},
+		{"validate"},
+	} {
+		if code := run(args, &stdout, &stderr); code != exitUsage {
+			t.Errorf("%q exited with %d, not %d", args, code, exitUsage)
+		}
+	}
+}
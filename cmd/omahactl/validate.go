@@ -0,0 +1,196 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+
+	"github.com/coreos/go-omaha/omaha"
+)
+
+// schema describes the attributes and child elements a struct decodes.
+type schema struct {
+	attrs map[string]bool
+	elems map[string]*schema
+}
+
+func newSchema() *schema {
+	return &schema{
+		attrs: make(map[string]bool),
+		elems: make(map[string]*schema),
+	}
+}
+
+// schemaOf derives the schema of a struct type from its xml field tags.
+func schemaOf(t reflect.Type) *schema {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+
+	s := newSchema()
+	if t.Kind() != reflect.Struct {
+		return s
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || f.Name == "XMLName" {
+			continue
+		}
+
+		tag := f.Tag.Get("xml")
+		if tag == "-" {
+			continue
+		}
+
+		name, flags := tag, ""
+		if j := strings.Index(tag, ","); j >= 0 {
+			name, flags = tag[:j], tag[j+1:]
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		if strings.Contains(","+flags+",", ",attr,") {
+			s.attrs[name] = true
+			continue
+		}
+		if flags != "" && flags != "omitempty" {
+			// chardata, innerxml, comment, any
+			continue
+		}
+
+		// Expand parent>child paths into intermediate elements.
+		parent := s
+		path := strings.Split(name, ">")
+		for _, p := range path[:len(path)-1] {
+			if parent.elems[p] == nil {
+				parent.elems[p] = newSchema()
+			}
+			parent = parent.elems[p]
+		}
+		parent.elems[path[len(path)-1]] = schemaOf(f.Type)
+	}
+
+	return s
+}
+
+// validate parses an Omaha request or response document, returning the
+// parsed value and a list of attributes and elements that were dropped
+// because they have no counterpart in the protocol structures.
+func validate(r io.Reader) (interface{}, []string, error) {
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	root, err := rootElement(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var doc interface{}
+	switch root {
+	case "request":
+		doc, err = omaha.ParseRequest("", bytes.NewReader(raw))
+	case "response":
+		doc, err = omaha.ParseResponse("", bytes.NewReader(raw))
+	default:
+		err = fmt.Errorf("unexpected root element <%s>", root)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	unknown, err := unknownFields(raw, schemaOf(reflect.TypeOf(doc)))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return doc, unknown, nil
+}
+
+func rootElement(raw []byte) (string, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(raw))
+	for {
+		tok, err := decoder.Token()
+		if err != nil {
+			return "", err
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			return start.Name.Local, nil
+		}
+	}
+}
+
+// unknownFields walks the document, reporting everything not in the schema.
+func unknownFields(raw []byte, s *schema) ([]string, error) {
+	var (
+		unknown []string
+		path    []string
+		stack   []*schema
+	)
+
+	decoder := xml.NewDecoder(bytes.NewReader(raw))
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			return unknown, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			var cur *schema
+			if len(stack) == 0 {
+				cur = s
+			} else if parent := stack[len(stack)-1]; parent != nil {
+				cur = parent.elems[tok.Name.Local]
+			}
+
+			path = append(path, tok.Name.Local)
+			stack = append(stack, cur)
+			elemPath := strings.Join(path, "/")
+
+			if cur == nil {
+				// only report the top of an unknown subtree
+				if len(stack) == 1 || stack[len(stack)-2] != nil {
+					unknown = append(unknown, "element "+elemPath)
+				}
+				continue
+			}
+
+			for _, attr := range tok.Attr {
+				if attr.Name.Space == "xmlns" || attr.Name.Local == "xmlns" {
+					continue
+				}
+				if !cur.attrs[attr.Name.Local] {
+					unknown = append(unknown, fmt.Sprintf(
+						"attribute %s/@%s", elemPath, attr.Name.Local))
+				}
+			}
+		case xml.EndElement:
+			path = path[:len(path)-1]
+			stack = stack[:len(stack)-1]
+		}
+	}
+}
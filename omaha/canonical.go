@@ -0,0 +1,134 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"reflect"
+	"sort"
+	"unicode/utf8"
+)
+
+// MarshalCanonical encodes the request in a stable form suitable for
+// comparing against golden files: an XML header, attributes in a fixed
+// order and two space indentation. If sortApps is set apps are ordered
+// by id. Strings that are not valid UTF-8 are an error rather than
+// being replaced.
+func (r *Request) MarshalCanonical(sortApps bool) ([]byte, error) {
+	if sortApps {
+		c := *r
+		c.Apps = make([]*AppRequest, len(r.Apps))
+		copy(c.Apps, r.Apps)
+		sort.SliceStable(c.Apps, func(i, j int) bool {
+			return c.Apps[i].ID < c.Apps[j].ID
+		})
+		r = &c
+	}
+	return marshalCanonical(r)
+}
+
+// MarshalCanonical encodes the response in a stable form, see
+// Request.MarshalCanonical.
+func (r *Response) MarshalCanonical(sortApps bool) ([]byte, error) {
+	if sortApps {
+		c := *r
+		c.Apps = make([]*AppResponse, len(r.Apps))
+		copy(c.Apps, r.Apps)
+		sort.SliceStable(c.Apps, func(i, j int) bool {
+			return c.Apps[i].ID < c.Apps[j].ID
+		})
+		r = &c
+	}
+	return marshalCanonical(r)
+}
+
+// Equal reports whether two requests have the same content, ignoring
+// formatting and the order of apps.
+func Equal(a, b *Request) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	ab, err := a.MarshalCanonical(true)
+	if err != nil {
+		return false
+	}
+	bb, err := b.MarshalCanonical(true)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(ab, bb)
+}
+
+// EqualResponse reports whether two responses have the same content,
+// ignoring formatting and the order of apps.
+func EqualResponse(a, b *Response) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	ab, err := a.MarshalCanonical(true)
+	if err != nil {
+		return false
+	}
+	bb, err := b.MarshalCanonical(true)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(ab, bb)
+}
+
+func marshalCanonical(v interface{}) ([]byte, error) {
+	if err := checkStrings(reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+
+	buf := bytes.NewBufferString(xml.Header)
+	enc := xml.NewEncoder(buf)
+	enc.Indent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// checkStrings rejects any string in v that is not valid UTF-8 since
+// encoding/xml would silently replace the invalid bytes.
+func checkStrings(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			return checkStrings(v.Elem())
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if err := checkStrings(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if err := checkStrings(v.Field(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.String:
+		if !utf8.ValidString(v.String()) {
+			return fmt.Errorf("omaha: invalid UTF-8 in %q", v.String())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/diff"
+)
+
+const canonicalRequest = `<?xml version="1.0" encoding="UTF-8"?>
+<request protocol="3.0">
+  <os platform="test" arch="test"></os>
+  <app appid="{a}" version="1.0.0">
+    <ping active="1"></ping>
+  </app>
+  <app appid="{b}" version="2.0.0">
+    <updatecheck></updatecheck>
+  </app>
+</request>
+`
+
+func newCanonicalRequest() *Request {
+	r := NewRequest()
+	r.UpdaterVersion, r.SessionID, r.RequestID = "", "", ""
+	r.OS = &OS{Platform: "test", Arch: "test"}
+	r.AddApp("{b}", "2.0.0").AddUpdateCheck()
+	r.AddApp("{a}", "1.0.0").AddPing()
+	return r
+}
+
+func TestMarshalCanonical(t *testing.T) {
+	r := newCanonicalRequest()
+	raw, err := r.MarshalCanonical(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := diff.Diff(canonicalRequest, string(raw)); d != "" {
+		t.Errorf("unexpected canonical form:\n%s", d)
+	}
+
+	// Sorting must not modify the original.
+	if r.Apps[0].ID != "{b}" {
+		t.Error("MarshalCanonical reordered the request")
+	}
+
+	raw, err = r.MarshalCanonical(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Index(string(raw), "{b}") > strings.Index(string(raw), "{a}") {
+		t.Errorf("unsorted form was sorted:\n%s", raw)
+	}
+}
+
+func TestMarshalCanonicalResponse(t *testing.T) {
+	r := NewResponse()
+	r.AddApps([]string{"{b}", "{a}"}, AppOK)
+	raw, err := r.MarshalCanonical(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Index(string(raw), "{b}") < strings.Index(string(raw), "{a}") {
+		t.Errorf("apps were not sorted:\n%s", raw)
+	}
+	if !strings.Contains(string(raw), "\n  <daystart") {
+		t.Errorf("unexpected indentation:\n%s", raw)
+	}
+}
+
+func TestMarshalCanonicalInvalidUTF8(t *testing.T) {
+	r := newCanonicalRequest()
+	r.Apps[1].Track = "bad\xff"
+	if _, err := r.MarshalCanonical(false); err == nil {
+		t.Error("invalid UTF-8 accepted")
+	}
+}
+
+func TestEqual(t *testing.T) {
+	a := newCanonicalRequest()
+	b := newCanonicalRequest()
+	b.Apps[0], b.Apps[1] = b.Apps[1], b.Apps[0]
+	if !Equal(a, b) {
+		t.Error("app order should not matter")
+	}
+
+	b.Apps[0].Version = "1.0.1"
+	if Equal(a, b) {
+		t.Error("different versions compared equal")
+	}
+
+	if Equal(a, nil) || !Equal(nil, nil) {
+		t.Error("unexpected nil comparison")
+	}
+}
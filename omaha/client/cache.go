@@ -0,0 +1,390 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-omaha/omaha"
+)
+
+// CacheKey identifies the update check a cached response answers.
+type CacheKey struct {
+	AppID   string
+	Version string
+	Track   string
+}
+
+// CachedResponse is an update check response and when it was received.
+type CachedResponse struct {
+	Stored      time.Time
+	UpdateCheck *omaha.UpdateResponse
+}
+
+// ResponseCache stores the last update check response for each app,
+// version, and track. Get returns nil and no error if key is not cached.
+type ResponseCache interface {
+	Get(key CacheKey) (*CachedResponse, error)
+	Put(key CacheKey, resp *CachedResponse) error
+}
+
+// EventQueue stores event requests that could not be sent. Push must
+// ignore a request for the same app and version with the same event as
+// one already queued. Peek returns the queued requests, oldest first,
+// and Pop removes the n oldest.
+type EventQueue interface {
+	Push(req *omaha.Request) error
+	Peek() ([]*omaha.Request, error)
+	Pop(n int) error
+}
+
+// CachedStatus is the error returned by update checks answered from the
+// response cache rather than the server. UpdateCheck is the cached
+// response, which may offer an update, and Err is the error from the
+// server.
+type CachedStatus struct {
+	UpdateCheck *omaha.UpdateResponse
+	Stored      time.Time
+	Err         error
+}
+
+func (cs *CachedStatus) Error() string {
+	return fmt.Sprintf("omaha: cached response %s from %s, server unreachable: %v",
+		cs.UpdateCheck.Status, cs.Stored.Format(time.RFC3339), cs.Err)
+}
+
+// SetResponseCache stores update check responses in cache and answers
+// checks from it while the server is unreachable, as long as the cached
+// response is no older than ttl. A nil cache disables this.
+func (c *Client) SetResponseCache(cache ResponseCache, ttl time.Duration) {
+	c.cache = cache
+	c.cacheTTL = ttl
+}
+
+// SetEventQueue makes events that cannot reach the server wait in q
+// until the next successful request, when they are sent in order. Events
+// the server rejects are dropped. A nil q disables this.
+func (c *Client) SetEventQueue(q EventQueue) {
+	c.events = q
+}
+
+// serverUnreachable reports whether err is a transient failure to
+// reach the server, as opposed to an error the server returned.
+func serverUnreachable(err error) bool {
+	re, ok := err.(*RequestError)
+	return ok && isTransient(re.Err)
+}
+
+func (ac *AppClient) cacheKey() CacheKey {
+	return CacheKey{AppID: ac.appID, Version: ac.version, Track: ac.track}
+}
+
+// putCache records a well-formed update check response. The cache is
+// only an optimization so failing to write it is not an error.
+func (ac *AppClient) putCache(u *omaha.UpdateResponse) {
+	if ac.cache == nil || (u.Status != omaha.UpdateOK && u.Status != omaha.NoUpdate) {
+		return
+	}
+	ac.cache.Put(ac.cacheKey(), &CachedResponse{
+		Stored:      time.Now(),
+		UpdateCheck: u,
+	})
+}
+
+// checkCache returns a *CachedStatus if the update check failing with
+// err can be answered from the cache, or nil.
+func (ac *AppClient) checkCache(err error) *CachedStatus {
+	if ac.cache == nil || !serverUnreachable(err) {
+		return nil
+	}
+	cached, cerr := ac.cache.Get(ac.cacheKey())
+	if cerr != nil || cached == nil || time.Since(cached.Stored) > ac.cacheTTL {
+		return nil
+	}
+	return &CachedStatus{
+		UpdateCheck: cached.UpdateCheck,
+		Stored:      cached.Stored,
+		Err:         err,
+	}
+}
+
+// queueEvent queues req and sends everything in the queue, returning
+// the error for req's event if it was sent or the error that left it
+// queued. If another goroutine is already sending the queue, req is
+// left for it and nil is returned. Events are still sent directly if
+// the queue cannot be written.
+func (ac *AppClient) queueEvent(ctx context.Context, url string, req *omaha.Request) error {
+	ac.eventMu.Lock()
+	err := ac.events.Push(req)
+	ac.eventMu.Unlock()
+	if err != nil {
+		_, err := ac.doReq(ctx, url, req)
+		return err
+	}
+	return ac.flushEvents(ctx, url, eventKey(req))
+}
+
+// flushEvents sends queued events until the queue is empty or the
+// server is unreachable. The error for the event matching key, if any,
+// is returned. Only one goroutine flushes at a time so events stay in
+// order, but eventMu is released while each event is sent so queueing
+// new events never waits on the server.
+func (ac *AppClient) flushEvents(ctx context.Context, url, key string) error {
+	ac.eventMu.Lock()
+	if ac.flushing {
+		ac.eventMu.Unlock()
+		return nil
+	}
+	ac.flushing = true
+	ac.eventMu.Unlock()
+
+	var keyErr error
+	for {
+		ac.eventMu.Lock()
+		reqs, err := ac.events.Peek()
+		if err != nil || len(reqs) == 0 {
+			// Checked under the same lock as flushing is cleared
+			// so an event queued meanwhile is never left behind.
+			ac.flushing = false
+			ac.eventMu.Unlock()
+			if err != nil {
+				return err
+			}
+			return keyErr
+		}
+		ac.eventMu.Unlock()
+
+		req := reqs[0]
+		_, err = ac.doReq(ctx, url, req)
+		ac.eventMu.Lock()
+		if serverUnreachable(err) {
+			ac.flushing = false
+			ac.eventMu.Unlock()
+			return err
+		}
+		if eventKey(req) == key {
+			keyErr = err
+		}
+		err = ac.events.Pop(1)
+		if err != nil {
+			ac.flushing = false
+		}
+		ac.eventMu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// eventKey identifies duplicate event requests. The request and session
+// IDs differ between retries so only the app and events are compared.
+func eventKey(req *omaha.Request) string {
+	var parts []string
+	for _, app := range req.Apps {
+		parts = append(parts, app.ID, app.Version, app.Track)
+		for _, event := range app.Events {
+			raw, _ := xml.Marshal(event)
+			parts = append(parts, string(raw))
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// FileCache is a ResponseCache storing each response in a JSON file
+// in a directory, which is created if needed.
+type FileCache struct {
+	dir string
+}
+
+func NewFileCache(dir string) *FileCache {
+	return &FileCache{dir: dir}
+}
+
+type cacheFile struct {
+	Stored      time.Time `json:"stored"`
+	UpdateCheck string    `json:"updatecheck"`
+}
+
+func (fc *FileCache) path(key CacheKey) string {
+	sum := sha256.Sum256([]byte(key.AppID + "\n" + key.Version + "\n" + key.Track))
+	return filepath.Join(fc.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (fc *FileCache) Get(key CacheKey) (*CachedResponse, error) {
+	data, err := ioutil.ReadFile(fc.path(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var f cacheFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("omaha: invalid cached response: %v", err)
+	}
+	u := &omaha.UpdateResponse{}
+	if err := xml.Unmarshal([]byte(f.UpdateCheck), u); err != nil {
+		return nil, fmt.Errorf("omaha: invalid cached response: %v", err)
+	}
+	return &CachedResponse{Stored: f.Stored, UpdateCheck: u}, nil
+}
+
+func (fc *FileCache) Put(key CacheKey, resp *CachedResponse) error {
+	body, err := xml.Marshal(resp.UpdateCheck)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(&cacheFile{
+		Stored:      resp.Stored,
+		UpdateCheck: string(body),
+	})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fc.path(key), data)
+}
+
+// FileQueue is an EventQueue stored in a single JSON file, which is
+// created along with its directory if needed.
+type FileQueue struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewFileQueue(path string) *FileQueue {
+	return &FileQueue{path: path}
+}
+
+type queueEntry struct {
+	Key     string `json:"key"`
+	Request string `json:"request"`
+}
+
+func (fq *FileQueue) load() ([]queueEntry, error) {
+	data, err := ioutil.ReadFile(fq.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var entries []queueEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("omaha: invalid event queue: %v", err)
+	}
+	return entries, nil
+}
+
+func (fq *FileQueue) store(entries []queueEntry) error {
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fq.path, data)
+}
+
+func (fq *FileQueue) Push(req *omaha.Request) error {
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+
+	entries, err := fq.load()
+	if err != nil {
+		return err
+	}
+
+	key := eventKey(req)
+	for _, e := range entries {
+		if e.Key == key {
+			return nil
+		}
+	}
+
+	body, err := xml.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return fq.store(append(entries, queueEntry{Key: key, Request: string(body)}))
+}
+
+func (fq *FileQueue) Peek() ([]*omaha.Request, error) {
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+
+	entries, err := fq.load()
+	if err != nil {
+		return nil, err
+	}
+
+	reqs := make([]*omaha.Request, len(entries))
+	for i, e := range entries {
+		reqs[i], err = omaha.ParseRequest("", strings.NewReader(e.Request))
+		if err != nil {
+			return nil, fmt.Errorf("omaha: invalid event queue: %v", err)
+		}
+	}
+	return reqs, nil
+}
+
+func (fq *FileQueue) Pop(n int) error {
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+
+	entries, err := fq.load()
+	if err != nil {
+		return err
+	}
+	if n > len(entries) {
+		n = len(entries)
+	}
+	return fq.store(entries[n:])
+}
+
+// writeFileAtomic replaces path with data so readers never see a
+// partially written file.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
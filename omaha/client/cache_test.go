@@ -0,0 +1,339 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-omaha/omaha"
+)
+
+func newCacheTestDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "go-omaha-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// newRecordingStatusServer is a statusServer that starts out working
+// and records requests like newRecordingServer.
+func newRecordingStatusServer(t *testing.T, u *omaha.Update) (*recorder, *statusServer) {
+	r := &recorder{t: t, update: u}
+	s := newStatusServer(http.StatusServiceUnavailable, 0)
+	s.handler.Updater = r
+	return r, s
+}
+
+func (s *statusServer) setFails(fails int) {
+	s.mu.Lock()
+	s.fails = fails
+	s.mu.Unlock()
+}
+
+func TestFileCache(t *testing.T) {
+	dir := newCacheTestDir(t)
+	defer os.RemoveAll(dir)
+
+	fc := NewFileCache(filepath.Join(dir, "cache"))
+	key := CacheKey{AppID: "app-id", Version: "0.0.0", Track: "stable"}
+	if cached, err := fc.Get(key); err != nil || cached != nil {
+		t.Fatalf("empty cache returned %v, %v", cached, err)
+	}
+
+	resp := omaha.NewResponse()
+	u := resp.AddApp("app-id", omaha.AppOK).AddUpdateCheck(omaha.UpdateOK)
+	u.AddURL("https://example.com/")
+	u.AddManifest("1.1.0")
+	stored := time.Now().Round(time.Second)
+	if err := fc.Put(key, &CachedResponse{Stored: stored, UpdateCheck: u}); err != nil {
+		t.Fatal(err)
+	}
+
+	cached, err := fc.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cached.Stored.Equal(stored) || cached.UpdateCheck.Status != omaha.UpdateOK ||
+		cached.UpdateCheck.Manifest.Version != "1.1.0" || len(cached.UpdateCheck.URLs) != 1 {
+		t.Errorf("unexpected cached response: %+v", cached.UpdateCheck)
+	}
+
+	key.Track = "beta"
+	if cached, err := fc.Get(key); err != nil || cached != nil {
+		t.Errorf("other track returned %v, %v", cached, err)
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	dir := newCacheTestDir(t)
+	defer os.RemoveAll(dir)
+
+	_, s := newRecordingStatusServer(t, &omaha.Update{
+		Manifest: omaha.Manifest{Version: "1.1.1"},
+	})
+	defer s.Close()
+
+	ac, err := NewAppClient(s.URL, "client-id", "app-id", "0.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac.SetRetryPolicy(testRetryPolicy)
+	ac.SetResponseCache(NewFileCache(dir), time.Hour)
+
+	if _, err := ac.UpdateCheck(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Server down, answered from the cache.
+	s.setFails(-1)
+	_, err = ac.UpdateCheck()
+	if cs, ok := err.(*CachedStatus); !ok {
+		t.Fatalf("unexpected error: %v", err)
+	} else if cs.UpdateCheck.Status != omaha.UpdateOK || cs.UpdateCheck.Manifest.Version != "1.1.1" {
+		t.Errorf("unexpected cached response: %+v", cs.UpdateCheck)
+	} else if !serverUnreachable(cs.Err) {
+		t.Errorf("unexpected server error: %v", cs.Err)
+	}
+
+	// Server recovered, answered by the server again.
+	s.setFails(0)
+	if _, err := ac.UpdateCheck(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Stale responses are not used.
+	ac.SetResponseCache(NewFileCache(dir), 0)
+	s.setFails(-1)
+	if _, err := ac.UpdateCheck(); !serverUnreachable(err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestResponseCacheFallback(t *testing.T) {
+	dir := newCacheTestDir(t)
+	defer os.RemoveAll(dir)
+
+	_, s := newRecordingStatusServer(t, &omaha.Update{
+		Manifest: omaha.Manifest{Version: "1.1.1"},
+	})
+	defer s.Close()
+
+	ac := newFallbackClient(t, s.URL, time.Now())
+	ac.SetResponseCache(NewFileCache(dir), time.Hour)
+	if _, err := ac.UpdateCheck(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cached response is preferred over the fallback no matter
+	// how many checks fail.
+	s.setFails(-1)
+	for i := 0; i < 3; i++ {
+		_, err := ac.UpdateCheck()
+		if cs, ok := err.(*CachedStatus); !ok {
+			t.Fatalf("check %d: unexpected error: %v", i, err)
+		} else if cs.UpdateCheck.Status != omaha.UpdateOK {
+			t.Errorf("check %d: unexpected cached response: %+v", i, cs.UpdateCheck)
+		}
+	}
+
+	// Once the cache is stale the failures so far count towards
+	// the fallback.
+	ac.SetResponseCache(NewFileCache(dir), 0)
+	if _, err := ac.UpdateCheck(); err == nil {
+		t.Fatal("update check succeeded")
+	} else if _, ok := err.(*FallbackStatus); !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestResponseCachePermanent(t *testing.T) {
+	dir := newCacheTestDir(t)
+	defer os.RemoveAll(dir)
+
+	_, s := newRecordingStatusServer(t, nil)
+	defer s.Close()
+	s.status = http.StatusBadRequest
+
+	ac, err := NewAppClient(s.URL, "client-id", "app-id", "0.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac.SetRetryPolicy(testRetryPolicy)
+	ac.SetResponseCache(NewFileCache(dir), time.Hour)
+
+	if _, err := ac.UpdateCheck(); err != omaha.NoUpdate {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	s.setFails(-1)
+	if _, err := ac.UpdateCheck(); err == nil {
+		t.Fatal("update check succeeded")
+	} else if _, ok := err.(*CachedStatus); ok {
+		t.Fatal("cache used for a permanent error")
+	}
+}
+
+func TestEventQueue(t *testing.T) {
+	dir := newCacheTestDir(t)
+	defer os.RemoveAll(dir)
+
+	r, s := newRecordingStatusServer(t, nil)
+	defer s.Close()
+
+	ac, err := NewAppClient(s.URL, "client-id", "app-id", "0.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac.SetRetryPolicy(testRetryPolicy)
+	q := NewFileQueue(filepath.Join(dir, "events.json"))
+	ac.SetEventQueue(q)
+
+	events := []*omaha.EventRequest{
+		{Type: omaha.EventTypeUpdateDownloadStarted, Result: omaha.EventResultSuccess},
+		{Type: omaha.EventTypeUpdateDownloadFinished, Result: omaha.EventResultSuccess},
+		{Type: omaha.EventTypeInstallComplete, Result: omaha.EventResultSuccess},
+	}
+
+	// Server down, events are queued and retries of the same event
+	// are only queued once.
+	s.setFails(-1)
+	for _, event := range append(events, events[0]) {
+		if err := <-ac.Event(event); !serverUnreachable(err) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if reqs, err := q.Peek(); err != nil {
+		t.Fatal(err)
+	} else if len(reqs) != len(events) {
+		t.Fatalf("expected %d queued events, not %d", len(events), len(reqs))
+	}
+	if len(r.events) != 0 {
+		t.Fatalf("events sent while server down: %v", r.events)
+	}
+
+	// Server recovered, the queue is sent in order after a ping.
+	s.setFails(0)
+	if err := ac.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.events) != len(events) {
+		t.Fatalf("expected %d events, not %d", len(events), len(r.events))
+	}
+	for i, event := range events {
+		if r.events[i].Type != event.Type {
+			t.Errorf("event %d: expected %v, not %v", i, event.Type, r.events[i].Type)
+		}
+	}
+	if reqs, err := q.Peek(); err != nil {
+		t.Fatal(err)
+	} else if len(reqs) != 0 {
+		t.Fatalf("%d events left in queue", len(reqs))
+	}
+
+	// Later events are sent immediately.
+	if err := <-ac.Event(events[0]); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.events) != len(events)+1 {
+		t.Fatalf("expected %d events, not %d", len(events)+1, len(r.events))
+	}
+}
+
+// blockingUpdater holds the first event it receives until release is
+// closed.
+type blockingUpdater struct {
+	omaha.UpdaterStub
+	started chan struct{}
+	release chan struct{}
+
+	mu     sync.Mutex
+	events []omaha.EventType
+}
+
+func (b *blockingUpdater) Event(req *omaha.Request, app *omaha.AppRequest, event *omaha.EventRequest) {
+	b.mu.Lock()
+	first := len(b.events) == 0
+	b.events = append(b.events, event.Type)
+	b.mu.Unlock()
+	if first {
+		close(b.started)
+		<-b.release
+	}
+}
+
+func TestEventQueueConcurrent(t *testing.T) {
+	dir := newCacheTestDir(t)
+	defer os.RemoveAll(dir)
+
+	b := &blockingUpdater{
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	s := httptest.NewServer(&omaha.OmahaHandler{Updater: b})
+	defer s.Close()
+
+	ac, err := NewAppClient(s.URL, "client-id", "app-id", "0.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac.SetRetryPolicy(testRetryPolicy)
+	q := NewFileQueue(filepath.Join(dir, "events.json"))
+	ac.SetEventQueue(q)
+
+	first := ac.Event(&omaha.EventRequest{
+		Type:   omaha.EventTypeUpdateDownloadStarted,
+		Result: omaha.EventResultSuccess,
+	})
+	<-b.started
+
+	// Queueing an event must not wait for the server to answer the
+	// event being sent.
+	select {
+	case err := <-ac.Event(&omaha.EventRequest{
+		Type:   omaha.EventTypeUpdateDownloadFinished,
+		Result: omaha.EventResultSuccess,
+	}):
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("event queueing blocked by a flush")
+	}
+
+	close(b.release)
+	if err := <-first; err != nil {
+		t.Fatal(err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.events) != 2 || b.events[0] != omaha.EventTypeUpdateDownloadStarted ||
+		b.events[1] != omaha.EventTypeUpdateDownloadFinished {
+		t.Errorf("unexpected events: %v", b.events)
+	}
+	if reqs, err := q.Peek(); err != nil {
+		t.Fatal(err)
+	} else if len(reqs) != 0 {
+		t.Errorf("%d events left in queue", len(reqs))
+	}
+}
@@ -16,10 +16,13 @@
 package client
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/url"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/satori/go.uuid"
 
@@ -44,7 +47,22 @@ type Client struct {
 	sessionID     string
 	isMachine     bool
 	sentPing      bool
+	minimalAck    bool
 	apps          map[string]*AppClient
+
+	downloadBackoffBase time.Duration
+	downloadBackoffMax  time.Duration
+
+	fallback         *Fallback
+	fallbackMaxAge   time.Duration
+	fallbackFailures int
+	checkFailures    int
+
+	cache    ResponseCache
+	cacheTTL time.Duration
+	events   EventQueue
+	eventMu  sync.Mutex
+	flushing bool
 }
 
 // AppClient supports managing a single application.
@@ -62,6 +80,9 @@ func New(serverURL, userID string) (*Client, error) {
 	if userID == "" {
 		return nil, errors.New("omaha: empty user identifier")
 	}
+	if err := checkUTF8("user identifier", userID); err != nil {
+		return nil, err
+	}
 
 	c := &Client{
 		apiClient:     newHTTPClient(),
@@ -69,6 +90,9 @@ func New(serverURL, userID string) (*Client, error) {
 		userID:        userID,
 		sessionID:     uuid.NewV4().String(),
 		apps:          make(map[string]*AppClient),
+
+		downloadBackoffBase: defaultDownloadBackoffBase,
+		downloadBackoffMax:  defaultDownloadBackoffMax,
 	}
 
 	if err := c.SetServerURL(serverURL); err != nil {
@@ -79,30 +103,67 @@ func New(serverURL, userID string) (*Client, error) {
 }
 
 // SetServerURL changes the Omaha server this client talks to.
-// If the URL does not include a path component /v1/update/ is assumed.
+// The URL must be absolute http or https and may not have a fragment.
+// If the URL has no path, or just "/", /v1/update/ is assumed. Any
+// other path, including its escaping and trailing slash or lack of
+// one, and any query are sent exactly as given.
 func (c *Client) SetServerURL(serverURL string) error {
+	endpoint, err := parseServerURL(serverURL)
+	if err != nil {
+		return err
+	}
+
+	c.apiEndpoint = endpoint
+	return nil
+}
+
+// parseServerURL validates serverURL as described by SetServerURL,
+// returning the endpoint to post requests to.
+func parseServerURL(serverURL string) (string, error) {
 	u, err := url.Parse(serverURL)
 	if err != nil {
-		return fmt.Errorf("omaha: invalid server URL: %v", err)
+		return "", fmt.Errorf("omaha: invalid server URL: %v", err)
 	}
 	if u.Scheme != "http" && u.Scheme != "https" {
-		return fmt.Errorf("omaha: invalid server protocol: %s", u)
+		return "", fmt.Errorf("omaha: invalid server protocol: %s", u)
+	}
+	if u.Host == "" || u.Opaque != "" {
+		return "", fmt.Errorf("omaha: invalid server host: %s", u)
 	}
-	if u.Host == "" {
-		return fmt.Errorf("omaha: invalid server host: %s", u)
+	if u.Fragment != "" {
+		return "", fmt.Errorf("omaha: invalid server URL fragment: %s", u)
 	}
 	if u.Path == "" || u.Path == "/" {
-		u.Path = "/v1/update/"
+		u.Path, u.RawPath = "/v1/update/", ""
 	}
 
-	c.apiEndpoint = u.String()
-	return nil
+	return u.String(), nil
 }
 
 // SetClientVersion sets the identifier of this updater application.
 // e.g. "update_engine-0.1.0".  Default is "go-omaha".
-func (c *Client) SetClientVersion(clientVersion string) {
+// Values that are not valid UTF-8 are rejected with an error, which
+// earlier versions of this method did not return.
+func (c *Client) SetClientVersion(clientVersion string) error {
+	if err := checkUTF8("client version", clientVersion); err != nil {
+		return err
+	}
+
 	c.clientVersion = clientVersion
+	return nil
+}
+
+// SetCompression enables gzip compression of request bodies. Only enable
+// this for servers that accept a gzip Content-Encoding. Compressed
+// responses are always accepted regardless of this setting.
+func (c *Client) SetCompression(enabled bool) {
+	c.apiClient.compress = enabled
+}
+
+// SetMinimalAck asks the server for minimal responses to events. Only
+// servers built with go-omaha support this, others ignore the request.
+func (c *Client) SetMinimalAck(enabled bool) {
+	c.minimalAck = enabled
 }
 
 // NextPing returns a timer channel that will fire when the next update
@@ -129,6 +190,9 @@ func (c *Client) NewAppClient(appID, appVersion string) (*AppClient, error) {
 	if _, ok := c.apps[appID]; ok {
 		return nil, fmt.Errorf("omaha: duplicate app client %q", appID)
 	}
+	if err := checkUTF8("application id", appID); err != nil {
+		return nil, err
+	}
 
 	ac := &AppClient{
 		Client: c,
@@ -148,6 +212,10 @@ func NewAppClient(serverURL, userID, appID, appVersion string) (*AppClient, erro
 	}
 
 	ac, err := c.NewAppClient(appID, appVersion)
+	if err != nil {
+		return nil, err
+	}
+
 	if err := ac.SetVersion(appVersion); err != nil {
 		return nil, err
 	}
@@ -163,6 +231,9 @@ func (ac *AppClient) SetAppID(appID string) error {
 	if _, ok := ac.apps[appID]; ok {
 		return fmt.Errorf("omaha: duplicate app %q", appID)
 	}
+	if err := checkUTF8("application id", appID); err != nil {
+		return err
+	}
 
 	delete(ac.apps, ac.appID)
 	ac.appID = appID
@@ -175,6 +246,9 @@ func (ac *AppClient) SetVersion(version string) error {
 	if version == "" {
 		return errors.New("omaha: empty application version")
 	}
+	if err := checkUTF8("application version", version); err != nil {
+		return err
+	}
 
 	ac.version = version
 	return nil
@@ -189,6 +263,9 @@ func (ac *AppClient) SetTrack(track string) error {
 	if track == "" {
 		return errors.New("omaha: empty application update track/group")
 	}
+	if err := checkUTF8("application update track/group", track); err != nil {
+		return err
+	}
 
 	ac.track = track
 	return nil
@@ -196,11 +273,35 @@ func (ac *AppClient) SetTrack(track string) error {
 
 // SetOEM sets the application OEM name.
 // This is a update_engine/Core Update protocol extension.
-func (ac *AppClient) SetOEM(oem string) {
+// Values that are not valid UTF-8 are rejected with an error, which
+// earlier versions of this method did not return.
+func (ac *AppClient) SetOEM(oem string) error {
+	if err := checkUTF8("application OEM", oem); err != nil {
+		return err
+	}
+
 	ac.oem = oem
+	return nil
+}
+
+// checkUTF8 rejects values encoding/xml would silently mangle.
+func checkUTF8(name, value string) error {
+	if !utf8.ValidString(value) {
+		return fmt.Errorf("omaha: %s is not valid UTF-8: %q", name, value)
+	}
+	return nil
 }
 
+// UpdateCheck is UpdateCheckContext with a background context.
 func (ac *AppClient) UpdateCheck() (*omaha.UpdateResponse, error) {
+	return ac.UpdateCheckContext(context.Background())
+}
+
+// UpdateCheckContext checks for an update, sending a ping along with it.
+// Retries are abandoned if ctx is canceled. If the server is unreachable
+// the error may be a *CachedStatus if a response cache is configured or
+// a *FallbackStatus if a fallback is configured.
+func (ac *AppClient) UpdateCheckContext(ctx context.Context) (*omaha.UpdateResponse, error) {
 	req := ac.NewAppRequest()
 	app := req.Apps[0]
 	app.AddPing()
@@ -213,10 +314,17 @@ func (ac *AppClient) UpdateCheck() (*omaha.UpdateResponse, error) {
 
 	ac.sentPing = true
 
-	appResp, err := ac.SendAppRequest(req)
+	appResp, err := ac.SendAppRequestContext(ctx, req)
 	if err != nil {
-		return nil, err
+		// A recent answer from the server beats the fallback, but
+		// the failure still counts towards using the fallback.
+		if cs := ac.checkCache(err); cs != nil {
+			ac.checkFailures++
+			return nil, cs
+		}
+		return nil, ac.checkFallback(err)
 	}
+	ac.checkFailures = 0
 
 	// BUG: CoreUpdate does not send ping status in response.
 	/*if appResp.Ping == nil {
@@ -232,6 +340,7 @@ func (ac *AppClient) UpdateCheck() (*omaha.UpdateResponse, error) {
 		ac.Event(NewErrorEvent(ExitCodeOmahaResponseInvalid))
 		return nil, fmt.Errorf("omaha: update check missing from response")
 	}
+	ac.putCache(appResp.UpdateCheck)
 
 	if appResp.UpdateCheck.Status != omaha.UpdateOK {
 		return nil, appResp.UpdateCheck.Status
@@ -240,14 +349,21 @@ func (ac *AppClient) UpdateCheck() (*omaha.UpdateResponse, error) {
 	return appResp.UpdateCheck, nil
 }
 
+// Ping is PingContext with a background context.
 func (ac *AppClient) Ping() error {
+	return ac.PingContext(context.Background())
+}
+
+// PingContext sends a ping without checking for updates.
+// Retries are abandoned if ctx is canceled.
+func (ac *AppClient) PingContext(ctx context.Context) error {
 	req := ac.NewAppRequest()
 	app := req.Apps[0]
 	app.AddPing()
 
 	ac.sentPing = true
 
-	appResp, err := ac.SendAppRequest(req)
+	appResp, err := ac.SendAppRequestContext(ctx, req)
 	if err != nil {
 		return err
 	}
@@ -267,16 +383,24 @@ func (ac *AppClient) Ping() error {
 }
 
 // Event asynchronously sends the given omaha event.
-// Reading the error channel is optional.
+// Reading the error channel is optional. If an event queue is configured
+// events are sent in order, and an event that cannot reach the server is
+// queued rather than lost.
 func (ac *AppClient) Event(event *omaha.EventRequest) <-chan error {
 	errc := make(chan error, 1)
 	url := ac.apiEndpoint
 	req := ac.NewAppRequest()
+	req.MinimalAck = ac.minimalAck
 	app := req.Apps[0]
 	app.Events = append(app.Events, event)
 
 	go func() {
-		appResp, err := ac.doReq(url, req)
+		if ac.events != nil {
+			errc <- ac.queueEvent(context.Background(), url, req)
+			return
+		}
+
+		appResp, err := ac.doReq(context.Background(), url, req)
 		if err != nil {
 			errc <- err
 			return
@@ -305,8 +429,10 @@ func (ac *AppClient) Event(event *omaha.EventRequest) <-chan error {
 func (ac *AppClient) NewAppRequest() *omaha.Request {
 	req := omaha.NewRequest()
 	req.Version = ac.clientVersion
+	req.UpdaterVersion = ac.clientVersion
 	req.UserID = ac.userID
 	req.SessionID = ac.sessionID
+	req.SetRequestID("")
 	if ac.isMachine {
 		req.IsMachine = 1
 	}
@@ -326,9 +452,16 @@ func (ac *AppClient) NewAppRequest() *omaha.Request {
 }
 
 // SendAppRequest sends a Request object and validates the response.
-// On failure an error event is automatically sent to the server.
+// On failure an error event is automatically sent to the server. On
+// success any queued events are sent.
 func (ac *AppClient) SendAppRequest(req *omaha.Request) (*omaha.AppResponse, error) {
-	resp, err := ac.doReq(ac.apiEndpoint, req)
+	return ac.SendAppRequestContext(context.Background(), req)
+}
+
+// SendAppRequestContext is SendAppRequest, abandoning retries if ctx
+// is canceled.
+func (ac *AppClient) SendAppRequestContext(ctx context.Context, req *omaha.Request) (*omaha.AppResponse, error) {
+	resp, err := ac.doReq(ctx, ac.apiEndpoint, req)
 	if _, ok := err.(omaha.AppStatus); ok {
 		// No point to sending an error if we got a well-formed
 		// non-ok application status in the response.
@@ -336,22 +469,28 @@ func (ac *AppClient) SendAppRequest(req *omaha.Request) (*omaha.AppResponse, err
 		ac.Event(err.ErrorEvent())
 	} else if err != nil {
 		ac.Event(NewErrorEvent(ExitCodeOmahaRequestError))
+	} else if ac.events != nil {
+		ac.flushEvents(ctx, ac.apiEndpoint, "")
 	}
 	return resp, err
 }
 
 // doReq posts an omaha request. It may be called in its own goroutine so
 // it should not touch any mutable data in AppClient, but apiClient is ok.
-func (ac *AppClient) doReq(url string, req *omaha.Request) (*omaha.AppResponse, error) {
+func (ac *AppClient) doReq(ctx context.Context, url string, req *omaha.Request) (*omaha.AppResponse, error) {
 	if len(req.Apps) != 1 {
 		panic(fmt.Errorf("unexpected number of apps: %d", len(req.Apps)))
 	}
 	appID := req.Apps[0].ID
-	resp, err := ac.apiClient.Omaha(url, req)
+	resp, err := ac.apiClient.Omaha(ctx, url, req)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := resp.Validate(req); err != nil {
+		return nil, &omahaError{err, ExitCodeOmahaResponseInvalid}
+	}
+
 	appResp := resp.GetApp(appID)
 	if appResp == nil {
 		return nil, &omahaError{
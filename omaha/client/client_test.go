@@ -15,6 +15,8 @@
 package client
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"testing"
 
@@ -50,6 +52,9 @@ func (r *recorder) CheckApp(req *omaha.Request, app *omaha.AppRequest) error {
 	if app.BootID != req.SessionID {
 		r.t.Errorf("BootID %q != SessionID %q", app.BootID, req.SessionID)
 	}
+	if len(req.RequestID) != 38 || req.RequestID == req.SessionID {
+		r.t.Errorf("RequestID %q is not a unique UUID", req.RequestID)
+	}
 	if req.UserID == "" {
 		r.t.Error("UserID is blank")
 	}
@@ -197,3 +202,141 @@ func TestClientEvent(t *testing.T) {
 		t.Fatalf("sent != received:\n%#v\n%#v", event, r.events[0])
 	}
 }
+
+func TestClientInvalidUTF8(t *testing.T) {
+	if _, err := NewAppClient("http://localhost", "client-id", "app-\xff", "0.0.0"); err == nil {
+		t.Error("invalid app id accepted")
+	}
+
+	ac, err := NewAppClient("http://localhost", "client-id", "app-id", "0.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ac.SetClientVersion("go-omaha\xff"); err == nil {
+		t.Error("invalid client version accepted")
+	}
+	if err := ac.SetOEM("ec\xfe3000"); err == nil {
+		t.Error("invalid OEM accepted")
+	}
+	if err := ac.SetTrack("stable\xff"); err == nil {
+		t.Error("invalid track accepted")
+	}
+	if err := ac.SetVersion("1.0.\xff"); err == nil {
+		t.Error("invalid version accepted")
+	}
+	if err := ac.SetOEM("ec3000"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClientMinimalAck(t *testing.T) {
+	r, s := newRecordingServer(t, nil)
+	defer s.Destroy()
+
+	url := "http://" + s.Addr().String()
+	ac, err := NewAppClient(url, "client-id", "app-id", "0.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac.SetMinimalAck(true)
+
+	event := &omaha.EventRequest{
+		Type:   omaha.EventTypeDownloadComplete,
+		Result: omaha.EventResultSuccess,
+	}
+	if err := <-ac.Event(event); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.events) != 1 {
+		t.Fatalf("expected 1 event, not %d", len(r.events))
+	}
+
+	// Update checks still get a full response.
+	if _, err := ac.UpdateCheck(); err != omaha.NoUpdate {
+		t.Fatalf("expected noupdate, got %v", err)
+	}
+}
+
+func TestClientUnexpectedMinimalAck(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+		w.Write([]byte(`<response protocol="3.0" minimalack="true"><app appid="app-id" status="ok"><event status="ok"></event></app></response>`))
+	}))
+	defer s.Close()
+
+	ac, err := NewAppClient(s.URL, "client-id", "app-id", "0.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := &omaha.EventRequest{
+		Type:   omaha.EventTypeDownloadComplete,
+		Result: omaha.EventResultSuccess,
+	}
+	err = <-ac.Event(event)
+	if ee, ok := err.(ErrorEvent); !ok {
+		t.Fatalf("unexpected error: %v", err)
+	} else if code := ee.ErrorEvent().ErrorCode; code != omaha.ErrorCode(ExitCodeOmahaResponseInvalid) {
+		t.Errorf("unexpected error code %d", code)
+	}
+}
+
+func TestClientServerURL(t *testing.T) {
+	var target string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target = r.RequestURI
+		w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+		w.Write([]byte(`<response protocol="3.0"><app appid="app-id" status="ok"><ping status="ok"></ping></app></response>`))
+	}))
+	defer s.Close()
+
+	for _, tt := range []struct {
+		url    string
+		target string
+	}{
+		{"", "/v1/update/"},
+		{"/", "/v1/update/"},
+		{"?a=1", "/v1/update/?a=1"},
+		{"/?a=1", "/v1/update/?a=1"},
+		{"/v1/update/", "/v1/update/"},
+		{"/v1/update", "/v1/update"},
+		{"/custom/omaha", "/custom/omaha"},
+		{"/custom/omaha/", "/custom/omaha/"},
+		{"/custom/omaha?a=1&b=2", "/custom/omaha?a=1&b=2"},
+		{"/custom/omaha?a=1&a=2", "/custom/omaha?a=1&a=2"},
+		{"/custom%2Fomaha", "/custom%2Fomaha"},
+		{"//custom//omaha", "//custom//omaha"},
+	} {
+		ac, err := NewAppClient(s.URL+tt.url, "client-id", "app-id", "0.0.0")
+		if err != nil {
+			t.Errorf("%q: %v", tt.url, err)
+			continue
+		}
+		target = ""
+		if err := ac.Ping(); err != nil {
+			t.Errorf("%q: %v", tt.url, err)
+		}
+		if target != tt.target {
+			t.Errorf("%q: requested %q, expected %q", tt.url, target, tt.target)
+		}
+	}
+}
+
+func TestClientServerURLInvalid(t *testing.T) {
+	for _, u := range []string{
+		"",
+		"example.com",
+		"example.com/v1/update/",
+		"ftp://example.com/",
+		"https://",
+		"https:example.com",
+		"https:///v1/update/",
+		"https://example.com/v1/update/#frag",
+		"https://example.com/%zz",
+	} {
+		if _, err := New(u, "client-id"); err == nil {
+			t.Errorf("%q: expected an error", u)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/coreos/go-omaha/omaha"
+)
+
+const (
+	// default parameters for download retries
+	defaultDownloadBackoffBase = 10 * time.Second
+	defaultDownloadBackoffMax  = 10 * time.Minute
+)
+
+// number of times to try all of an update's URLs before giving up
+var downloadTries = 5
+
+// SetDownloadBackoff configures the exponential backoff between failed
+// package downloads. The first retry waits about base, doubling on each
+// subsequent failure up to max. Each delay is randomized by up to ±50%.
+func (c *Client) SetDownloadBackoff(base, max time.Duration) {
+	c.downloadBackoffBase = base
+	c.downloadBackoffMax = max
+}
+
+// downloadDelay applies jitter to the backoff d, limited to max.
+func downloadDelay(d, max time.Duration) time.Duration {
+	d = FuzzyDuration(d, d)
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// Download fetches a package listed in the update into dir, verifying its
+// size and hashes. Each URL is tried in order; if all fail the attempt is
+// retried after a backoff, unless the update's postinstall action sets
+// DisablePayloadBackoff in which case retries are immediate. Failures
+// implement ErrorEvent so they may be reported to the server.
+func (ac *AppClient) Download(update *omaha.UpdateResponse, pkg *omaha.Package, dir string) error {
+	return ac.DownloadContext(context.Background(), update, pkg, dir)
+}
+
+// DownloadContext is Download abandoning the transfer and any retries
+// once ctx is canceled, in which case ctx's error is returned. Packages
+// are fetched with the client's transport, so its TLS and proxy settings
+// apply, but not its request timeout since payloads may take far longer
+// than an Omaha exchange; use ctx to limit the total time.
+func (ac *AppClient) DownloadContext(ctx context.Context, update *omaha.UpdateResponse, pkg *omaha.Package, dir string) error {
+	if len(update.URLs) == 0 {
+		return &omahaError{
+			Err:  errors.New("update has no urls"),
+			Code: ExitCodeOmahaResponseInvalid,
+		}
+	}
+
+	backoff := true
+	if update.Manifest != nil {
+		a, _ := update.Manifest.Action(omaha.ActionEventPostInstall)
+		backoff = !a.PayloadBackoffDisabled()
+	}
+
+	urls := make([]string, len(update.URLs))
+	for i, u := range update.URLs {
+		urls[i] = u.CodeBase + pkg.Name
+	}
+	return ac.download(ctx, urls, pkg, backoff, dir)
+}
+
+// DownloadPayload fetches an update's payload into dir, see Download.
+func (ac *AppClient) DownloadPayload(p *omaha.Payload, dir string) error {
+	return ac.DownloadPayloadContext(context.Background(), p, dir)
+}
+
+// DownloadPayloadContext fetches an update's payload into dir, see
+// DownloadContext.
+func (ac *AppClient) DownloadPayloadContext(ctx context.Context, p *omaha.Payload, dir string) error {
+	if len(p.URLs) == 0 {
+		return &omahaError{
+			Err:  errors.New("payload has no urls"),
+			Code: ExitCodeOmahaResponseInvalid,
+		}
+	}
+	return ac.download(ctx, p.URLs, p.Package, !p.DisablePayloadBackoff, dir)
+}
+
+func (ac *AppClient) download(ctx context.Context, urls []string, pkg *omaha.Package, backoff bool, dir string) error {
+	var (
+		err   error
+		delay = ac.downloadBackoffBase
+		tries = downloadTries
+	)
+	// The client's Timeout is meant for Omaha exchanges, not payloads.
+	hc := &http.Client{Transport: ac.apiClient.Transport}
+	for {
+		for _, u := range urls {
+			if err = download(ctx, hc, u, pkg, dir); err == nil {
+				return nil
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+		}
+
+		tries--
+		if tries <= 0 {
+			return err
+		}
+
+		if backoff {
+			t := time.NewTimer(downloadDelay(delay, ac.downloadBackoffMax))
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return ctx.Err()
+			}
+			delay *= 2
+		}
+	}
+}
+
+// download fetches and verifies a single package from url.
+func download(ctx context.Context, hc *http.Client, url string, pkg *omaha.Package, dir string) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return &omahaError{err, ExitCodeDownloadTransferError}
+	}
+	resp, err := hc.Do(req.WithContext(ctx))
+	if err != nil {
+		return &omahaError{err, ExitCodeDownloadTransferError}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &omahaError{
+			Err:  fmt.Errorf("download failed: %s", resp.Status),
+			Code: ExitCodeDownloadTransferError,
+		}
+	}
+
+	tmp, err := ioutil.TempFile(dir, "."+pkg.Name)
+	if err != nil {
+		return &omahaError{err, ExitCodeDownloadWriteError}
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	// Write the payload while hashing it.
+	if err := pkg.VerifyReader(io.TeeReader(resp.Body, tmp)); err != nil {
+		switch err {
+		case omaha.PackageSizeMismatchError:
+			return &omahaError{err, ExitCodePayloadSizeMismatchError}
+		case omaha.PackageHashMismatchError:
+			return &omahaError{err, ExitCodePayloadHashMismatchError}
+		default:
+			return &omahaError{err, ExitCodeDownloadTransferError}
+		}
+	}
+
+	if err := tmp.Close(); err != nil {
+		return &omahaError{err, ExitCodeDownloadWriteError}
+	}
+
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, pkg.Name)); err != nil {
+		return &omahaError{err, ExitCodeDownloadWriteError}
+	}
+
+	return nil
+}
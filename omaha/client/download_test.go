@@ -0,0 +1,303 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-omaha/omaha"
+)
+
+const testPayload = "testing\n"
+
+// payloadServer serves testPayload after failing a number of times.
+type payloadServer struct {
+	*httptest.Server
+	mu     sync.Mutex
+	flakes int
+	reqs   int
+}
+
+func newPayloadServer(flakes int) *payloadServer {
+	p := &payloadServer{flakes: flakes}
+	p.Server = httptest.NewServer(http.HandlerFunc(p.serve))
+	return p
+}
+
+func (p *payloadServer) serve(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.reqs++
+	if p.flakes > 0 {
+		p.flakes--
+		http.Error(w, "Flake!", http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte(testPayload))
+}
+
+func newTestUpdate(url string, disableBackoff bool) (*omaha.UpdateResponse, *omaha.Package, error) {
+	u := &omaha.UpdateResponse{Status: omaha.UpdateOK}
+	u.AddURL(url + "/")
+	m := u.AddManifest("1.0.1")
+	pkg := m.AddPackage()
+	if err := pkg.FromReader(strings.NewReader(testPayload)); err != nil {
+		return nil, nil, err
+	}
+	pkg.Name = "update.gz"
+	a := m.AddAction("postinstall")
+	a.DisablePayloadBackoff = disableBackoff
+	return u, pkg, nil
+}
+
+func newTestAppClient(t *testing.T) *AppClient {
+	ac, err := NewAppClient("http://localhost", "client-id", "app-id", "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ac
+}
+
+func TestDownloadDelay(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		d := downloadDelay(time.Second, time.Minute)
+		if d < time.Second/2 || d > 3*time.Second/2 {
+			t.Fatalf("delay %v outside of jitter range", d)
+		}
+	}
+
+	if d := downloadDelay(time.Hour, time.Minute); d != time.Minute {
+		t.Errorf("delay %v exceeds max", d)
+	}
+}
+
+func TestDownloadRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-omaha-download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := newPayloadServer(2)
+	defer p.Close()
+
+	u, pkg, err := newTestUpdate(p.URL, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ac := newTestAppClient(t)
+	ac.SetDownloadBackoff(time.Millisecond, 10*time.Millisecond)
+	if err := ac.Download(u, pkg, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if p.reqs != 3 {
+		t.Errorf("expected 3 requests, not %d", p.reqs)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, pkg.Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != testPayload {
+		t.Errorf("unexpected payload %q", data)
+	}
+}
+
+func TestDownloadBackoffDisabled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-omaha-download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := newPayloadServer(2)
+	defer p.Close()
+
+	u, pkg, err := newTestUpdate(p.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The test would take hours if the backoff was honored.
+	ac := newTestAppClient(t)
+	ac.SetDownloadBackoff(time.Hour, time.Hour)
+	done := make(chan error, 1)
+	go func() { done <- ac.Download(u, pkg, dir) }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("download did not skip the backoff")
+	}
+
+	if p.reqs != 3 {
+		t.Errorf("expected 3 requests, not %d", p.reqs)
+	}
+}
+
+func TestDownloadCanceled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-omaha-download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := newPayloadServer(1)
+	defer p.Close()
+
+	u, pkg, err := newTestUpdate(p.URL, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The test would take hours if the backoff could not be canceled.
+	ac := newTestAppClient(t)
+	ac.SetDownloadBackoff(time.Hour, time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- ac.DownloadContext(ctx, u, pkg, dir) }()
+
+	select {
+	case err := <-done:
+		if err != context.DeadlineExceeded {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("download backoff not canceled")
+	}
+
+	if p.reqs != 1 {
+		t.Errorf("expected 1 request, not %d", p.reqs)
+	}
+}
+
+func TestDownloadTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-omaha-download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t)
+	p := &payloadServer{}
+	p.Server = httptest.NewUnstartedServer(http.HandlerFunc(p.serve))
+	p.TLS = &tls.Config{Certificates: []tls.Certificate{ca.issue(t, x509.ExtKeyUsageServerAuth)}}
+	p.StartTLS()
+	defer p.Close()
+
+	u, pkg, err := newTestUpdate(p.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Downloads must use the client's TLS settings.
+	ac := newTestAppClient(t)
+	ac.SetTLSConfig(&tls.Config{RootCAs: ca.pool})
+	if err := ac.Download(u, pkg, dir); err != nil {
+		t.Fatal(err)
+	}
+	if p.reqs != 1 {
+		t.Errorf("expected 1 request, not %d", p.reqs)
+	}
+}
+
+func TestDownloadPayload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-omaha-download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := newPayloadServer(1)
+	defer p.Close()
+
+	u, pkg, err := newTestUpdate(p.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkg.Required = true
+	payload, err := u.Payload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ac := newTestAppClient(t)
+	ac.SetDownloadBackoff(time.Hour, time.Hour)
+	if err := ac.DownloadPayload(payload, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, payload.Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != testPayload {
+		t.Errorf("unexpected payload %q", data)
+	}
+}
+
+func TestDownloadHashMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-omaha-download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := newPayloadServer(0)
+	defer p.Close()
+
+	u, pkg, err := newTestUpdate(p.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkg.SHA1 = "xxxxxxxxxxxxxxxxxxxxxxxxxxx="
+
+	ac := newTestAppClient(t)
+	err = ac.Download(u, pkg, dir)
+	if ee, ok := err.(ErrorEvent); !ok {
+		t.Fatalf("unexpected error: %v", err)
+	} else if code := ee.ErrorEvent().ErrorCode; code != omaha.ErrorCode(ExitCodePayloadHashMismatchError) {
+		t.Errorf("unexpected error code %d", code)
+	}
+
+	if p.reqs != downloadTries {
+		t.Errorf("expected %d requests, not %d", downloadTries, p.reqs)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("failed download left %d files behind", len(files))
+	}
+}
@@ -15,10 +15,10 @@
 package client
 
 import (
+	"context"
 	"encoding/xml"
 	"errors"
 	"io"
-	"net"
 	"net/http"
 	"time"
 
@@ -42,22 +42,8 @@ var (
 
 // retries and exponentially backs off for temporary network errors
 func expNetBackoff(f func() error) error {
-	var (
-		backoff = backoffStart
-		tries   = backoffTries
-	)
-	for {
-		err := f()
-		tries--
-		if tries <= 0 {
-			return err
-		}
-		if neterr, ok := err.(net.Error); !ok || !neterr.Temporary() {
-			return err
-		}
-		FuzzySleep(backoff, backoff)
-		backoff *= 2
-	}
+	_, err := defaultRetryPolicy().do(context.Background(), f)
+	return err
 }
 
 // xml doesn't return the standard io.ErrUnexpectedEOF so check for both.
@@ -48,7 +48,10 @@ func Example() {
 	}
 
 	// Client version is the name and version of this updater.
-	c.SetClientVersion("example-0.0.1")
+	if err := c.SetClientVersion("example-0.0.1"); err != nil {
+		fmt.Println(err)
+		return
+	}
 
 	// Use SIGUSR1 to trigger immediate update checks.
 	sigc := make(chan os.Signal, 1)
@@ -59,9 +62,9 @@ func Example() {
 	var source string
 	select {
 	case <-sigc:
-		source = "ondemandupdate"
+		source = omaha.InstallSourceOnDemand
 	case <-c.NextPing():
-		source = "scheduler"
+		source = omaha.InstallSourceScheduled
 	}
 
 	// TODO: pass source to UpdateCheck
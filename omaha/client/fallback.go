@@ -0,0 +1,182 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-omaha/omaha"
+)
+
+var fallbackSignatureError = errors.New("omaha: fallback response signature is invalid")
+
+// Fallback is a signed response bundled with a client for answering
+// update checks while the server is unreachable, typically telling the
+// client there is no update and to check again later.
+type Fallback struct {
+	Created  time.Time
+	Response *omaha.Response
+}
+
+// fallbackFile is the JSON encoding of a Fallback. The signature is an
+// ASN.1 encoded ECDSA signature of the SHA-256 digest of the creation
+// time in RFC 3339 format, a newline, and the response XML.
+type fallbackFile struct {
+	Created   string `json:"created"`
+	Response  string `json:"response"`
+	Signature []byte `json:"signature"`
+}
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+func (f *fallbackFile) digest() []byte {
+	h := sha256.New()
+	h.Write([]byte(f.Created))
+	h.Write([]byte{'\n'})
+	h.Write([]byte(f.Response))
+	return h.Sum(nil)
+}
+
+// SignFallback encodes and signs a fallback response file.
+func SignFallback(resp *omaha.Response, created time.Time, key *ecdsa.PrivateKey) ([]byte, error) {
+	body, err := xml.Marshal(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	f := fallbackFile{
+		Created:  created.UTC().Format(time.RFC3339),
+		Response: string(body),
+	}
+	r, s, err := ecdsa.Sign(rand.Reader, key, f.digest())
+	if err != nil {
+		return nil, err
+	}
+	if f.Signature, err = asn1.Marshal(ecdsaSignature{r, s}); err != nil {
+		return nil, err
+	}
+
+	return json.MarshalIndent(&f, "", "\t")
+}
+
+// ParseFallback verifies and decodes a fallback response file. Since a
+// fallback must never trigger an update, responses offering one are
+// rejected.
+func ParseFallback(data []byte, key *ecdsa.PublicKey) (*Fallback, error) {
+	var f fallbackFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("omaha: invalid fallback response: %v", err)
+	}
+
+	var sig ecdsaSignature
+	if rest, err := asn1.Unmarshal(f.Signature, &sig); err != nil || len(rest) != 0 {
+		return nil, fallbackSignatureError
+	}
+	if !ecdsa.Verify(key, f.digest(), sig.R, sig.S) {
+		return nil, fallbackSignatureError
+	}
+
+	created, err := time.Parse(time.RFC3339, f.Created)
+	if err != nil {
+		return nil, fmt.Errorf("omaha: invalid fallback response: %v", err)
+	}
+
+	resp, err := omaha.ParseResponse("", strings.NewReader(f.Response))
+	if err != nil {
+		return nil, fmt.Errorf("omaha: invalid fallback response: %v", err)
+	}
+	for _, app := range resp.Apps {
+		if app.UpdateCheck != nil && app.UpdateCheck.Status == omaha.UpdateOK {
+			return nil, fmt.Errorf("omaha: fallback response offers an update for %s", app.ID)
+		}
+	}
+
+	return &Fallback{Created: created, Response: resp}, nil
+}
+
+// LoadFallback reads, verifies, and decodes a fallback response file.
+func LoadFallback(path string, key *ecdsa.PublicKey) (*Fallback, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseFallback(data, key)
+}
+
+// FallbackStatus is the error returned by update checks answered from a
+// fallback response rather than the server. Status is the update check
+// status from the fallback and Err is the error from the server.
+type FallbackStatus struct {
+	Status  omaha.UpdateStatus
+	Created time.Time
+	Err     error
+}
+
+func (fs *FallbackStatus) Error() string {
+	return fmt.Sprintf("omaha: fallback response %s from %s, server unreachable: %v",
+		fs.Status, fs.Created.Format(time.RFC3339), fs.Err)
+}
+
+// SetFallback configures update checks to be answered from f once
+// failures consecutive checks have failed with transient errors,
+// until a check succeeds again. Fallbacks older than maxAge are never
+// used. Events are always sent to the server. A nil f disables this.
+func (c *Client) SetFallback(f *Fallback, maxAge time.Duration, failures int) {
+	c.fallback = f
+	c.fallbackMaxAge = maxAge
+	c.fallbackFailures = failures
+}
+
+// checkFallback counts consecutive transient update check failures,
+// returning a *FallbackStatus instead of err if the fallback applies.
+func (ac *AppClient) checkFallback(err error) error {
+	if !serverUnreachable(err) {
+		// The server was reachable.
+		ac.checkFailures = 0
+		return err
+	}
+
+	ac.checkFailures++
+	if ac.fallback == nil || ac.checkFailures < ac.fallbackFailures {
+		return err
+	}
+	if time.Since(ac.fallback.Created) > ac.fallbackMaxAge {
+		return err
+	}
+
+	appResp := ac.fallback.Response.GetApp(ac.appID)
+	if appResp == nil || appResp.UpdateCheck == nil {
+		return err
+	}
+
+	return &FallbackStatus{
+		Status:  appResp.UpdateCheck.Status,
+		Created: ac.fallback.Created,
+		Err:     err,
+	}
+}
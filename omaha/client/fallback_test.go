@@ -0,0 +1,153 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-omaha/omaha"
+)
+
+func newFallbackKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func signFallback(t *testing.T, key *ecdsa.PrivateKey, created time.Time) []byte {
+	resp := omaha.NewResponse()
+	app := resp.AddApp("app-id", omaha.AppOK)
+	app.AddUpdateCheck(omaha.NoUpdate)
+	data, err := SignFallback(resp, created, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestFallbackSignature(t *testing.T) {
+	key := newFallbackKey(t)
+	data := signFallback(t, key, time.Now())
+
+	f, err := ParseFallback(data, &key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if app := f.Response.GetApp("app-id"); app == nil || app.UpdateCheck.Status != omaha.NoUpdate {
+		t.Errorf("unexpected fallback response: %#v", f.Response)
+	}
+
+	other := newFallbackKey(t)
+	if _, err := ParseFallback(data, &other.PublicKey); err != fallbackSignatureError {
+		t.Errorf("other key: unexpected error: %v", err)
+	}
+
+	tampered := bytes.Replace(data, []byte("noupdate"), []byte("ok"), 1)
+	if _, err := ParseFallback(tampered, &key.PublicKey); err != fallbackSignatureError {
+		t.Errorf("tampered: unexpected error: %v", err)
+	}
+
+	// Even a correctly signed fallback may not offer an update.
+	resp := omaha.NewResponse()
+	resp.AddApp("app-id", omaha.AppOK).AddUpdateCheck(omaha.UpdateOK)
+	data, err = SignFallback(resp, time.Now(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseFallback(data, &key.PublicKey); err == nil {
+		t.Error("update accepted in fallback response")
+	}
+}
+
+func newFallbackClient(t *testing.T, url string, created time.Time) *AppClient {
+	key := newFallbackKey(t)
+	f, err := ParseFallback(signFallback(t, key, created), &key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ac, err := NewAppClient(url, "client-id", "app-id", "0.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac.SetRetryPolicy(testRetryPolicy)
+	ac.SetFallback(f, time.Hour, 2)
+	return ac
+}
+
+func TestFallbackRecovery(t *testing.T) {
+	s := newStatusServer(http.StatusServiceUnavailable, -1)
+	defer s.Close()
+	ac := newFallbackClient(t, s.URL, time.Now())
+
+	if _, err := ac.UpdateCheck(); err == nil {
+		t.Fatal("update check succeeded")
+	} else if _, ok := err.(*FallbackStatus); ok {
+		t.Fatal("fallback used after a single failure")
+	}
+
+	_, err := ac.UpdateCheck()
+	if fs, ok := err.(*FallbackStatus); !ok {
+		t.Fatalf("unexpected error: %v", err)
+	} else if fs.Status != omaha.NoUpdate {
+		t.Errorf("unexpected fallback status: %v", fs.Status)
+	}
+
+	s.mu.Lock()
+	s.fails = 0
+	s.mu.Unlock()
+
+	if _, err := ac.UpdateCheck(); err != omaha.NoUpdate {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ac.checkFailures != 0 {
+		t.Errorf("failure count not reset: %d", ac.checkFailures)
+	}
+}
+
+func TestFallbackStale(t *testing.T) {
+	s := newStatusServer(http.StatusServiceUnavailable, -1)
+	defer s.Close()
+	ac := newFallbackClient(t, s.URL, time.Now().Add(-2*time.Hour))
+
+	for i := 0; i < 3; i++ {
+		_, err := ac.UpdateCheck()
+		if _, ok := err.(*RequestError); !ok {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
+func TestFallbackPermanent(t *testing.T) {
+	s := newStatusServer(http.StatusBadRequest, -1)
+	defer s.Close()
+	ac := newFallbackClient(t, s.URL, time.Now())
+
+	for i := 0; i < 3; i++ {
+		if _, err := ac.UpdateCheck(); err == nil {
+			t.Fatal("update check succeeded")
+		} else if _, ok := err.(*FallbackStatus); ok {
+			t.Fatal("fallback used for a permanent error")
+		}
+	}
+}
@@ -16,9 +16,12 @@ package client
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/xml"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"time"
 
@@ -33,24 +36,76 @@ const (
 // and decoding as well as automatic retries on transient failures.
 type httpClient struct {
 	http.Client
+
+	// gzip request bodies
+	compress bool
+
+	retry RetryPolicy
 }
 
 func newHTTPClient() *httpClient {
-	return &httpClient{http.Client{
-		Timeout: defaultTimeout,
-	}}
+	return &httpClient{
+		Client: http.Client{
+			Timeout:   defaultTimeout,
+			Transport: newTransport(),
+		},
+		retry: defaultRetryPolicy(),
+	}
+}
+
+// newTransport returns a transport for talking to a single Omaha server.
+// Idle connections are kept for reuse between a client's periodic checks
+// and retries, but not indefinitely.
+func newTransport() *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConnsPerHost:   2,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
 }
 
 // doPost sends a single HTTP POST, returning a parsed omaha response.
-func (hc *httpClient) doPost(url string, reqBody []byte) (*omaha.Response, error) {
-	resp, err := hc.Post(url, "text/xml; charset=utf-8", bytes.NewReader(reqBody))
+// reqBody must already be compressed if hc.compress is set.
+func (hc *httpClient) doPost(ctx context.Context, url string, reqBody []byte) (*omaha.Response, error) {
+	httpReq, err := http.NewRequest("POST", url, bytes.NewReader(reqBody))
 	if err != nil {
 		return nil, &omahaError{err, ExitCodeOmahaRequestError}
 	}
+	httpReq = httpReq.WithContext(ctx)
+	httpReq.Header.Set("Content-Type", "text/xml; charset=utf-8")
+	httpReq.Header.Set("Accept-Encoding", "gzip")
+	if hc.compress {
+		httpReq.Header.Set("Content-Encoding", "gzip")
+	}
+
+	resp, err := hc.Do(httpReq)
+	if isCertificateError(err) {
+		return nil, &CertificateError{err}
+	} else if err != nil {
+		return nil, &omahaError{err, ExitCodeOmahaRequestError}
+	}
 	defer resp.Body.Close()
 
+	// Since Accept-Encoding is set explicitly the standard transport
+	// leaves decompressing the response to us.
+	var body io.Reader = resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, &omahaError{err, ExitCodeOmahaRequestXMLParseError}
+		}
+		defer gz.Close()
+		body = gz
+	}
+
 	// A response over 1M in size is certainly bogus.
-	respBody := &io.LimitedReader{R: resp.Body, N: 1024 * 1024}
+	respBody := &io.LimitedReader{R: body, N: 1024 * 1024}
 	contentType := resp.Header.Get("Content-Type")
 	omahaResp, err := omaha.ParseResponse(contentType, respBody)
 
@@ -71,18 +126,42 @@ func (hc *httpClient) doPost(url string, reqBody []byte) (*omaha.Response, error
 	return omahaResp, err
 }
 
-// Omaha encodes and sends an omaha request, retrying on any transient errors.
-func (hc *httpClient) Omaha(url string, req *omaha.Request) (resp *omaha.Response, err error) {
+// Omaha encodes and sends an omaha request, retrying on any transient
+// errors. Failures are reported as a *RequestError, along with the last
+// response if the server sent a well-formed one with its HTTP error.
+func (hc *httpClient) Omaha(ctx context.Context, url string, req *omaha.Request) (resp *omaha.Response, err error) {
 	buf := bytes.NewBufferString(xml.Header)
 	enc := xml.NewEncoder(buf)
 	if err := enc.Encode(req); err != nil {
 		return nil, fmt.Errorf("omaha: failed to encode request: %v", err)
 	}
 
-	expNetBackoff(func() error {
-		resp, err = hc.doPost(url, buf.Bytes())
+	body := buf.Bytes()
+	if hc.compress {
+		if body, err = gzipBytes(body); err != nil {
+			return nil, fmt.Errorf("omaha: failed to compress request: %v", err)
+		}
+	}
+
+	attempts, err := hc.retry.do(ctx, func() error {
+		resp, err = hc.doPost(ctx, url, body)
 		return err
 	})
+	if err != nil {
+		return resp, &RequestError{Attempts: attempts, Err: err}
+	}
+
+	return resp, nil
+}
 
-	return resp, err
+func gzipBytes(b []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	if _, err := gz.Write(b); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
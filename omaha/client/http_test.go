@@ -16,8 +16,12 @@ package client
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 
@@ -48,7 +52,7 @@ func TestHTTPClientDoPost(t *testing.T) {
 	c := newHTTPClient()
 	url := "http://" + s.Addr().String() + "/v1/update/"
 
-	resp, err := c.doPost(url, []byte(sampleRequest))
+	resp, err := c.doPost(context.Background(), url, []byte(sampleRequest))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -114,7 +118,7 @@ func TestHTTPClientError(t *testing.T) {
 	c := newHTTPClient()
 	url := "http://" + f.l.Addr().String()
 
-	_, err = c.doPost(url, []byte(sampleRequest))
+	_, err = c.doPost(context.Background(), url, []byte(sampleRequest))
 	switch err := err.(type) {
 	case nil:
 		t.Fatal("doPost succeeded but should have failed")
@@ -148,7 +152,7 @@ func TestHTTPClientRetry(t *testing.T) {
 	c := newHTTPClient()
 	url := "http://" + f.l.Addr().String()
 
-	resp, err := c.Omaha(url, req)
+	resp, err := c.Omaha(context.Background(), url, req)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -196,7 +200,7 @@ func TestHTTPClientLarge(t *testing.T) {
 	c := newHTTPClient()
 	url := "http://" + l.Addr().String()
 
-	_, err = c.doPost(url, []byte(sampleRequest))
+	_, err = c.doPost(context.Background(), url, []byte(sampleRequest))
 	if err != bodySizeError {
 		t.Errorf("Unexpected error: %v", err)
 	}
@@ -205,8 +209,105 @@ func TestHTTPClientLarge(t *testing.T) {
 	// through (which results in a different error internally)
 	s.Handler = http.HandlerFunc(largeHandler2)
 
-	_, err = c.doPost(url, []byte(sampleRequest))
+	_, err = c.doPost(context.Background(), url, []byte(sampleRequest))
 	if err != bodyEmptyError {
 		t.Errorf("Unexpected error: %v", err)
 	}
 }
+
+func TestHTTPClientCompress(t *testing.T) {
+	var encoding string
+	handler := &omaha.OmahaHandler{Updater: omaha.UpdaterStub{}}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding = r.Header.Get("Content-Encoding")
+		handler.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	req, err := omaha.ParseRequest("", strings.NewReader(sampleRequest))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, compress := range []bool{false, true} {
+		c := newHTTPClient()
+		c.compress = compress
+
+		resp, err := c.Omaha(context.Background(), s.URL, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Apps) != 1 || resp.Apps[0].Status != omaha.AppOK {
+			t.Fatalf("Bad response: %#v", resp)
+		}
+
+		if compress && encoding != "gzip" {
+			t.Errorf("Request was not compressed")
+		} else if !compress && encoding != "" {
+			t.Errorf("Request was compressed")
+		}
+	}
+}
+
+// gzipHandler always compresses its response.
+func gzipHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.Header().Set("Content-Encoding", "gzip")
+	gz := gzip.NewWriter(w)
+	gz.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><response protocol="3.0"><app appid="app" status="ok"></app></response>`))
+	gz.Close()
+}
+
+func TestHTTPClientGzipResponse(t *testing.T) {
+	var accept string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accept = r.Header.Get("Accept-Encoding")
+		gzipHandler(w, r)
+	}))
+	defer s.Close()
+
+	c := newHTTPClient()
+	resp, err := c.doPost(context.Background(), s.URL, []byte(sampleRequest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetApp("app") == nil {
+		t.Errorf("Bad response: %#v", resp)
+	}
+	if accept != "gzip" {
+		t.Errorf("Unexpected Accept-Encoding %q", accept)
+	}
+}
+
+func TestHTTPClientCompressedHandler(t *testing.T) {
+	var encoding string
+	handler := &omaha.OmahaHandler{
+		Updater:           omaha.UpdaterStub{},
+		CompressResponses: true,
+	}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r)
+		encoding = w.Header().Get("Content-Encoding")
+	}))
+	defer s.Close()
+
+	// Enough apps to push the response over the compression threshold.
+	req := omaha.NewRequest()
+	for i := 0; i < 20; i++ {
+		app := req.AddApp(fmt.Sprintf("{app-%d}", i), "1.0.0")
+		app.AddUpdateCheck()
+	}
+
+	c := newHTTPClient()
+	c.compress = true
+	resp, err := c.Omaha(context.Background(), s.URL, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Apps) != 20 {
+		t.Errorf("Expected 20 apps, not %d", len(resp.Apps))
+	}
+	if encoding != "gzip" {
+		t.Errorf("Response was not compressed")
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/coreos/go-omaha/omaha"
+)
+
+// RetryPolicy controls how requests to the Omaha server are retried.
+// Only transient failures are retried: network errors, timeouts, and
+// HTTP 5xx, 408 and 429 responses. Other HTTP errors and unparsable
+// responses fail immediately.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first.
+	MaxAttempts int
+
+	// Backoff is the delay before the first retry, doubling on each
+	// subsequent retry up to MaxBackoff if it is non-zero. Each delay
+	// is randomized by up to ±50%.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+func defaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: backoffTries,
+		Backoff:     backoffStart,
+	}
+}
+
+// SetRetryPolicy changes how failed requests are retried.
+func (c *Client) SetRetryPolicy(p RetryPolicy) {
+	c.apiClient.retry = p
+}
+
+// do calls f until it succeeds, fails permanently, the attempts are
+// exhausted or ctx is done. It returns the number of attempts made.
+func (p RetryPolicy) do(ctx context.Context, f func() error) (int, error) {
+	var (
+		attempts int
+		backoff  = p.Backoff
+	)
+	for {
+		err := f()
+		attempts++
+		if err != nil && ctx.Err() != nil {
+			// Report cancellation the same way whether it
+			// interrupted the request or the backoff.
+			return attempts, ctx.Err()
+		}
+		if err == nil || attempts >= p.MaxAttempts || !isTransient(err) {
+			return attempts, err
+		}
+
+		t := time.NewTimer(FuzzyDuration(backoff, backoff))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return attempts, ctx.Err()
+		case <-t.C:
+		}
+
+		backoff *= 2
+		if p.MaxBackoff != 0 && backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
+
+// isTransient reports whether a request failing with err may succeed
+// if tried again.
+func isTransient(err error) bool {
+	if oe, ok := err.(*omahaError); ok {
+		err = oe.Err
+	}
+	if ue, ok := err.(*url.Error); ok {
+		// The server closed or reset the connection. net/http does
+		// not export the error for closing an idle connection.
+		if ue.Err == io.EOF || ue.Err == io.ErrUnexpectedEOF ||
+			ue.Err.Error() == "http: server closed idle connection" {
+			return true
+		}
+		err = ue.Err
+	}
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return false
+	}
+	if _, ok := err.(*net.OpError); ok {
+		// Connections refused, reset, or otherwise failed.
+		return true
+	}
+	if neterr, ok := err.(net.Error); ok {
+		return neterr.Timeout() || neterr.Temporary()
+	}
+	return false
+}
+
+// RequestError is returned when a request to the Omaha server fails,
+// recording how many attempts were made.
+type RequestError struct {
+	Attempts int
+	Err      error
+}
+
+func (re *RequestError) Error() string {
+	return fmt.Sprintf("%v (%d attempts)", re.Err, re.Attempts)
+}
+
+// ErrorEvent passes through the underlying error's event, if any.
+func (re *RequestError) ErrorEvent() *omaha.EventRequest {
+	if ee, ok := re.Err.(ErrorEvent); ok {
+		return ee.ErrorEvent()
+	}
+	return NewErrorEvent(ExitCodeOmahaRequestError)
+}
@@ -0,0 +1,205 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-omaha/omaha"
+)
+
+var testRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	Backoff:     time.Millisecond,
+	MaxBackoff:  4 * time.Millisecond,
+}
+
+// statusServer fails requests with the given status a number of times.
+type statusServer struct {
+	*httptest.Server
+	handler omaha.OmahaHandler
+	mu      sync.Mutex
+	status  int
+	fails   int
+	reqs    int
+}
+
+func newStatusServer(status, fails int) *statusServer {
+	s := &statusServer{
+		handler: omaha.OmahaHandler{Updater: omaha.UpdaterStub{}},
+		status:  status,
+		fails:   fails,
+	}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+func (s *statusServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.reqs++
+	fail := s.fails != 0
+	if s.fails > 0 {
+		s.fails--
+	}
+	s.mu.Unlock()
+
+	if fail {
+		http.Error(w, http.StatusText(s.status), s.status)
+		return
+	}
+	s.handler.ServeHTTP(w, r)
+}
+
+func (s *statusServer) requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reqs
+}
+
+func newRetryClient() *httpClient {
+	c := newHTTPClient()
+	c.retry = testRetryPolicy
+	return c
+}
+
+func expectRequestError(t *testing.T, err error, attempts int) *RequestError {
+	re, ok := err.(*RequestError)
+	if !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if re.Attempts != attempts {
+		t.Errorf("expected %d attempts, not %d", attempts, re.Attempts)
+	}
+	return re
+}
+
+func TestRetryTransient(t *testing.T) {
+	s := newStatusServer(http.StatusServiceUnavailable, 3)
+	defer s.Close()
+
+	c := newRetryClient()
+	resp, err := c.Omaha(context.Background(), s.URL, omaha.NewPingRequest("{a}", "1.0.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetApp("{a}") == nil {
+		t.Errorf("unexpected response: %#v", resp)
+	}
+	if s.requests() != 4 {
+		t.Errorf("expected 4 requests, not %d", s.requests())
+	}
+}
+
+func TestRetryExhausted(t *testing.T) {
+	s := newStatusServer(http.StatusInternalServerError, -1)
+	defer s.Close()
+
+	c := newRetryClient()
+	_, err := c.Omaha(context.Background(), s.URL, omaha.NewPingRequest("{a}", "1.0.0"))
+	re := expectRequestError(t, err, testRetryPolicy.MaxAttempts)
+	if he, ok := re.Err.(*httpError); !ok || he.StatusCode != http.StatusInternalServerError {
+		t.Errorf("unexpected underlying error: %v", re.Err)
+	}
+	if code := re.ErrorEvent().ErrorCode; code != omaha.ErrorCode(ExitCodeOmahaRequestHTTPResponseBase+500) {
+		t.Errorf("unexpected error code %d", code)
+	}
+}
+
+func TestRetryPermanent(t *testing.T) {
+	s := newStatusServer(http.StatusBadRequest, -1)
+	defer s.Close()
+
+	c := newRetryClient()
+	_, err := c.Omaha(context.Background(), s.URL, omaha.NewPingRequest("{a}", "1.0.0"))
+	expectRequestError(t, err, 1)
+	if s.requests() != 1 {
+		t.Errorf("4xx error was retried %d times", s.requests()-1)
+	}
+}
+
+func TestRetryParseError(t *testing.T) {
+	reqs := 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqs++
+		w.Write([]byte("<response>garbage"))
+	}))
+	defer s.Close()
+
+	c := newRetryClient()
+	_, err := c.Omaha(context.Background(), s.URL, omaha.NewPingRequest("{a}", "1.0.0"))
+	expectRequestError(t, err, 1)
+	if reqs != 1 {
+		t.Errorf("parse error was retried %d times", reqs-1)
+	}
+}
+
+func TestRetryConnectionClosed(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Hang up on every connection without responding.
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	c := newRetryClient()
+	url := "http://" + l.Addr().String()
+	_, err = c.Omaha(context.Background(), url, omaha.NewPingRequest("{a}", "1.0.0"))
+	expectRequestError(t, err, testRetryPolicy.MaxAttempts)
+}
+
+func TestRetryCanceled(t *testing.T) {
+	s := newStatusServer(http.StatusServiceUnavailable, -1)
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := newHTTPClient()
+	c.retry = RetryPolicy{MaxAttempts: 5, Backoff: time.Hour}
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Omaha(ctx, s.URL, omaha.NewPingRequest("{a}", "1.0.0"))
+		done <- err
+	}()
+
+	for s.requests() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+
+	select {
+	case err := <-done:
+		re := expectRequestError(t, err, 1)
+		if re.Err != context.Canceled {
+			t.Errorf("unexpected underlying error: %v", re.Err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("canceling did not interrupt the backoff")
+	}
+}
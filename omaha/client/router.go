@@ -0,0 +1,171 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/coreos/go-omaha/omaha"
+)
+
+// Router is an Omaha server for requests covering apps that are served
+// by different upstream servers. Each request is split by app, the parts
+// are sent to their upstreams concurrently, and the answers are merged
+// back into one response in the order of the request.
+type Router struct {
+	upstreams map[string]string
+	timeout   time.Duration
+	client    *httpClient
+	compress  bool
+}
+
+// NewRouter creates a router sending each app ID in upstreams to the
+// given server URL, which is interpreted as by SetServerURL. Apps not in
+// upstreams are answered with AppUnknownID. All upstream requests for
+// one request, including retries, must complete within timeout or the
+// apps they cover are answered with AppInternalError.
+func NewRouter(upstreams map[string]string, timeout time.Duration) (*Router, error) {
+	r := &Router{
+		upstreams: make(map[string]string, len(upstreams)),
+		timeout:   timeout,
+		client:    newHTTPClient(),
+	}
+	for appID, serverURL := range upstreams {
+		endpoint, err := parseServerURL(serverURL)
+		if err != nil {
+			return nil, err
+		}
+		r.upstreams[appID] = endpoint
+	}
+	return r, nil
+}
+
+// SetRetryPolicy changes how upstream requests are retried.
+func (r *Router) SetRetryPolicy(p RetryPolicy) {
+	r.client.retry = p
+}
+
+// SetCompressResponses enables gzip encoding of larger responses for
+// clients that send Accept-Encoding: gzip, like OmahaHandler's
+// CompressResponses.
+func (r *Router) SetCompressResponses(compress bool) {
+	r.compress = compress
+}
+
+// upstreamResult is the outcome of the request sent to one upstream.
+// An upstream may answer with an HTTP error and still send a valid
+// response, in which case both are set.
+type upstreamResult struct {
+	resp *omaha.Response
+	err  error
+}
+
+// Route answers req from the upstream servers. The request and session
+// IDs are passed through unchanged and the daystart is taken from the
+// first upstream, in request order, that answered. App statuses from an
+// upstream that answered with an HTTP error but a valid response, such
+// as AppUnknownID from another OmahaHandler, are passed through too.
+func (r *Router) Route(ctx context.Context, req *omaha.Request) *omaha.Response {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	// Split the request, remembering the order upstreams first appear.
+	var order []string
+	parts := make(map[string]*omaha.Request)
+	for _, app := range req.Apps {
+		endpoint, ok := r.upstreams[app.ID]
+		if !ok {
+			continue
+		}
+		part, ok := parts[endpoint]
+		if !ok {
+			c := *req
+			c.Apps = nil
+			part = &c
+			parts[endpoint] = part
+			order = append(order, endpoint)
+		}
+		part.Apps = append(part.Apps, app)
+	}
+
+	results := make(map[string]chan upstreamResult, len(parts))
+	for endpoint, part := range parts {
+		resc := make(chan upstreamResult, 1)
+		results[endpoint] = resc
+		go func(endpoint string, part *omaha.Request) {
+			resp, err := r.client.Omaha(ctx, endpoint, part)
+			if resp != nil {
+				if verr := resp.Validate(part); verr != nil {
+					resp = nil
+					if err == nil {
+						err = verr
+					}
+				}
+			}
+			resc <- upstreamResult{resp, err}
+		}(endpoint, part)
+	}
+
+	answers := make(map[string]*omaha.Response, len(parts))
+	resp := omaha.NewResponse()
+	if req.Protocol == omaha.ProtocolV31 {
+		resp.Protocol = omaha.ProtocolV31
+	}
+	if req.MinimalAck && req.EventOnly() {
+		resp.MinimalAck = true
+	}
+	daystart := false
+	for _, endpoint := range order {
+		res := <-results[endpoint]
+		if res.err != nil {
+			log.Printf("omaha: Upstream %s failed: %v", endpoint, res.err)
+		}
+		if res.resp == nil {
+			continue
+		}
+		answers[endpoint] = res.resp
+		if !daystart && !res.resp.MinimalAck {
+			resp.DayStart = res.resp.DayStart
+			daystart = true
+		}
+	}
+
+	for _, app := range req.Apps {
+		endpoint, ok := r.upstreams[app.ID]
+		if !ok {
+			resp.AddApp(app.ID, omaha.AppUnknownID)
+			continue
+		}
+		var appResp *omaha.AppResponse
+		if answer := answers[endpoint]; answer != nil {
+			appResp = answer.GetApp(app.ID)
+		}
+		if appResp == nil {
+			appResp = &omaha.AppResponse{ID: app.ID, Status: omaha.AppInternalError}
+		}
+		resp.Apps = append(resp.Apps, appResp)
+	}
+
+	return resp
+}
+
+// ServeHTTP answers Omaha requests with Route. Requests and responses
+// are handled as by omaha.OmahaHandler, see omaha.ServeExchange.
+func (r *Router) ServeHTTP(w http.ResponseWriter, httpReq *http.Request) {
+	omaha.ServeExchange(w, httpReq, r.compress, r.Route)
+}
@@ -0,0 +1,334 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-omaha/omaha"
+)
+
+// upstreamServer answers every app with noupdate, recording requests.
+type upstreamServer struct {
+	*httptest.Server
+	mu   sync.Mutex
+	reqs []*omaha.Request
+}
+
+func newUpstreamServer(t *testing.T) *upstreamServer {
+	u := &upstreamServer{}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, err := omaha.ParseRequest(r.Header.Get("Content-Type"), r.Body)
+		if err != nil {
+			t.Errorf("upstream: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		u.mu.Lock()
+		u.reqs = append(u.reqs, req)
+		u.mu.Unlock()
+
+		resp := omaha.NewResponse()
+		resp.DayStart.ElapsedSeconds = "4242"
+		for _, app := range req.Apps {
+			resp.AddApp(app.ID, omaha.AppOK).AddUpdateCheck(omaha.NoUpdate)
+		}
+		w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+		xml.NewEncoder(w).Encode(resp)
+	}))
+	return u
+}
+
+func newRouterTest(t *testing.T, timeout time.Duration) (*Router, *upstreamServer, func()) {
+	good := newUpstreamServer(t)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The request is only canceled when the client goes away
+		// once the body has been read.
+		ioutil.ReadAll(r.Body)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+
+	router, err := NewRouter(map[string]string{
+		"good-1":  good.URL,
+		"good-2":  good.URL,
+		"slow":    slow.URL,
+		"failing": failing.URL,
+	}, timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router.SetRetryPolicy(testRetryPolicy)
+
+	return router, good, func() {
+		good.Close()
+		slow.Close()
+		failing.Close()
+	}
+}
+
+func newRouterRequest() *omaha.Request {
+	req := omaha.NewRequest()
+	req.SetSessionID("").SetRequestID("")
+	for _, id := range []string{"slow", "good-1", "unknown", "failing", "good-2"} {
+		req.AddApp(id, "1.0.0").AddUpdateCheck()
+	}
+	return req
+}
+
+func TestRouter(t *testing.T) {
+	const timeout = 250 * time.Millisecond
+	router, good, cleanup := newRouterTest(t, timeout)
+	defer cleanup()
+
+	req := newRouterRequest()
+	start := time.Now()
+	resp := router.Route(context.Background(), req)
+	if elapsed := time.Since(start); elapsed > timeout+time.Second {
+		t.Errorf("response took %v", elapsed)
+	}
+
+	expected := []struct {
+		id     string
+		status omaha.AppStatus
+	}{
+		{"slow", omaha.AppInternalError},
+		{"good-1", omaha.AppOK},
+		{"unknown", omaha.AppUnknownID},
+		{"failing", omaha.AppInternalError},
+		{"good-2", omaha.AppOK},
+	}
+	if len(resp.Apps) != len(expected) {
+		t.Fatalf("expected %d apps, not %d", len(expected), len(resp.Apps))
+	}
+	for i, e := range expected {
+		app := resp.Apps[i]
+		if app.ID != e.id || app.Status != e.status {
+			t.Errorf("app %d: expected %s %s, not %s %s", i, e.id, e.status, app.ID, app.Status)
+		}
+		if e.status == omaha.AppOK && (app.UpdateCheck == nil || app.UpdateCheck.Status != omaha.NoUpdate) {
+			t.Errorf("app %s: unexpected update check %+v", app.ID, app.UpdateCheck)
+		}
+	}
+	if resp.DayStart.ElapsedSeconds != "4242" {
+		t.Errorf("daystart not from upstream: %+v", resp.DayStart)
+	}
+
+	// Both apps for the good upstream go in one request, with the
+	// original identifiers.
+	good.mu.Lock()
+	defer good.mu.Unlock()
+	if len(good.reqs) != 1 {
+		t.Fatalf("expected 1 upstream request, not %d", len(good.reqs))
+	}
+	up := good.reqs[0]
+	if up.SessionID != req.SessionID || up.RequestID != req.RequestID {
+		t.Errorf("identifiers not propagated: %q %q", up.SessionID, up.RequestID)
+	}
+	if len(up.Apps) != 2 || up.Apps[0].ID != "good-1" || up.Apps[1].ID != "good-2" {
+		t.Errorf("unexpected upstream apps: %+v", up.Apps)
+	}
+}
+
+func TestRouterHTTP(t *testing.T) {
+	router, _, cleanup := newRouterTest(t, 250*time.Millisecond)
+	defer cleanup()
+	s := httptest.NewServer(router)
+	defer s.Close()
+
+	body, err := xml.Marshal(newRouterRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpResp, err := http.Post(s.URL, "text/xml; charset=utf-8", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpResp.Body.Close()
+
+	resp, err := omaha.ParseResponse(httpResp.Header.Get("Content-Type"), httpResp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Apps) != 5 || resp.Apps[1].Status != omaha.AppOK || resp.Apps[3].Status != omaha.AppInternalError {
+		t.Errorf("unexpected response: %+v", resp.Apps)
+	}
+
+	httpResp, err = http.Post(s.URL, "text/xml", bytes.NewReader([]byte("<request")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid request: status %d", httpResp.StatusCode)
+	}
+}
+
+// rejectingUpdater answers every app with AppUnknownID, which
+// OmahaHandler sends with an HTTP error.
+type rejectingUpdater struct {
+	omaha.UpdaterStub
+}
+
+func (rejectingUpdater) CheckApp(req *omaha.Request, app *omaha.AppRequest) error {
+	return omaha.AppUnknownID
+}
+
+func TestRouterUpstreamStatus(t *testing.T) {
+	good := newUpstreamServer(t)
+	defer good.Close()
+	rejecting := httptest.NewServer(&omaha.OmahaHandler{Updater: rejectingUpdater{}})
+	defer rejecting.Close()
+
+	router, err := NewRouter(map[string]string{
+		"good":      good.URL,
+		"rejecting": rejecting.URL,
+	}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router.SetRetryPolicy(testRetryPolicy)
+
+	req := omaha.NewRequest()
+	req.AddApp("rejecting", "1.0.0").AddUpdateCheck()
+	req.AddApp("good", "1.0.0").AddUpdateCheck()
+	resp := router.Route(context.Background(), req)
+	if len(resp.Apps) != 2 || resp.Apps[0].Status != omaha.AppUnknownID || resp.Apps[1].Status != omaha.AppOK {
+		t.Errorf("unexpected response: %+v", resp.Apps)
+	}
+}
+
+func TestRouterHTTPStatus(t *testing.T) {
+	router, _, cleanup := newRouterTest(t, 250*time.Millisecond)
+	defer cleanup()
+	s := httptest.NewServer(router)
+	defer s.Close()
+
+	for _, tt := range []struct {
+		app    string
+		status int
+	}{
+		{"good-1", http.StatusOK},
+		{"unknown", http.StatusBadRequest},
+		{"failing", http.StatusInternalServerError},
+	} {
+		req := omaha.NewRequest()
+		req.AddApp(tt.app, "1.0.0").AddUpdateCheck()
+		body, err := xml.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		httpResp, err := http.Post(s.URL, "text/xml; charset=utf-8", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := omaha.ParseResponse(httpResp.Header.Get("Content-Type"), httpResp.Body)
+		httpResp.Body.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.app, err)
+		}
+		if httpResp.StatusCode != tt.status || len(resp.Apps) != 1 {
+			t.Errorf("%s: unexpected status %d with %+v", tt.app, httpResp.StatusCode, resp.Apps)
+		}
+	}
+}
+
+func TestRouterHTTPGzip(t *testing.T) {
+	router, _, cleanup := newRouterTest(t, 250*time.Millisecond)
+	defer cleanup()
+	router.SetCompressResponses(true)
+	s := httptest.NewServer(router)
+	defer s.Close()
+
+	// Enough apps for the response to be worth compressing.
+	req := omaha.NewRequest()
+	req.AddApp("good-1", "1.0.0").AddUpdateCheck()
+	for i := 0; i < 50; i++ {
+		req.AddApp(fmt.Sprintf("unknown-%d", i), "1.0.0").AddUpdateCheck()
+	}
+	body, err := xml.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := gzipBytes(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	httpReq, err := http.NewRequest("POST", s.URL, bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpReq.Header.Set("Content-Type", "text/xml; charset=utf-8")
+	httpReq.Header.Set("Content-Encoding", "gzip")
+	httpReq.Header.Set("Accept-Encoding", "gzip")
+	httpResp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK || httpResp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("unexpected status %d, encoding %q",
+			httpResp.StatusCode, httpResp.Header.Get("Content-Encoding"))
+	}
+
+	gz, err := gzip.NewReader(httpResp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := omaha.ParseResponse(httpResp.Header.Get("Content-Type"), gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Apps) != 51 || resp.Apps[0].Status != omaha.AppOK {
+		t.Errorf("unexpected response: %+v", resp.Apps)
+	}
+
+	httpReq, err = http.NewRequest("POST", s.URL, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpReq.Header.Set("Content-Type", "text/xml; charset=utf-8")
+	httpReq.Header.Set("Content-Encoding", "compress")
+	httpResp, err = http.DefaultClient.Do(httpReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("unsupported encoding: status %d", httpResp.StatusCode)
+	}
+}
+
+func TestRouterInvalidUpstream(t *testing.T) {
+	if _, err := NewRouter(map[string]string{"app": "example.com"}, time.Second); err == nil {
+		t.Error("invalid upstream URL accepted")
+	}
+}
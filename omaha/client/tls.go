@@ -0,0 +1,147 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/coreos/go-omaha/omaha"
+)
+
+// transport returns the client's http.Transport for configuration.
+func (hc *httpClient) transport() *http.Transport {
+	return hc.Transport.(*http.Transport)
+}
+
+// tlsConfig returns the transport's TLS config, creating it if needed.
+// Idle connections are closed since the config is about to change.
+func (hc *httpClient) tlsConfig() *tls.Config {
+	t := hc.transport()
+	t.CloseIdleConnections()
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = &tls.Config{}
+	}
+	return t.TLSClientConfig
+}
+
+// SetTLSConfig replaces the TLS configuration used for HTTPS servers.
+// The config is copied so later changes to cfg have no effect.
+func (c *Client) SetTLSConfig(cfg *tls.Config) {
+	t := c.apiClient.transport()
+	t.CloseIdleConnections()
+	t.TLSClientConfig = cfg.Clone()
+}
+
+// SetCA restricts the server certificates accepted to those signed by
+// the PEM encoded CA certificates in path, instead of the system roots.
+func (c *Client) SetCA(path string) error {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("omaha: failed to read CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("omaha: no certificates found in %s", path)
+	}
+	c.apiClient.tlsConfig().RootCAs = pool
+	return nil
+}
+
+// SetClientCertificate presents the certificate and key in the given
+// PEM files to servers requesting client authentication.
+func (c *Client) SetClientCertificate(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("omaha: failed to load client certificate: %v", err)
+	}
+	c.apiClient.tlsConfig().Certificates = []tls.Certificate{cert}
+	return nil
+}
+
+// SetProxy sends requests through the given HTTP proxy, which may
+// include credentials. An empty URL restores the default of using the
+// HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment variables.
+func (c *Client) SetProxy(proxyURL string) error {
+	t := c.apiClient.transport()
+	if proxyURL == "" {
+		t.Proxy = http.ProxyFromEnvironment
+		return nil
+	}
+
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return fmt.Errorf("omaha: invalid proxy URL: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("omaha: invalid proxy protocol: %s", u)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("omaha: invalid proxy host: %s", u)
+	}
+	t.CloseIdleConnections()
+	t.Proxy = http.ProxyURL(u)
+	return nil
+}
+
+// CertificateError is a failed TLS handshake, either the server's
+// certificate was not trusted or the server rejected the client's.
+// These are not retried since trying again will not help.
+type CertificateError struct {
+	Err error
+}
+
+func (ce *CertificateError) Error() string {
+	return "omaha: certificate verification failed: " + ce.Err.Error()
+}
+
+// ErrorEvent reports a request error; update_engine has no more
+// specific code for certificate problems.
+func (ce *CertificateError) ErrorEvent() *omaha.EventRequest {
+	return NewErrorEvent(ExitCodeOmahaRequestError)
+}
+
+// isCertificateError reports whether err from http.Client.Do is due to
+// a certificate being rejected by either side.
+func isCertificateError(err error) bool {
+	if ue, ok := err.(*url.Error); ok {
+		err = ue.Err
+	}
+	for err != nil {
+		switch e := err.(type) {
+		case x509.UnknownAuthorityError, x509.HostnameError,
+			x509.CertificateInvalidError, x509.SystemRootsError:
+			return true
+		case *net.OpError:
+			// The server sent a TLS alert, such as bad_certificate.
+			return e.Op == "remote error"
+		}
+
+		// Newer versions of crypto/tls wrap the x509 errors.
+		u, ok := err.(interface {
+			Unwrap() error
+		})
+		if !ok {
+			break
+		}
+		err = u.Unwrap()
+	}
+	return false
+}
@@ -0,0 +1,233 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-omaha/omaha"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "go-omaha test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue returns a certificate for 127.0.0.1 with the given usage.
+func (ca *testCA) issue(t *testing.T, usage x509.ExtKeyUsage) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func writePEM(t *testing.T, dir, name, typ string, der []byte) string {
+	path := filepath.Join(dir, name)
+	data := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newTLSServer(t *testing.T, cert tls.Certificate, clientCAs *x509.CertPool) *httptest.Server {
+	s := httptest.NewUnstartedServer(&omaha.OmahaHandler{Updater: omaha.UpdaterStub{}})
+	s.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	if clientCAs != nil {
+		s.TLS.ClientCAs = clientCAs
+		s.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	// Handshake failures are expected, keep them out of the test log.
+	s.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	s.StartTLS()
+	return s
+}
+
+func newTLSClient(t *testing.T) *Client {
+	c, err := New("https://127.0.0.1/", "test-user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetRetryPolicy(testRetryPolicy)
+	return c
+}
+
+func ping(c *Client, url string) error {
+	_, err := c.apiClient.Omaha(context.Background(), url, omaha.NewPingRequest("{a}", "1.0.0"))
+	return err
+}
+
+func expectCertificateError(t *testing.T, err error) {
+	re := expectRequestError(t, err, 1)
+	if _, ok := re.Err.(*CertificateError); !ok {
+		t.Errorf("expected a certificate error, not %v", re.Err)
+	}
+}
+
+func TestClientCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-omaha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, other := newTestCA(t), newTestCA(t)
+	caFile := writePEM(t, dir, "ca.pem", "CERTIFICATE", ca.cert.Raw)
+
+	trusted := newTLSServer(t, ca.issue(t, x509.ExtKeyUsageServerAuth), nil)
+	defer trusted.Close()
+	untrusted := newTLSServer(t, other.issue(t, x509.ExtKeyUsageServerAuth), nil)
+	defer untrusted.Close()
+
+	c := newTLSClient(t)
+	expectCertificateError(t, ping(c, trusted.URL))
+
+	if err := c.SetCA(caFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := ping(c, trusted.URL); err != nil {
+		t.Error(err)
+	}
+
+	// A server with a certificate from a different CA is rejected
+	// without retrying.
+	expectCertificateError(t, ping(c, untrusted.URL))
+
+	if err := c.SetCA(filepath.Join(dir, "missing.pem")); err == nil {
+		t.Error("missing CA file accepted")
+	}
+}
+
+func TestClientCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-omaha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t)
+	s := newTLSServer(t, ca.issue(t, x509.ExtKeyUsageServerAuth), ca.pool)
+	defer s.Close()
+
+	c := newTLSClient(t)
+	c.SetTLSConfig(&tls.Config{RootCAs: ca.pool})
+	expectCertificateError(t, ping(c, s.URL))
+
+	cert := ca.issue(t, x509.ExtKeyUsageClientAuth)
+	keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := writePEM(t, dir, "cert.pem", "CERTIFICATE", cert.Certificate[0])
+	keyFile := writePEM(t, dir, "key.pem", "EC PRIVATE KEY", keyDER)
+	if err := c.SetClientCertificate(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := ping(c, s.URL); err != nil {
+		t.Error(err)
+	}
+
+	if err := c.SetClientCertificate(keyFile, certFile); err == nil {
+		t.Error("swapped certificate and key accepted")
+	}
+}
+
+func TestClientProxy(t *testing.T) {
+	var proxied []string
+	handler := &omaha.OmahaHandler{Updater: omaha.UpdaterStub{}}
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String()+" "+r.Header.Get("Proxy-Authorization"))
+		handler.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	c := newTLSClient(t)
+	u := "http://user:secret@" + proxy.Listener.Addr().String()
+	if err := c.SetProxy(u); err != nil {
+		t.Fatal(err)
+	}
+	if err := ping(c, "http://omaha.invalid/v1/update/"); err != nil {
+		t.Fatal(err)
+	}
+	expected := "http://omaha.invalid/v1/update/ Basic dXNlcjpzZWNyZXQ="
+	if len(proxied) != 1 || proxied[0] != expected {
+		t.Errorf("expected proxied request %q, got %q", expected, proxied)
+	}
+
+	for _, bad := range []string{"socks5://localhost", "http://", ":"} {
+		if err := c.SetProxy(bad); err == nil {
+			t.Errorf("invalid proxy %q accepted", bad)
+		}
+	}
+}
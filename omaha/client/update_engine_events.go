@@ -42,162 +42,68 @@ var (
 	}
 )
 
-// ExitCode is used for omaha event error codes derived from update_engine
+// ExitCode is used for omaha event error codes derived from update_engine.
+// The values are converted from omaha.ErrorCode, which defines them.
 type ExitCode int
 
-// These error codes are from CoreOS Container Linux update_engine 0.4.x
-// https://github.com/coreos/update_engine/blob/master/src/update_engine/action_processor.h
+// These error codes are from CoreOS Container Linux update_engine 0.4.x,
+// see omaha.ErrorCode.
 // The whole list is included for the sake of completeness but lots of these
 // are not generally applicable and not even used by update_engine any more.
 // Also there are clearly duplicate errors for the same condition.
 const (
-	ExitCodeSuccess                                    ExitCode = 0
-	ExitCodeError                                      ExitCode = 1
-	ExitCodeOmahaRequestError                          ExitCode = 2
-	ExitCodeOmahaResponseHandlerError                  ExitCode = 3
-	ExitCodeFilesystemCopierError                      ExitCode = 4
-	ExitCodePostinstallRunnerError                     ExitCode = 5
-	ExitCodeSetBootableFlagError                       ExitCode = 6
-	ExitCodeInstallDeviceOpenError                     ExitCode = 7
-	ExitCodeKernelDeviceOpenError                      ExitCode = 8
-	ExitCodeDownloadTransferError                      ExitCode = 9
-	ExitCodePayloadHashMismatchError                   ExitCode = 10
-	ExitCodePayloadSizeMismatchError                   ExitCode = 11
-	ExitCodeDownloadPayloadVerificationError           ExitCode = 12
-	ExitCodeDownloadNewPartitionInfoError              ExitCode = 13
-	ExitCodeDownloadWriteError                         ExitCode = 14
-	ExitCodeNewRootfsVerificationError                 ExitCode = 15
-	ExitCodeNewKernelVerificationError                 ExitCode = 16
-	ExitCodeSignedDeltaPayloadExpectedError            ExitCode = 17
-	ExitCodeDownloadPayloadPubKeyVerificationError     ExitCode = 18
-	ExitCodePostinstallBootedFromFirmwareB             ExitCode = 19
-	ExitCodeDownloadStateInitializationError           ExitCode = 20
-	ExitCodeDownloadInvalidMetadataMagicString         ExitCode = 21
-	ExitCodeDownloadSignatureMissingInManifest         ExitCode = 22
-	ExitCodeDownloadManifestParseError                 ExitCode = 23
-	ExitCodeDownloadMetadataSignatureError             ExitCode = 24
-	ExitCodeDownloadMetadataSignatureVerificationError ExitCode = 25
-	ExitCodeDownloadMetadataSignatureMismatch          ExitCode = 26
-	ExitCodeDownloadOperationHashVerificationError     ExitCode = 27
-	ExitCodeDownloadOperationExecutionError            ExitCode = 28
-	ExitCodeDownloadOperationHashMismatch              ExitCode = 29
-	ExitCodeOmahaRequestEmptyResponseError             ExitCode = 30
-	ExitCodeOmahaRequestXMLParseError                  ExitCode = 31
-	ExitCodeDownloadInvalidMetadataSize                ExitCode = 32
-	ExitCodeDownloadInvalidMetadataSignature           ExitCode = 33
-	ExitCodeOmahaResponseInvalid                       ExitCode = 34
-	ExitCodeOmahaUpdateIgnoredPerPolicy                ExitCode = 35
-	ExitCodeOmahaUpdateDeferredPerPolicy               ExitCode = 36
-	ExitCodeOmahaErrorInHTTPResponse                   ExitCode = 37
-	ExitCodeDownloadOperationHashMissingError          ExitCode = 38
-	ExitCodeDownloadMetadataSignatureMissingError      ExitCode = 39
-	ExitCodeOmahaUpdateDeferredForBackoff              ExitCode = 40
-	ExitCodePostinstallPowerwashError                  ExitCode = 41
-	ExitCodeNewPCRPolicyVerificationError              ExitCode = 42
-	ExitCodeNewPCRPolicyHTTPError                      ExitCode = 43
+	ExitCodeSuccess                                    = ExitCode(omaha.ErrorCodeSuccess)
+	ExitCodeError                                      = ExitCode(omaha.ErrorCodeError)
+	ExitCodeOmahaRequestError                          = ExitCode(omaha.ErrorCodeOmahaRequestError)
+	ExitCodeOmahaResponseHandlerError                  = ExitCode(omaha.ErrorCodeOmahaResponseHandlerError)
+	ExitCodeFilesystemCopierError                      = ExitCode(omaha.ErrorCodeFilesystemCopierError)
+	ExitCodePostinstallRunnerError                     = ExitCode(omaha.ErrorCodePostinstallRunnerError)
+	ExitCodeSetBootableFlagError                       = ExitCode(omaha.ErrorCodeSetBootableFlagError)
+	ExitCodeInstallDeviceOpenError                     = ExitCode(omaha.ErrorCodeInstallDeviceOpenError)
+	ExitCodeKernelDeviceOpenError                      = ExitCode(omaha.ErrorCodeKernelDeviceOpenError)
+	ExitCodeDownloadTransferError                      = ExitCode(omaha.ErrorCodeDownloadTransferError)
+	ExitCodePayloadHashMismatchError                   = ExitCode(omaha.ErrorCodePayloadHashMismatchError)
+	ExitCodePayloadSizeMismatchError                   = ExitCode(omaha.ErrorCodePayloadSizeMismatchError)
+	ExitCodeDownloadPayloadVerificationError           = ExitCode(omaha.ErrorCodeDownloadPayloadVerificationError)
+	ExitCodeDownloadNewPartitionInfoError              = ExitCode(omaha.ErrorCodeDownloadNewPartitionInfoError)
+	ExitCodeDownloadWriteError                         = ExitCode(omaha.ErrorCodeDownloadWriteError)
+	ExitCodeNewRootfsVerificationError                 = ExitCode(omaha.ErrorCodeNewRootfsVerificationError)
+	ExitCodeNewKernelVerificationError                 = ExitCode(omaha.ErrorCodeNewKernelVerificationError)
+	ExitCodeSignedDeltaPayloadExpectedError            = ExitCode(omaha.ErrorCodeSignedDeltaPayloadExpectedError)
+	ExitCodeDownloadPayloadPubKeyVerificationError     = ExitCode(omaha.ErrorCodeDownloadPayloadPubKeyVerificationError)
+	ExitCodePostinstallBootedFromFirmwareB             = ExitCode(omaha.ErrorCodePostinstallBootedFromFirmwareB)
+	ExitCodeDownloadStateInitializationError           = ExitCode(omaha.ErrorCodeDownloadStateInitializationError)
+	ExitCodeDownloadInvalidMetadataMagicString         = ExitCode(omaha.ErrorCodeDownloadInvalidMetadataMagicString)
+	ExitCodeDownloadSignatureMissingInManifest         = ExitCode(omaha.ErrorCodeDownloadSignatureMissingInManifest)
+	ExitCodeDownloadManifestParseError                 = ExitCode(omaha.ErrorCodeDownloadManifestParseError)
+	ExitCodeDownloadMetadataSignatureError             = ExitCode(omaha.ErrorCodeDownloadMetadataSignatureError)
+	ExitCodeDownloadMetadataSignatureVerificationError = ExitCode(omaha.ErrorCodeDownloadMetadataSignatureVerificationError)
+	ExitCodeDownloadMetadataSignatureMismatch          = ExitCode(omaha.ErrorCodeDownloadMetadataSignatureMismatch)
+	ExitCodeDownloadOperationHashVerificationError     = ExitCode(omaha.ErrorCodeDownloadOperationHashVerificationError)
+	ExitCodeDownloadOperationExecutionError            = ExitCode(omaha.ErrorCodeDownloadOperationExecutionError)
+	ExitCodeDownloadOperationHashMismatch              = ExitCode(omaha.ErrorCodeDownloadOperationHashMismatch)
+	ExitCodeOmahaRequestEmptyResponseError             = ExitCode(omaha.ErrorCodeOmahaRequestEmptyResponseError)
+	ExitCodeOmahaRequestXMLParseError                  = ExitCode(omaha.ErrorCodeOmahaRequestXMLParseError)
+	ExitCodeDownloadInvalidMetadataSize                = ExitCode(omaha.ErrorCodeDownloadInvalidMetadataSize)
+	ExitCodeDownloadInvalidMetadataSignature           = ExitCode(omaha.ErrorCodeDownloadInvalidMetadataSignature)
+	ExitCodeOmahaResponseInvalid                       = ExitCode(omaha.ErrorCodeOmahaResponseInvalid)
+	ExitCodeOmahaUpdateIgnoredPerPolicy                = ExitCode(omaha.ErrorCodeOmahaUpdateIgnoredPerPolicy)
+	ExitCodeOmahaUpdateDeferredPerPolicy               = ExitCode(omaha.ErrorCodeOmahaUpdateDeferredPerPolicy)
+	ExitCodeOmahaErrorInHTTPResponse                   = ExitCode(omaha.ErrorCodeOmahaErrorInHTTPResponse)
+	ExitCodeDownloadOperationHashMissingError          = ExitCode(omaha.ErrorCodeDownloadOperationHashMissingError)
+	ExitCodeDownloadMetadataSignatureMissingError      = ExitCode(omaha.ErrorCodeDownloadMetadataSignatureMissingError)
+	ExitCodeOmahaUpdateDeferredForBackoff              = ExitCode(omaha.ErrorCodeOmahaUpdateDeferredForBackoff)
+	ExitCodePostinstallPowerwashError                  = ExitCode(omaha.ErrorCodePostinstallPowerwashError)
+	ExitCodeNewPCRPolicyVerificationError              = ExitCode(omaha.ErrorCodeNewPCRPolicyVerificationError)
+	ExitCodeNewPCRPolicyHTTPError                      = ExitCode(omaha.ErrorCodeNewPCRPolicyHTTPError)
 
 	// Use the 2xxx range to encode HTTP errors from the Omaha server.
 	// Sometimes aggregated into ExitCodeOmahaErrorInHTTPResponse
-	ExitCodeOmahaRequestHTTPResponseBase ExitCode = 2000 // + HTTP response code
+	ExitCodeOmahaRequestHTTPResponseBase = ExitCode(omaha.ErrorCodeOmahaRequestHTTPResponseBase) // + HTTP response code
 )
 
 func (e ExitCode) String() string {
-	switch e {
-	case ExitCodeSuccess:
-		return "success"
-	case ExitCodeError:
-		return "error"
-	case ExitCodeOmahaRequestError:
-		return "omaha request error"
-	case ExitCodeOmahaResponseHandlerError:
-		return "omaha response handler error"
-	case ExitCodeFilesystemCopierError:
-		return "filesystem copier error"
-	case ExitCodePostinstallRunnerError:
-		return "postinstall runner error"
-	case ExitCodeSetBootableFlagError:
-		return "set bootable flag error"
-	case ExitCodeInstallDeviceOpenError:
-		return "install device open error"
-	case ExitCodeKernelDeviceOpenError:
-		return "kernel device open error"
-	case ExitCodeDownloadTransferError:
-		return "download transfer error"
-	case ExitCodePayloadHashMismatchError:
-		return "payload hash mismatch error"
-	case ExitCodePayloadSizeMismatchError:
-		return "payload size mismatch error"
-	case ExitCodeDownloadPayloadVerificationError:
-		return "download payload verification error"
-	case ExitCodeDownloadNewPartitionInfoError:
-		return "download new partition info error"
-	case ExitCodeDownloadWriteError:
-		return "download write error"
-	case ExitCodeNewRootfsVerificationError:
-		return "new rootfs verification error"
-	case ExitCodeNewKernelVerificationError:
-		return "new kernel verification error"
-	case ExitCodeSignedDeltaPayloadExpectedError:
-		return "signed delta payload expected error"
-	case ExitCodeDownloadPayloadPubKeyVerificationError:
-		return "download payload pubkey verification error"
-	case ExitCodePostinstallBootedFromFirmwareB:
-		return "postinstall booted from firmware B"
-	case ExitCodeDownloadStateInitializationError:
-		return "download state initialization error"
-	case ExitCodeDownloadInvalidMetadataMagicString:
-		return "download invalid metadata magic string"
-	case ExitCodeDownloadSignatureMissingInManifest:
-		return "download signature missing in manifest"
-	case ExitCodeDownloadManifestParseError:
-		return "download manifest parse error"
-	case ExitCodeDownloadMetadataSignatureError:
-		return "download metadata signature error"
-	case ExitCodeDownloadMetadataSignatureVerificationError:
-		return "download metadata signature verification error"
-	case ExitCodeDownloadMetadataSignatureMismatch:
-		return "download metadata signature mismatch"
-	case ExitCodeDownloadOperationHashVerificationError:
-		return "download operation hash verification error"
-	case ExitCodeDownloadOperationExecutionError:
-		return "download operation execution error"
-	case ExitCodeDownloadOperationHashMismatch:
-		return "download operation hash mismatch"
-	case ExitCodeOmahaRequestEmptyResponseError:
-		return "omaha request empty response error"
-	case ExitCodeOmahaRequestXMLParseError:
-		return "omaha request XML parse error"
-	case ExitCodeDownloadInvalidMetadataSize:
-		return "download invalid metadata size"
-	case ExitCodeDownloadInvalidMetadataSignature:
-		return "download invalid metadata signature"
-	case ExitCodeOmahaResponseInvalid:
-		return "omaha response invalid"
-	case ExitCodeOmahaUpdateIgnoredPerPolicy:
-		return "omaha update ignored per policy"
-	case ExitCodeOmahaUpdateDeferredPerPolicy:
-		return "omaha update deferred per policy"
-	case ExitCodeOmahaErrorInHTTPResponse:
-		return "omaha error in HTTP response"
-	case ExitCodeDownloadOperationHashMissingError:
-		return "download operation hash missing error"
-	case ExitCodeDownloadMetadataSignatureMissingError:
-		return "download metadata signature missing error"
-	case ExitCodeOmahaUpdateDeferredForBackoff:
-		return "omaha update deferred for backoff"
-	case ExitCodePostinstallPowerwashError:
-		return "postinstall powerwash error"
-	case ExitCodeNewPCRPolicyVerificationError:
-		return "new PCR policy verification error"
-	case ExitCodeNewPCRPolicyHTTPError:
-		return "new PCR policy HTTP error"
-	default:
-		if e > ExitCodeOmahaRequestHTTPResponseBase {
-			return fmt.Sprintf("omaha response HTTP %d error",
-				e-ExitCodeOmahaRequestHTTPResponseBase)
-		}
-		return fmt.Sprintf("error code %d", e)
-	}
+	return omaha.ErrorCode(e).String()
 }
 
 // NewErrorEvent creates an EventRequest for reporting errors.
@@ -205,7 +111,7 @@ func NewErrorEvent(e ExitCode) *omaha.EventRequest {
 	return &omaha.EventRequest{
 		Type:      omaha.EventTypeUpdateComplete,
 		Result:    omaha.EventResultError,
-		ErrorCode: int(e),
+		ErrorCode: omaha.ErrorCode(e),
 	}
 }
 
@@ -214,7 +120,7 @@ func EventString(e *omaha.EventRequest) string {
 	s := fmt.Sprintf("omaha event: %s: %s", e.Type, e.Result)
 	if e.ErrorCode != 0 {
 		s = fmt.Sprintf("%s (%d - %s)", s,
-			e.ErrorCode, ExitCode(e.ErrorCode))
+			e.ErrorCode, e.ErrorCode)
 	}
 	return s
 }
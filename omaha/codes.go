@@ -163,6 +163,17 @@ func (a AppStatus) Error() string {
 	return "omaha: app status " + string(a)
 }
 
+// IsKnown reports whether a is one of the values defined here. Values
+// from newer servers are decoded as is so they can still be reported.
+func (a AppStatus) IsKnown() bool {
+	switch a {
+	case AppOK, AppRestricted, AppUnknownID, AppInvalidID,
+		AppInvalidVersion, AppInternalError:
+		return true
+	}
+	return false
+}
+
 type UpdateStatus string
 
 const (
@@ -179,3 +190,44 @@ const (
 func (u UpdateStatus) Error() string {
 	return "omaha: update status " + string(u)
 }
+
+// IsKnown reports whether u is one of the values defined here. Values
+// from newer servers are decoded as is so they can still be reported.
+func (u UpdateStatus) IsKnown() bool {
+	switch u {
+	case NoUpdate, UpdateOK, UpdateOSNotSupported, UpdateUnsupportedProtocol,
+		UpdatePluginRestrictedHost, UpdateHashError, UpdateInternalError:
+		return true
+	}
+	return false
+}
+
+type DataStatus string
+
+const (
+	DataOK          DataStatus = "ok"
+	DataNoData      DataStatus = "error-nodata"
+	DataInvalidArgs DataStatus = "error-invalidargs"
+)
+
+// Make DataStatus easy to use as an error
+func (d DataStatus) Error() string {
+	return "omaha: data status " + string(d)
+}
+
+// IsKnown reports whether d is one of the values defined here.
+func (d DataStatus) IsKnown() bool {
+	switch d {
+	case DataOK, DataNoData, DataInvalidArgs:
+		return true
+	}
+	return false
+}
+
+// Values for the Request InstallSource attribute. Servers may treat
+// scheduled checks differently from on demand checks, for example when
+// rate limiting.
+const (
+	InstallSourceScheduled = "scheduler"
+	InstallSourceOnDemand  = "ondemandupdate"
+)
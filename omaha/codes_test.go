@@ -0,0 +1,58 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestStatusUnknown(t *testing.T) {
+	for _, tt := range []struct {
+		attr   string
+		status string
+		known  bool
+	}{
+		{` status="ok"`, "ok", true},
+		{` status="error-someNewThing"`, "error-someNewThing", false},
+		{` status=""`, "", false},
+		{``, "", false},
+	} {
+		raw := fmt.Sprintf(`<response protocol="3.0"><app appid="%s"%s>`+
+			`<updatecheck%s></updatecheck><data name="install"%s></data></app></response>`,
+			testAppID, tt.attr, tt.attr, tt.attr)
+		resp, err := ParseResponse("", strings.NewReader(raw))
+		if err != nil {
+			t.Errorf("%q: %v", tt.attr, err)
+			continue
+		}
+		app := resp.Apps[0]
+		if app.Status != AppStatus(tt.status) || app.Status.IsKnown() != tt.known {
+			t.Errorf("%q: app status %q known=%v", tt.attr, app.Status, app.Status.IsKnown())
+		}
+		if u := app.UpdateCheck; u.Status != UpdateStatus(tt.status) || u.Status.IsKnown() != tt.known {
+			t.Errorf("%q: update status %q known=%v", tt.attr, u.Status, u.Status.IsKnown())
+		}
+		if d := app.Data[0]; d.Status != DataStatus(tt.status) || d.Status.IsKnown() != tt.known {
+			t.Errorf("%q: data status %q known=%v", tt.attr, d.Status, d.Status.IsKnown())
+		}
+	}
+
+	// Unknown values still read sensibly as errors.
+	if err := error(UpdateStatus("error-someNewThing")); err.Error() != "omaha: update status error-someNewThing" {
+		t.Errorf("unexpected error string %q", err)
+	}
+}
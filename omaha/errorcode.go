@@ -0,0 +1,274 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"fmt"
+)
+
+// ErrorCode is the errorcode attribute of an event, as reported by
+// update_engine. Unknown values are preserved as is.
+type ErrorCode int
+
+// These error codes are from CoreOS Container Linux update_engine 0.4.x
+// https://github.com/coreos/update_engine/blob/master/src/update_engine/action_processor.h
+const (
+	ErrorCodeSuccess                                    ErrorCode = 0
+	ErrorCodeError                                      ErrorCode = 1
+	ErrorCodeOmahaRequestError                          ErrorCode = 2
+	ErrorCodeOmahaResponseHandlerError                  ErrorCode = 3
+	ErrorCodeFilesystemCopierError                      ErrorCode = 4
+	ErrorCodePostinstallRunnerError                     ErrorCode = 5
+	ErrorCodeSetBootableFlagError                       ErrorCode = 6
+	ErrorCodeInstallDeviceOpenError                     ErrorCode = 7
+	ErrorCodeKernelDeviceOpenError                      ErrorCode = 8
+	ErrorCodeDownloadTransferError                      ErrorCode = 9
+	ErrorCodePayloadHashMismatchError                   ErrorCode = 10
+	ErrorCodePayloadSizeMismatchError                   ErrorCode = 11
+	ErrorCodeDownloadPayloadVerificationError           ErrorCode = 12
+	ErrorCodeDownloadNewPartitionInfoError              ErrorCode = 13
+	ErrorCodeDownloadWriteError                         ErrorCode = 14
+	ErrorCodeNewRootfsVerificationError                 ErrorCode = 15
+	ErrorCodeNewKernelVerificationError                 ErrorCode = 16
+	ErrorCodeSignedDeltaPayloadExpectedError            ErrorCode = 17
+	ErrorCodeDownloadPayloadPubKeyVerificationError     ErrorCode = 18
+	ErrorCodePostinstallBootedFromFirmwareB             ErrorCode = 19
+	ErrorCodeDownloadStateInitializationError           ErrorCode = 20
+	ErrorCodeDownloadInvalidMetadataMagicString         ErrorCode = 21
+	ErrorCodeDownloadSignatureMissingInManifest         ErrorCode = 22
+	ErrorCodeDownloadManifestParseError                 ErrorCode = 23
+	ErrorCodeDownloadMetadataSignatureError             ErrorCode = 24
+	ErrorCodeDownloadMetadataSignatureVerificationError ErrorCode = 25
+	ErrorCodeDownloadMetadataSignatureMismatch          ErrorCode = 26
+	ErrorCodeDownloadOperationHashVerificationError     ErrorCode = 27
+	ErrorCodeDownloadOperationExecutionError            ErrorCode = 28
+	ErrorCodeDownloadOperationHashMismatch              ErrorCode = 29
+	ErrorCodeOmahaRequestEmptyResponseError             ErrorCode = 30
+	ErrorCodeOmahaRequestXMLParseError                  ErrorCode = 31
+	ErrorCodeDownloadInvalidMetadataSize                ErrorCode = 32
+	ErrorCodeDownloadInvalidMetadataSignature           ErrorCode = 33
+	ErrorCodeOmahaResponseInvalid                       ErrorCode = 34
+	ErrorCodeOmahaUpdateIgnoredPerPolicy                ErrorCode = 35
+	ErrorCodeOmahaUpdateDeferredPerPolicy               ErrorCode = 36
+	ErrorCodeOmahaErrorInHTTPResponse                   ErrorCode = 37
+	ErrorCodeDownloadOperationHashMissingError          ErrorCode = 38
+	ErrorCodeDownloadMetadataSignatureMissingError      ErrorCode = 39
+	ErrorCodeOmahaUpdateDeferredForBackoff              ErrorCode = 40
+	ErrorCodePostinstallPowerwashError                  ErrorCode = 41
+	ErrorCodeNewPCRPolicyVerificationError              ErrorCode = 42
+	ErrorCodeNewPCRPolicyHTTPError                      ErrorCode = 43
+
+	// Use the 2xxx range to encode HTTP errors from the Omaha server.
+	// Sometimes aggregated into ErrorCodeOmahaErrorInHTTPResponse
+	ErrorCodeOmahaRequestHTTPResponseBase ErrorCode = 2000 // + HTTP response code
+)
+
+func (e ErrorCode) String() string {
+	switch e {
+	case ErrorCodeSuccess:
+		return "success"
+	case ErrorCodeError:
+		return "error"
+	case ErrorCodeOmahaRequestError:
+		return "omaha request error"
+	case ErrorCodeOmahaResponseHandlerError:
+		return "omaha response handler error"
+	case ErrorCodeFilesystemCopierError:
+		return "filesystem copier error"
+	case ErrorCodePostinstallRunnerError:
+		return "postinstall runner error"
+	case ErrorCodeSetBootableFlagError:
+		return "set bootable flag error"
+	case ErrorCodeInstallDeviceOpenError:
+		return "install device open error"
+	case ErrorCodeKernelDeviceOpenError:
+		return "kernel device open error"
+	case ErrorCodeDownloadTransferError:
+		return "download transfer error"
+	case ErrorCodePayloadHashMismatchError:
+		return "payload hash mismatch error"
+	case ErrorCodePayloadSizeMismatchError:
+		return "payload size mismatch error"
+	case ErrorCodeDownloadPayloadVerificationError:
+		return "download payload verification error"
+	case ErrorCodeDownloadNewPartitionInfoError:
+		return "download new partition info error"
+	case ErrorCodeDownloadWriteError:
+		return "download write error"
+	case ErrorCodeNewRootfsVerificationError:
+		return "new rootfs verification error"
+	case ErrorCodeNewKernelVerificationError:
+		return "new kernel verification error"
+	case ErrorCodeSignedDeltaPayloadExpectedError:
+		return "signed delta payload expected error"
+	case ErrorCodeDownloadPayloadPubKeyVerificationError:
+		return "download payload pubkey verification error"
+	case ErrorCodePostinstallBootedFromFirmwareB:
+		return "postinstall booted from firmware B"
+	case ErrorCodeDownloadStateInitializationError:
+		return "download state initialization error"
+	case ErrorCodeDownloadInvalidMetadataMagicString:
+		return "download invalid metadata magic string"
+	case ErrorCodeDownloadSignatureMissingInManifest:
+		return "download signature missing in manifest"
+	case ErrorCodeDownloadManifestParseError:
+		return "download manifest parse error"
+	case ErrorCodeDownloadMetadataSignatureError:
+		return "download metadata signature error"
+	case ErrorCodeDownloadMetadataSignatureVerificationError:
+		return "download metadata signature verification error"
+	case ErrorCodeDownloadMetadataSignatureMismatch:
+		return "download metadata signature mismatch"
+	case ErrorCodeDownloadOperationHashVerificationError:
+		return "download operation hash verification error"
+	case ErrorCodeDownloadOperationExecutionError:
+		return "download operation execution error"
+	case ErrorCodeDownloadOperationHashMismatch:
+		return "download operation hash mismatch"
+	case ErrorCodeOmahaRequestEmptyResponseError:
+		return "omaha request empty response error"
+	case ErrorCodeOmahaRequestXMLParseError:
+		return "omaha request XML parse error"
+	case ErrorCodeDownloadInvalidMetadataSize:
+		return "download invalid metadata size"
+	case ErrorCodeDownloadInvalidMetadataSignature:
+		return "download invalid metadata signature"
+	case ErrorCodeOmahaResponseInvalid:
+		return "omaha response invalid"
+	case ErrorCodeOmahaUpdateIgnoredPerPolicy:
+		return "omaha update ignored per policy"
+	case ErrorCodeOmahaUpdateDeferredPerPolicy:
+		return "omaha update deferred per policy"
+	case ErrorCodeOmahaErrorInHTTPResponse:
+		return "omaha error in HTTP response"
+	case ErrorCodeDownloadOperationHashMissingError:
+		return "download operation hash missing error"
+	case ErrorCodeDownloadMetadataSignatureMissingError:
+		return "download metadata signature missing error"
+	case ErrorCodeOmahaUpdateDeferredForBackoff:
+		return "omaha update deferred for backoff"
+	case ErrorCodePostinstallPowerwashError:
+		return "postinstall powerwash error"
+	case ErrorCodeNewPCRPolicyVerificationError:
+		return "new PCR policy verification error"
+	case ErrorCodeNewPCRPolicyHTTPError:
+		return "new PCR policy HTTP error"
+	default:
+		if status, ok := e.HTTPStatus(); ok {
+			return fmt.Sprintf("omaha response HTTP %d error", status)
+		}
+		return fmt.Sprintf("error code %d", e)
+	}
+}
+
+// transientErrorCodes are failures that may succeed if the client
+// simply tries again later.
+var transientErrorCodes = map[ErrorCode]bool{
+	ErrorCodeOmahaRequestError:              true,
+	ErrorCodeDownloadTransferError:          true,
+	ErrorCodeOmahaRequestEmptyResponseError: true,
+	ErrorCodeOmahaRequestXMLParseError:      true,
+	ErrorCodeOmahaErrorInHTTPResponse:       true,
+	ErrorCodeOmahaUpdateDeferredForBackoff:  true,
+	ErrorCodeNewPCRPolicyHTTPError:          true,
+}
+
+// IsTransient reports whether the error is likely to resolve itself
+// without intervention, such as network failures and server errors.
+func (e ErrorCode) IsTransient() bool {
+	if status, ok := e.HTTPStatus(); ok {
+		return status >= 500 || status == 408 || status == 429
+	}
+	return transientErrorCodes[e]
+}
+
+// HTTPStatus returns the HTTP status encoded in the 2xxx range.
+func (e ErrorCode) HTTPStatus() (int, bool) {
+	if e > ErrorCodeOmahaRequestHTTPResponseBase && e < ErrorCodeOmahaRequestHTTPResponseBase+1000 {
+		return int(e - ErrorCodeOmahaRequestHTTPResponseBase), true
+	}
+	return 0, false
+}
+
+const (
+	actionNone        = "none"
+	actionNetwork     = "check network connectivity and server availability"
+	actionResponse    = "check the update server's responses"
+	actionPayload     = "check the published payload and its signatures"
+	actionDisk        = "check the client's disk and partitions"
+	actionPostinstall = "check the client's postinstall logs"
+	actionUnknown     = "check the client's update_engine logs"
+)
+
+var errorCodeActions = map[ErrorCode]string{
+	ErrorCodeOmahaRequestError:                          actionNetwork,
+	ErrorCodeDownloadTransferError:                      actionNetwork,
+	ErrorCodeOmahaRequestEmptyResponseError:             actionNetwork,
+	ErrorCodeOmahaRequestXMLParseError:                  actionNetwork,
+	ErrorCodeOmahaErrorInHTTPResponse:                   actionNetwork,
+	ErrorCodeNewPCRPolicyHTTPError:                      actionNetwork,
+	ErrorCodeOmahaResponseHandlerError:                  actionResponse,
+	ErrorCodeOmahaResponseInvalid:                       actionResponse,
+	ErrorCodePayloadHashMismatchError:                   actionPayload,
+	ErrorCodePayloadSizeMismatchError:                   actionPayload,
+	ErrorCodeDownloadPayloadVerificationError:           actionPayload,
+	ErrorCodeSignedDeltaPayloadExpectedError:            actionPayload,
+	ErrorCodeDownloadPayloadPubKeyVerificationError:     actionPayload,
+	ErrorCodeDownloadInvalidMetadataMagicString:         actionPayload,
+	ErrorCodeDownloadSignatureMissingInManifest:         actionPayload,
+	ErrorCodeDownloadManifestParseError:                 actionPayload,
+	ErrorCodeDownloadMetadataSignatureError:             actionPayload,
+	ErrorCodeDownloadMetadataSignatureVerificationError: actionPayload,
+	ErrorCodeDownloadMetadataSignatureMismatch:          actionPayload,
+	ErrorCodeDownloadOperationHashVerificationError:     actionPayload,
+	ErrorCodeDownloadOperationHashMismatch:              actionPayload,
+	ErrorCodeDownloadInvalidMetadataSize:                actionPayload,
+	ErrorCodeDownloadInvalidMetadataSignature:           actionPayload,
+	ErrorCodeDownloadOperationHashMissingError:          actionPayload,
+	ErrorCodeDownloadMetadataSignatureMissingError:      actionPayload,
+	ErrorCodeNewPCRPolicyVerificationError:              actionPayload,
+	ErrorCodeFilesystemCopierError:                      actionDisk,
+	ErrorCodeSetBootableFlagError:                       actionDisk,
+	ErrorCodeInstallDeviceOpenError:                     actionDisk,
+	ErrorCodeKernelDeviceOpenError:                      actionDisk,
+	ErrorCodeDownloadNewPartitionInfoError:              actionDisk,
+	ErrorCodeDownloadWriteError:                         actionDisk,
+	ErrorCodeDownloadOperationExecutionError:            actionDisk,
+	ErrorCodeDownloadStateInitializationError:           actionDisk,
+	ErrorCodeNewRootfsVerificationError:                 actionDisk,
+	ErrorCodeNewKernelVerificationError:                 actionDisk,
+	ErrorCodePostinstallRunnerError:                     actionPostinstall,
+	ErrorCodePostinstallBootedFromFirmwareB:             actionPostinstall,
+	ErrorCodePostinstallPowerwashError:                  actionPostinstall,
+	ErrorCodeSuccess:                                    actionNone,
+	ErrorCodeOmahaUpdateIgnoredPerPolicy:                actionNone,
+	ErrorCodeOmahaUpdateDeferredPerPolicy:               actionNone,
+	ErrorCodeOmahaUpdateDeferredForBackoff:              actionNone,
+}
+
+// SuggestedAction describes what an operator should look into when
+// clients report this error, for example in a dashboard.
+func (e ErrorCode) SuggestedAction() string {
+	if status, ok := e.HTTPStatus(); ok {
+		if status >= 500 {
+			return actionNetwork
+		}
+		return actionResponse
+	}
+	if action, ok := errorCodeActions[e]; ok {
+		return action
+	}
+	return actionUnknown
+}
@@ -0,0 +1,124 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"testing"
+)
+
+func TestErrorCodeXML(t *testing.T) {
+	for _, tt := range []struct {
+		code ErrorCode
+		attr string
+	}{
+		{ErrorCodeSuccess, ""},
+		{ErrorCodePayloadHashMismatchError, ` errorcode="10"`},
+		{ErrorCodeOmahaRequestHTTPResponseBase + 503, ` errorcode="2503"`},
+		{ErrorCode(12345), ` errorcode="12345"`},
+	} {
+		event := &EventRequest{
+			Type:      EventTypeUpdateComplete,
+			Result:    EventResultError,
+			ErrorCode: tt.code,
+		}
+		raw, err := xml.Marshal(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := `<EventRequest eventtype="3" eventresult="0"` + tt.attr + `></EventRequest>`
+		if string(raw) != expected {
+			t.Errorf("expected %s, not %s", expected, raw)
+		}
+
+		parsed := &EventRequest{}
+		if err := xml.NewDecoder(bytes.NewReader(raw)).Decode(parsed); err != nil {
+			t.Fatal(err)
+		}
+		if parsed.ErrorCode != tt.code {
+			t.Errorf("code %d decoded as %d", tt.code, parsed.ErrorCode)
+		}
+	}
+}
+
+func TestErrorCodeClassify(t *testing.T) {
+	for _, tt := range []struct {
+		code      ErrorCode
+		str       string
+		transient bool
+		action    string
+	}{
+		{ErrorCodeSuccess, "success", false, actionNone},
+		{ErrorCodeDownloadTransferError, "download transfer error", true, actionNetwork},
+		{ErrorCodePayloadHashMismatchError, "payload hash mismatch error", false, actionPayload},
+		{ErrorCodeDownloadWriteError, "download write error", false, actionDisk},
+		{ErrorCodePostinstallRunnerError, "postinstall runner error", false, actionPostinstall},
+		{ErrorCodeOmahaResponseInvalid, "omaha response invalid", false, actionResponse},
+		{ErrorCodeOmahaUpdateDeferredForBackoff, "omaha update deferred for backoff", true, actionNone},
+		{ErrorCodeOmahaRequestHTTPResponseBase + 503, "omaha response HTTP 503 error", true, actionNetwork},
+		{ErrorCodeOmahaRequestHTTPResponseBase + 429, "omaha response HTTP 429 error", true, actionResponse},
+		{ErrorCodeOmahaRequestHTTPResponseBase + 404, "omaha response HTTP 404 error", false, actionResponse},
+		{ErrorCode(12345), "error code 12345", false, actionUnknown},
+	} {
+		if s := tt.code.String(); s != tt.str {
+			t.Errorf("%d: expected string %q, not %q", tt.code, tt.str, s)
+		}
+		if tt.code.IsTransient() != tt.transient {
+			t.Errorf("%s: expected transient %v", tt.code, tt.transient)
+		}
+		if a := tt.code.SuggestedAction(); a != tt.action {
+			t.Errorf("%s: expected action %q, not %q", tt.code, tt.action, a)
+		}
+	}
+}
+
+func TestErrorCodeHTTPStatus(t *testing.T) {
+	for _, tt := range []struct {
+		code   ErrorCode
+		status int
+		ok     bool
+	}{
+		{ErrorCodeOmahaErrorInHTTPResponse, 0, false},
+		{ErrorCodeOmahaRequestHTTPResponseBase, 0, false},
+		{ErrorCodeOmahaRequestHTTPResponseBase + 1, 1, true},
+		{ErrorCodeOmahaRequestHTTPResponseBase + 503, 503, true},
+		{ErrorCodeOmahaRequestHTTPResponseBase + 999, 999, true},
+		// Only the 2xxx range encodes HTTP statuses.
+		{ErrorCodeOmahaRequestHTTPResponseBase + 1000, 0, false},
+		{ErrorCode(3404), 0, false},
+		{ErrorCode(12345), 0, false},
+		{ErrorCode(-1), 0, false},
+	} {
+		status, ok := tt.code.HTTPStatus()
+		if status != tt.status || ok != tt.ok {
+			t.Errorf("%d: expected %d, %v, not %d, %v", tt.code, tt.status, tt.ok, status, ok)
+		}
+	}
+
+	// Codes past the range are neither HTTP errors nor transient.
+	for _, code := range []ErrorCode{3000, 3503} {
+		if s := code.String(); s != fmt.Sprintf("error code %d", code) {
+			t.Errorf("%d: unexpected string %q", code, s)
+		}
+		if code.IsTransient() {
+			t.Errorf("%d: reported as transient", code)
+		}
+		if a := code.SuggestedAction(); a != actionUnknown {
+			t.Errorf("%d: unexpected action %q", code, a)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+// lambdaRequest and lambdaResponse mimic the events an API gateway
+// passes to and expects from a serverless function.
+type lambdaRequest struct {
+	Headers         map[string]string
+	SourceIP        string
+	Body            string
+	IsBase64Encoded bool
+}
+
+type lambdaResponse struct {
+	StatusCode      int
+	Headers         map[string]string
+	Body            string
+	IsBase64Encoded bool
+}
+
+// lambdaHandler adapts an OmahaHandler to a serverless function.
+func lambdaHandler(h *OmahaHandler) func(context.Context, *lambdaRequest) (*lambdaResponse, error) {
+	return func(ctx context.Context, req *lambdaRequest) (*lambdaResponse, error) {
+		body := []byte(req.Body)
+		if req.IsBase64Encoded {
+			var err error
+			if body, err = base64.StdEncoding.DecodeString(req.Body); err != nil {
+				return nil, err
+			}
+		}
+
+		meta := RequestMeta{
+			RemoteAddr:      req.SourceIP,
+			Host:            req.Headers["Host"],
+			ContentType:     req.Headers["Content-Type"],
+			ContentEncoding: req.Headers["Content-Encoding"],
+			AcceptEncoding:  req.Headers["Accept-Encoding"],
+		}
+		status, respBody, headers, _ := h.Exchange(ctx, meta, body)
+		return &lambdaResponse{
+			StatusCode:      status,
+			Headers:         headers,
+			Body:            base64.StdEncoding.EncodeToString(respBody),
+			IsBase64Encoded: true,
+		}, nil
+	}
+}
+
+func TestExchangeParity(t *testing.T) {
+	small := fmt.Sprintf(`<request protocol="3.0"><app appid="%s" version="%s"><updatecheck/></app></request>`,
+		testAppID, testAppVer)
+	large := bytes.NewBufferString(`<request protocol="3.0">`)
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(large, `<app appid="{app-%d}" version="1.0.0"><updatecheck/><ping/></app>`, i)
+	}
+	large.WriteString(`</request>`)
+
+	for _, tt := range []struct {
+		name    string
+		headers map[string]string
+		body    []byte
+	}{
+		{"update", nil, []byte(small)},
+		{"gzip request", map[string]string{"Content-Encoding": "gzip"}, gzipRequest(t, small)},
+		{"gzip response", map[string]string{"Accept-Encoding": "gzip"}, large.Bytes()},
+		{"gzip bomb", map[string]string{"Content-Encoding": "gzip"},
+			gzipRequest(t, `<request protocol="3.0">`+strings.Repeat(" ", 2*maxRequestSize))},
+		{"too large", nil, bytes.Repeat([]byte(" "), maxRequestSize+1)},
+		{"unknown encoding", map[string]string{"Content-Encoding": "br"}, []byte(small)},
+		{"bad xml", nil, []byte(`<request protocol="3.0"><app>`)},
+		{"no apps", nil, []byte(`<request protocol="3.0"></request>`)},
+	} {
+		handler := &OmahaHandler{
+			Updater:           &updateAll{update: &Update{Manifest: Manifest{Version: "1.1.1"}}},
+			CompressResponses: true,
+		}
+
+		httpReq := httptest.NewRequest("POST", "/v1/update/", bytes.NewReader(tt.body))
+		for k, v := range tt.headers {
+			httpReq.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httpReq)
+
+		httpResp := &lambdaResponse{
+			StatusCode:      rec.Code,
+			Headers:         make(map[string]string),
+			Body:            base64.StdEncoding.EncodeToString(rec.Body.Bytes()),
+			IsBase64Encoded: true,
+		}
+		for k := range rec.HeaderMap {
+			httpResp.Headers[k] = rec.HeaderMap.Get(k)
+		}
+
+		headers := map[string]string{"Host": httpReq.Host}
+		for k, v := range tt.headers {
+			headers[k] = v
+		}
+		lambdaResp, err := lambdaHandler(handler)(context.Background(), &lambdaRequest{
+			Headers:         headers,
+			SourceIP:        httpReq.RemoteAddr,
+			Body:            base64.StdEncoding.EncodeToString(tt.body),
+			IsBase64Encoded: true,
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		if diff := pretty.Compare(httpResp, lambdaResp); diff != "" {
+			t.Errorf("%s: responses differ: %s", tt.name, diff)
+		}
+	}
+}
+
+func TestExchangeCanceled(t *testing.T) {
+	handler := &OmahaHandler{Updater: UpdaterStub{}}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	body := fmt.Sprintf(`<request protocol="3.0"><app appid="%s" version="%s"></app></request>`,
+		testAppID, testAppVer)
+	status, _, _, err := handler.Exchange(ctx, RequestMeta{}, []byte(body))
+	if err != context.Canceled {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if status != http.StatusServiceUnavailable {
+		t.Errorf("unexpected status %d", status)
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+// AssertGolden marshals v and compares it to the document captured from
+// a real client or server at path. Whitespace, attribute order and the
+// order of differently named sibling elements are ignored.
+//
+// Re-encoding a capture may lose a few attributes, listed in
+// differences as "-path@attr=value" for attributes dropped and
+// "+path@attr=value" for attributes added.
+func AssertGolden(t *testing.T, v interface{}, path string, differences ...string) {
+	captured, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := xml.Marshal(v)
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+
+	before, _ := flattenXML(t, path, captured)
+	after, _ := flattenXML(t, path, encoded)
+	var got []string
+	for k, v := range before {
+		if w, ok := after[k]; !ok || w != v {
+			got = append(got, fmt.Sprintf("-%s=%q", k, v))
+		}
+	}
+	for k, v := range after {
+		if w, ok := before[k]; !ok || w != v {
+			got = append(got, fmt.Sprintf("+%s=%q", k, v))
+		}
+	}
+	sort.Strings(got)
+	if differences == nil {
+		differences = []string{}
+	}
+	if got == nil {
+		got = []string{}
+	}
+	if diff := pretty.Compare(differences, got); diff != "" {
+		t.Errorf("%s: unexpected differences from capture:\n%s", path, diff)
+	}
+}
+
+// TestGoldenAttributeOrder checks requests encode their attributes in
+// the order update_engine sends them, so its captures can be diffed
+// against our encoding.
+func TestGoldenAttributeOrder(t *testing.T) {
+	for _, tt := range goldenCaptures {
+		if tt.response || !strings.HasPrefix(tt.capture, "update-engine/") {
+			continue
+		}
+		capture := filepath.Join("..", "fixtures", tt.capture)
+		captured, err := ioutil.ReadFile(capture)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded, err := xml.Marshal(parseGolden(t, capture, tt.response))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, before := flattenXML(t, capture, captured)
+		_, after := flattenXML(t, capture, encoded)
+		for elem, order := range before {
+			a, b := commonOrder(order, after[elem]), commonOrder(after[elem], order)
+			if !reflect.DeepEqual(a, b) {
+				t.Errorf("%s: %s attributes encoded as %v, captured as %v", tt.capture, elem, b, a)
+			}
+		}
+	}
+}
+
+// commonOrder returns the names in a that are also in b, in a's order.
+func commonOrder(a, b []string) []string {
+	in := make(map[string]bool, len(b))
+	for _, name := range b {
+		in[name] = true
+	}
+	var common []string
+	for _, name := range a {
+		if in[name] {
+			common = append(common, name)
+		}
+	}
+	return common
+}
+
+// goldenCaptures lists traffic captured from real clients and servers in
+// the top level fixtures directory.
+//
+// Empty strings, zero and false are among the differences since the
+// fields cannot tell them apart from unset values. Attributes the
+// package does not model are dropped.
+var goldenCaptures = []struct {
+	capture     string
+	response    bool
+	differences []string
+}{
+	{"update-engine/update/request.xml", false, []string{
+		`-request/app[0]/event[0]@previousversion=""`,
+		`-request/app[0]/updatecheck[0]@targetversionprefix=""`,
+		`-request/app[0]@delta_okay="false"`,
+		`-request/app[0]@hardware_class=""`,
+	}},
+	{"update-engine/update/response.xml", true, []string{
+		// ChromeOSVersion and IsDelta predate the DisplayVersion
+		// and IsDeltaPayload attributes update_engine reads.
+		`+response@server=""`,
+		`-response/app[0]/updatecheck[0]/manifest[0]/actions[0]/action[0]@ChromeOSVersion="9999.0.0"`,
+		`-response/app[0]/updatecheck[0]/manifest[0]/actions[0]/action[0]@IsDelta="True"`,
+		`-response/app[0]/updatecheck[0]/manifest[0]/actions[0]/action[0]@needsadmin="false"`,
+	}},
+	{"update-engine/no-update/request.xml", false, []string{
+		`-request/app[0]@delta_okay="false"`,
+		`-request/app[0]@hardware_class=""`,
+		`-request/app[0]@track=""`,
+	}},
+	{"request.xml", false, []string{
+		`-request/app[0]@nextversion=""`,
+		`-request/app[1]@client=""`,
+		`-request/app[1]@nextversion=""`,
+		`-request/os[0]@sp=""`,
+		`-request@ismachine="0"`,
+	}},
+}
+
+func parseGolden(t *testing.T, path string, response bool) interface{} {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var v interface{}
+	if response {
+		v, err = ParseResponse("", f)
+	} else {
+		v, err = ParseRequest("", f)
+	}
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	return v
+}
+
+func TestGoldenCaptures(t *testing.T) {
+	for _, tt := range goldenCaptures {
+		capture := filepath.Join("..", "fixtures", tt.capture)
+		AssertGolden(t, parseGolden(t, capture, tt.response), capture, tt.differences...)
+	}
+}
+
+// flattenXML lists every element and attribute in a document by path,
+// indexing elements among siblings of the same name, so whitespace and
+// the order of differently named siblings are ignored. The attribute
+// names of each element are also returned in document order.
+func flattenXML(t *testing.T, path string, data []byte) (map[string]string, map[string][]string) {
+	flat := make(map[string]string)
+	order := make(map[string][]string)
+	var stack []string
+	var counts []map[string]int
+	counts = append(counts, map[string]int{})
+	d := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return flat, order
+		} else if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			n := counts[len(counts)-1][tok.Name.Local]
+			counts[len(counts)-1][tok.Name.Local]++
+			elem := tok.Name.Local
+			if len(stack) != 0 {
+				elem = fmt.Sprintf("%s[%d]", elem, n)
+			}
+			stack = append(stack, elem)
+			counts = append(counts, map[string]int{})
+			key := strings.Join(stack, "/")
+			flat[key] = ""
+			for _, a := range tok.Attr {
+				flat[key+"@"+a.Name.Local] = a.Value
+				order[key] = append(order[key], a.Name.Local)
+			}
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+			counts = counts[:len(counts)-1]
+		case xml.CharData:
+			if text := strings.TrimSpace(string(tok)); text != "" {
+				flat[strings.Join(stack, "/")] = text
+			}
+		}
+	}
+}
+
+// TestGoldenRoundTrip checks encoding is stable: a parsed capture
+// encodes byte for byte the same after another parse.
+func TestGoldenRoundTrip(t *testing.T) {
+	for _, tt := range goldenCaptures {
+		capture := filepath.Join("..", "fixtures", tt.capture)
+		first, err := xml.Marshal(parseGolden(t, capture, tt.response))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var reparsed interface{}
+		if tt.response {
+			reparsed, err = ParseResponse("", bytes.NewReader(first))
+		} else {
+			reparsed, err = ParseRequest("", bytes.NewReader(first))
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.capture, err)
+		}
+		second, err := xml.Marshal(reparsed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(first, second) {
+			t.Errorf("%s: encoding changed after a round trip:\n%s\n%s", tt.capture, first, second)
+		}
+	}
+}
@@ -15,71 +15,579 @@
 package omaha
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+const (
+	// A request over 1M in size is certainly bogus, compressed or not.
+	maxRequestSize = 1024 * 1024
+
+	// Responses smaller than this are not worth compressing.
+	compressMinSize = 1024
+
+	// DefaultMaxSpooledEvents is the number of events held in
+	// maintenance mode if OmahaHandler.MaxSpooledEvents is zero.
+	DefaultMaxSpooledEvents = 10000
+)
+
+var requestTooLargeError = errors.New("omaha: request body too large")
+
 type OmahaHandler struct {
 	Updater
+
+	// CompressResponses enables gzip encoding of larger responses
+	// for clients that send Accept-Encoding: gzip.
+	CompressResponses bool
+
+	// OnEvent, if set, is called with every event in a request before
+	// the request is passed to the Updater, even in maintenance mode.
+	// It does not affect the response.
+	OnEvent func(appID string, event *EventRequest)
+
+	// Journal, if set, records every exchange.
+	Journal *Journal
+
+	// TrustProxy takes the client's address from X-Forwarded-For.
+	// Only enable this behind proxies that set the header, otherwise
+	// clients may claim any address.
+	TrustProxy bool
+
+	// UnknownApps, if set, caches apps CheckApp rejected with
+	// AppUnknownID. On demand requests always reach the Updater so
+	// newly registered apps can be tested immediately.
+	UnknownApps *UnknownAppCache
+
+	// MaintenanceRetryAfter, if set, is sent as X-Retry-After with
+	// responses in maintenance mode, asking clients to wait that long
+	// before contacting the server again.
+	MaintenanceRetryAfter time.Duration
+
+	// MaxSpooledEvents limits the events held in maintenance mode,
+	// DefaultMaxSpooledEvents if zero. Further events are dropped and
+	// counted in MaintenanceStats.
+	MaxSpooledEvents int
+
+	// mu is held for reading while serving a request so maintenance
+	// mode can only change between exchanges.
+	mu          sync.RWMutex
+	maintenance bool
+	spool       bool
+
+	// spoolMu guards spooled and stats since concurrent requests may
+	// update them while mu is only held for reading.
+	spoolMu sync.Mutex
+	spooled []spooledEvent
+	stats   MaintenanceStats
+}
+
+// MaintenanceStats describes the current or most recent maintenance
+// period, for metrics.
+type MaintenanceStats struct {
+	// Started and Stopped are when the period began and ended.
+	// Stopped is zero while still in maintenance mode.
+	Started time.Time
+	Stopped time.Time
+
+	// Requests answered in maintenance mode.
+	Requests uint64
+
+	// Events spooled and not yet replayed, and events dropped
+	// because the spool was full.
+	Spooled int
+	Dropped uint64
+}
+
+// spooledEvent is an event received while in maintenance mode.
+type spooledEvent struct {
+	req   *Request
+	app   *AppRequest
+	event *EventRequest
+}
+
+// StartMaintenance stops passing requests to the Updater, for example
+// while its backing store is offline. Clients still receive well formed
+// responses: every app is ok, update checks get noupdate, and pings and
+// events are acknowledged. If spool is true up to MaxSpooledEvents events
+// are held and passed to the Updater by StopMaintenance, otherwise they
+// are discarded.
+func (o *OmahaHandler) StartMaintenance(spool bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.maintenance {
+		o.stats = MaintenanceStats{Started: time.Now()}
+	}
+	o.maintenance = true
+	o.spool = spool
+}
+
+// StopMaintenance replays any spooled events to the Updater in the order
+// they were received and resumes normal operation. Requests arriving
+// during the replay wait for it to finish.
+func (o *OmahaHandler) StopMaintenance() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, s := range o.spooled {
+		o.Event(s.req, s.app, s.event)
+	}
+	o.spooled = nil
+	if o.maintenance {
+		o.stats.Spooled = 0
+		o.stats.Stopped = time.Now()
+	}
+	o.maintenance = false
+}
+
+// MaintenanceStats returns the statistics of the current or most recent
+// maintenance period.
+func (o *OmahaHandler) MaintenanceStats() MaintenanceStats {
+	o.spoolMu.Lock()
+	defer o.spoolMu.Unlock()
+	return o.stats
+}
+
+// InMaintenance reports whether maintenance mode is enabled.
+func (o *OmahaHandler) InMaintenance() bool {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.maintenance
+}
+
+// RequestMeta describes the transport carrying an Omaha request.
+type RequestMeta struct {
+	// RemoteAddr is the network address of the client.
+	RemoteAddr string
+
+	// Host is the host the request was sent to, update URLs are
+	// relative to it.
+	Host string
+
+	// ContentType and ContentEncoding describe the request body.
+	ContentType     string
+	ContentEncoding string
+
+	// AcceptEncoding lists the encodings the client accepts for the
+	// response, in the same format as the HTTP header.
+	AcceptEncoding string
+
+	// ForwardedFor and UserAgent are the X-Forwarded-For and
+	// User-Agent headers.
+	ForwardedFor string
+	UserAgent    string
+
+	// TLS is set if the request was received over HTTPS.
+	TLS bool
+
+	// Received is when the request arrived, set by Exchange if zero.
+	Received time.Time
+
+	// ClientIP is the client's address, taken from RemoteAddr or, if
+	// the handler's TrustProxy is set, X-Forwarded-For. Exchange sets
+	// it if nil.
+	ClientIP net.IP
+}
+
+func newRequestMeta(httpReq *http.Request) RequestMeta {
+	return RequestMeta{
+		RemoteAddr:      httpReq.RemoteAddr,
+		Host:            httpReq.Host,
+		ContentType:     httpReq.Header.Get("Content-Type"),
+		ContentEncoding: httpReq.Header.Get("Content-Encoding"),
+		AcceptEncoding:  httpReq.Header.Get("Accept-Encoding"),
+		ForwardedFor:    strings.Join(httpReq.Header["X-Forwarded-For"], ","),
+		UserAgent:       httpReq.Header.Get("User-Agent"),
+		TLS:             httpReq.TLS != nil,
+		Received:        time.Now(),
+	}
+}
+
+// clientIP finds the client's address. Proxies append the address
+// they received a request from to X-Forwarded-For, so the header is
+// read from the end, skipping private addresses of internal proxies.
+// The first public address is the client as seen by the outermost
+// trusted proxy. Anything before it may have been sent by the client.
+func (o *OmahaHandler) clientIP(meta *RequestMeta) net.IP {
+	ip := remoteIP(meta)
+	if !o.TrustProxy || meta.ForwardedFor == "" {
+		return ip
+	}
+
+	hops := strings.Split(meta.ForwardedFor, ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			// Garbage from the client or a broken proxy,
+			// the last good hop is the best guess.
+			break
+		}
+		ip = hop
+		if !isPrivateIP(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// remoteIP is the address the request came from, which may be a proxy.
+func remoteIP(meta *RequestMeta) net.IP {
+	host, _, err := net.SplitHostPort(meta.RemoteAddr)
+	if err != nil {
+		host = meta.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+var privateNets = []*net.IPNet{
+	mustParseCIDR("10.0.0.0/8"),
+	mustParseCIDR("172.16.0.0/12"),
+	mustParseCIDR("192.168.0.0/16"),
+	mustParseCIDR("100.64.0.0/10"), // carrier-grade NAT
+	mustParseCIDR("fc00::/7"),
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// isPrivateIP reports whether ip is a loopback, link-local or private
+// network address.
+func isPrivateIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return true
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
 
 func (o *OmahaHandler) ServeHTTP(w http.ResponseWriter, httpReq *http.Request) {
+	serveExchange(w, httpReq, o.Exchange)
+}
+
+// ServeExchange answers an Omaha request with serve, for servers that
+// build whole responses themselves rather than app by app through an
+// Updater. Requests are read, decoded and limited, and responses are
+// encoded, given a status and compressed, exactly as by OmahaHandler.
+func ServeExchange(w http.ResponseWriter, httpReq *http.Request, compress bool, serve func(context.Context, *Request) *Response) {
+	serveExchange(w, httpReq, func(ctx context.Context, meta RequestMeta, body []byte) (int, []byte, map[string]string, error) {
+		return ExchangeFunc(ctx, meta, body, compress, serve)
+	})
+}
+
+// exchangeFunc has the signature of OmahaHandler.Exchange.
+type exchangeFunc func(ctx context.Context, meta RequestMeta, body []byte) (int, []byte, map[string]string, error)
+
+func serveExchange(w http.ResponseWriter, httpReq *http.Request, exchange exchangeFunc) {
 	if httpReq.Method != "POST" {
 		log.Printf("omaha: Unexpected HTTP method: %s", httpReq.Method)
 		http.Error(w, "Expected a POST", http.StatusBadRequest)
 		return
 	}
 
-	// A request over 1M in size is certainly bogus.
-	reader := http.MaxBytesReader(w, httpReq.Body, 1024*1024)
-	contentType := httpReq.Header.Get("Content-Type")
-	omahaReq, err := ParseRequest(contentType, reader)
+	// Exchange rejects anything larger than maxRequestSize so there
+	// is no need to read further than that.
+	reqBody, err := ioutil.ReadAll(io.LimitReader(httpReq.Body, maxRequestSize+1))
 	if err != nil {
-		log.Printf("omaha: Failed parsing request: %v", err)
+		log.Printf("omaha: Failed reading request: %v", err)
 		http.Error(w, "Bad Omaha Request", http.StatusBadRequest)
 		return
 	}
 
-	httpStatus := 0
-	omahaResp := NewResponse()
-	for _, appReq := range omahaReq.Apps {
-		appResp := o.serveApp(omahaResp, httpReq, omahaReq, appReq)
-		if appResp.Status == AppOK {
-			// HTTP is ok if any app is ok.
-			httpStatus = http.StatusOK
-		} else if httpStatus == 0 {
-			// If no app is ok HTTP will use the first error.
-			if appResp.Status == AppInternalError {
-				httpStatus = http.StatusInternalServerError
-			} else {
-				httpStatus = http.StatusBadRequest
-			}
+	status, respBody, headers, err := exchange(httpReq.Context(), newRequestMeta(httpReq), reqBody)
+	if err != nil {
+		log.Print(err)
+	}
+
+	for k, v := range headers {
+		w.Header().Set(k, v)
+	}
+	w.WriteHeader(status)
+	if _, err := w.Write(respBody); err != nil {
+		log.Printf("omaha: Failed writing response: %v", err)
+	}
+}
+
+// Exchange performs one complete Omaha exchange independent of net/http,
+// for example for serverless functions. It returns the HTTP status,
+// body, and headers of the response. Requests that cannot be handled
+// still get a plain text error response along with a non-nil error
+// describing the problem.
+func (o *OmahaHandler) Exchange(ctx context.Context, meta RequestMeta, body []byte) (status int, respBody []byte, headers map[string]string, err error) {
+	if meta.ClientIP == nil {
+		meta.ClientIP = o.clientIP(&meta)
+	}
+
+	var maintenance bool
+	serve := func(meta *RequestMeta, omahaReq *Request) *Response {
+		var omahaResp *Response
+		omahaResp, _, maintenance = o.serveRequest(meta, omahaReq)
+		return omahaResp
+	}
+	finish := func(meta *RequestMeta, omahaReq *Request, raw, respBody []byte, headers map[string]string) {
+		if o.Journal != nil {
+			o.Journal.Record(newJournalRecord(meta, omahaReq, raw, respBody))
+		}
+		if maintenance && o.MaintenanceRetryAfter > 0 {
+			secs := (o.MaintenanceRetryAfter + time.Second - 1) / time.Second
+			headers["X-Retry-After"] = strconv.FormatInt(int64(secs), 10)
 		}
 	}
+	return exchange(ctx, &meta, body, o.CompressResponses, serve, finish)
+}
 
-	if httpStatus == 0 {
-		httpStatus = http.StatusBadRequest
+// ExchangeFunc is Exchange for the servers ServeExchange is for.
+func ExchangeFunc(ctx context.Context, meta RequestMeta, body []byte, compress bool, serve func(context.Context, *Request) *Response) (status int, respBody []byte, headers map[string]string, err error) {
+	if meta.ClientIP == nil {
+		meta.ClientIP = remoteIP(&meta)
 	}
+	return exchange(ctx, &meta, body, compress,
+		func(meta *RequestMeta, omahaReq *Request) *Response {
+			return serve(ctx, omahaReq)
+		}, nil)
+}
 
-	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
-	w.WriteHeader(httpStatus)
+// exchange is the body of Exchange and ExchangeFunc. serve answers the
+// parsed request and finish, if set, sees the uncompressed request and
+// response before the response is compressed and may add headers.
+func exchange(ctx context.Context, meta *RequestMeta, body []byte, compress bool,
+	serve func(*RequestMeta, *Request) *Response,
+	finish func(*RequestMeta, *Request, []byte, []byte, map[string]string)) (int, []byte, map[string]string, error) {
+	if err := ctx.Err(); err != nil {
+		return exchangeError(http.StatusServiceUnavailable, "Service Unavailable", err)
+	}
 
-	if _, err := w.Write([]byte(xml.Header)); err != nil {
-		log.Printf("omaha: Failed writing response: %v", err)
-		return
+	if len(body) > maxRequestSize {
+		return exchangeError(http.StatusRequestEntityTooLarge, "Request Too Large",
+			fmt.Errorf("omaha: request from %s is too large", meta.RemoteAddr))
 	}
 
-	encoder := xml.NewEncoder(w)
+	if meta.Received.IsZero() {
+		meta.Received = time.Now()
+	}
+
+	raw := body
+	switch meta.ContentEncoding {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return exchangeError(http.StatusBadRequest, "Bad Omaha Request",
+				fmt.Errorf("omaha: failed decompressing request: %v", err))
+		}
+		defer gz.Close()
+		// Limit the decompressed size too, guarding against gzip bombs.
+		raw, err = ioutil.ReadAll(&sizeLimitReader{r: gz, n: maxRequestSize})
+		if err == requestTooLargeError {
+			return exchangeError(http.StatusRequestEntityTooLarge, "Request Too Large",
+				fmt.Errorf("omaha: decompressed request from %s is too large", meta.RemoteAddr))
+		} else if err != nil {
+			return exchangeError(http.StatusBadRequest, "Bad Omaha Request",
+				fmt.Errorf("omaha: failed decompressing request: %v", err))
+		}
+	default:
+		return exchangeError(http.StatusUnsupportedMediaType, "Unsupported Content-Encoding",
+			fmt.Errorf("omaha: unexpected content encoding: %s", meta.ContentEncoding))
+	}
+
+	omahaReq, replaced, err := ParseRequestLenient(meta.ContentType, bytes.NewReader(raw))
+	if err != nil {
+		return exchangeError(http.StatusBadRequest, "Bad Omaha Request",
+			fmt.Errorf("omaha: failed parsing request: %v", err))
+	}
+	if replaced {
+		log.Printf("omaha: Replaced invalid UTF-8 in request from %s", meta.RemoteAddr)
+	}
+
+	omahaResp := serve(meta, omahaReq)
+	status := responseStatus(omahaResp)
+
+	buf := bytes.NewBufferString(xml.Header)
+	encoder := xml.NewEncoder(buf)
 	encoder.Indent("", "\t")
 	if err := encoder.Encode(omahaResp); err != nil {
-		log.Printf("omaha: Failed encoding response: %v", err)
+		return exchangeError(http.StatusInternalServerError, "Internal Server Error",
+			fmt.Errorf("omaha: failed encoding response: %v", err))
+	}
+	respBody := buf.Bytes()
+
+	headers := map[string]string{"Content-Type": "text/xml; charset=utf-8"}
+	if finish != nil {
+		finish(meta, omahaReq, raw, respBody, headers)
+	}
+	if compress {
+		headers["Vary"] = "Accept-Encoding"
+		if len(respBody) >= compressMinSize && acceptsGzip(meta.AcceptEncoding) {
+			// The response is still valid uncompressed so a
+			// failure here is logged rather than sent to the client.
+			if compressed, err := gzipBytes(respBody); err != nil {
+				log.Printf("omaha: Failed compressing response: %v", err)
+			} else {
+				headers["Content-Encoding"] = "gzip"
+				respBody = compressed
+			}
+		}
+	}
+
+	return status, respBody, headers, nil
+}
+
+// responseStatus is the HTTP status to send resp with: ok if any app is
+// ok, otherwise an error matching the first app.
+func responseStatus(resp *Response) int {
+	for _, appResp := range resp.Apps {
+		if appResp.Status == AppOK {
+			return http.StatusOK
+		}
 	}
+	if len(resp.Apps) > 0 && resp.Apps[0].Status == AppInternalError {
+		return http.StatusInternalServerError
+	}
+	return http.StatusBadRequest
+}
+
+// gzipBytes compresses data, failing if any write does.
+func gzipBytes(data []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	if _, err := gz.Write(data); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// exchangeError builds a plain text error response like http.Error.
+func exchangeError(status int, msg string, err error) (int, []byte, map[string]string, error) {
+	headers := map[string]string{
+		"Content-Type":           "text/plain; charset=utf-8",
+		"X-Content-Type-Options": "nosniff",
+	}
+	return status, []byte(msg + "\n"), headers, err
 }
 
-func (o *OmahaHandler) serveApp(omahaResp *Response, httpReq *http.Request, omahaReq *Request, appReq *AppRequest) *AppResponse {
+// serveRequest passes each app in the request to the Updater, returning
+// the response, the HTTP status to send it with, and whether it was
+// answered in maintenance mode.
+func (o *OmahaHandler) serveRequest(meta *RequestMeta, omahaReq *Request) (*Response, int, bool) {
+	omahaResp := NewResponse()
+	if omahaReq.Protocol == ProtocolV31 {
+		omahaResp.Protocol = ProtocolV31
+	}
+	if omahaReq.MinimalAck && omahaReq.EventOnly() {
+		omahaResp.MinimalAck = true
+	}
+
+	if o.OnEvent != nil {
+		for _, appReq := range omahaReq.Apps {
+			for _, event := range appReq.Events {
+				o.OnEvent(appReq.ID, event)
+			}
+		}
+	}
+
+	o.mu.RLock()
+	maintenance := o.maintenance
+	if maintenance {
+		o.spoolMu.Lock()
+		o.stats.Requests++
+		o.spoolMu.Unlock()
+	}
+	for _, appReq := range omahaReq.Apps {
+		if maintenance {
+			o.serveMaintenance(omahaResp, omahaReq, appReq)
+		} else {
+			o.serveApp(omahaResp, meta, omahaReq, appReq)
+		}
+	}
+	o.mu.RUnlock()
+
+	return omahaResp, responseStatus(omahaResp), maintenance
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip.
+func acceptsGzip(header string) bool {
+	for _, coding := range strings.Split(header, ",") {
+		params := strings.Split(coding, ";")
+		name := strings.TrimSpace(params[0])
+		if name != "gzip" && name != "*" {
+			continue
+		}
+		accepted := true
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				q, err := strconv.ParseFloat(p[2:], 64)
+				accepted = err == nil && q > 0
+			}
+		}
+		return accepted
+	}
+	return false
+}
+
+// sizeLimitReader fails with requestTooLargeError if r has over n bytes.
+type sizeLimitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *sizeLimitReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		// Check for EOF before declaring the data too large.
+		var b [1]byte
+		if n, err := l.r.Read(b[:]); n == 0 && err != nil {
+			return 0, err
+		}
+		return 0, requestTooLargeError
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+func (o *OmahaHandler) serveApp(omahaResp *Response, meta *RequestMeta, omahaReq *Request, appReq *AppRequest) *AppResponse {
+	cache := o.UnknownApps
+	if omahaReq.InstallSource == InstallSourceOnDemand {
+		cache = nil
+	}
+	var gen uint64
+	if cache != nil {
+		var unknown bool
+		if unknown, gen = cache.lookup(appReq.ID); unknown {
+			return omahaResp.AddApp(appReq.ID, AppUnknownID)
+		}
+	}
+
 	if err := o.CheckApp(omahaReq, appReq); err != nil {
 		if appStatus, ok := err.(AppStatus); ok {
+			if appStatus == AppUnknownID && cache != nil {
+				cache.add(appReq.ID, gen)
+			}
 			return omahaResp.AddApp(appReq.ID, appStatus)
 		}
 		log.Printf("omaha: CheckApp failed: %v", err)
@@ -88,7 +596,7 @@ func (o *OmahaHandler) serveApp(omahaResp *Response, httpReq *http.Request, omah
 
 	appResp := omahaResp.AddApp(appReq.ID, AppOK)
 	if appReq.UpdateCheck != nil {
-		o.checkUpdate(appResp, httpReq, omahaReq, appReq)
+		o.checkUpdate(appResp, meta, omahaReq, appReq)
 	}
 
 	if appReq.Ping != nil {
@@ -104,8 +612,55 @@ func (o *OmahaHandler) serveApp(omahaResp *Response, httpReq *http.Request, omah
 	return appResp
 }
 
-func (o *OmahaHandler) checkUpdate(appResp *AppResponse, httpReq *http.Request, omahaReq *Request, appReq *AppRequest) {
-	update, err := o.CheckUpdate(omahaReq, appReq)
+// serveMaintenance answers an app without consulting the Updater.
+// The caller must hold o.mu for reading.
+func (o *OmahaHandler) serveMaintenance(omahaResp *Response, omahaReq *Request, appReq *AppRequest) *AppResponse {
+	appResp := omahaResp.AddApp(appReq.ID, AppOK)
+	if appReq.UpdateCheck != nil {
+		appResp.AddUpdateCheck(NoUpdate)
+	}
+
+	if appReq.Ping != nil {
+		appResp.AddPing()
+	}
+
+	for _, event := range appReq.Events {
+		if o.spool {
+			o.spoolEvent(omahaReq, appReq, event)
+		}
+		appResp.AddEvent()
+	}
+
+	return appResp
+}
+
+// spoolEvent holds an event for StopMaintenance, dropping it if the
+// spool is full.
+func (o *OmahaHandler) spoolEvent(omahaReq *Request, appReq *AppRequest, event *EventRequest) {
+	o.spoolMu.Lock()
+	defer o.spoolMu.Unlock()
+	max := o.MaxSpooledEvents
+	if max <= 0 {
+		max = DefaultMaxSpooledEvents
+	}
+	if len(o.spooled) >= max {
+		o.stats.Dropped++
+		return
+	}
+	o.spooled = append(o.spooled, spooledEvent{omahaReq, appReq, event})
+	o.stats.Spooled = len(o.spooled)
+}
+
+func (o *OmahaHandler) checkUpdate(appResp *AppResponse, meta *RequestMeta, omahaReq *Request, appReq *AppRequest) {
+	var (
+		update *Update
+		err    error
+	)
+	if mu, ok := o.Updater.(MetaUpdater); ok {
+		update, err = mu.CheckUpdateMeta(meta, omahaReq, appReq)
+	} else {
+		update, err = o.CheckUpdate(omahaReq, appReq)
+	}
 	if err != nil {
 		if updateStatus, ok := err.(UpdateStatus); ok {
 			appResp.AddUpdateCheck(updateStatus)
@@ -115,13 +670,20 @@ func (o *OmahaHandler) checkUpdate(appResp *AppResponse, httpReq *http.Request,
 		}
 	} else if update != nil {
 		u := appResp.AddUpdateCheck(UpdateOK)
-		fillUpdate(u, update, httpReq)
+		fillUpdate(u, update, meta)
 	} else {
 		appResp.AddUpdateCheck(NoUpdate)
 	}
 }
 
-func fillUpdate(u *UpdateResponse, update *Update, httpReq *http.Request) {
-	u.URLs = update.URLs([]string{"http://" + httpReq.Host})
+// fillUpdate makes a relative codebase relative to the server's host.
+// Absolute codebases, such as a mirror picked by a MetaUpdater, are
+// used as is.
+func fillUpdate(u *UpdateResponse, update *Update, meta *RequestMeta) {
+	if strings.Contains(update.URL.CodeBase, "://") {
+		u.URLs = update.URLs([]string{""})
+	} else {
+		u.URLs = update.URLs([]string{"http://" + meta.Host})
+	}
 	u.Manifest = &update.Manifest
 }
@@ -15,9 +15,20 @@
 package omaha
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
 	"encoding/xml"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/kylelemons/godebug/diff"
 )
@@ -59,10 +70,619 @@ func compareXML(a, b interface{}) error {
 }
 
 func TestHandleNilRequest(t *testing.T) {
-	handler := OmahaHandler{UpdaterStub{}}
+	handler := OmahaHandler{Updater: UpdaterStub{}}
 	response := NewResponse()
 	handler.serveApp(response, nil, nilRequest, nilRequest.Apps[0])
 	if err := compareXML(nilResponse, response); err != nil {
 		t.Error(err)
 	}
 }
+
+func TestHandleProtocolVersion(t *testing.T) {
+	handler := &OmahaHandler{Updater: UpdaterStub{}}
+	for _, protocol := range []string{ProtocolV30, ProtocolV31} {
+		body := fmt.Sprintf(`<request protocol="%s"><app appid="%s" version="%s"></app></request>`,
+			protocol, testAppID, testAppVer)
+		req := httptest.NewRequest("POST", "/v1/update/", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("unexpected HTTP status: %d", rec.Code)
+		}
+
+		resp, err := ParseResponse(rec.Header().Get("Content-Type"), rec.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Protocol != protocol {
+			t.Errorf("request protocol %s got response protocol %s",
+				protocol, resp.Protocol)
+		}
+	}
+}
+
+// eventRecorder records events and fails update checks.
+type eventRecorder struct {
+	UpdaterStub
+	mu     sync.Mutex
+	events []*EventRequest
+}
+
+func (e *eventRecorder) CheckUpdate(req *Request, app *AppRequest) (*Update, error) {
+	return nil, UpdateInternalError
+}
+
+func (e *eventRecorder) Event(req *Request, app *AppRequest, event *EventRequest) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.events = append(e.events, event)
+}
+
+func postRequest(handler http.Handler, req *Request) (*Response, error) {
+	body, err := xml.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq := httptest.NewRequest("POST", "/v1/update/", strings.NewReader(string(body)))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httpReq)
+	if rec.Code != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status: %d", rec.Code)
+	}
+
+	return ParseResponse(rec.Header().Get("Content-Type"), rec.Body)
+}
+
+func TestHandleMaintenance(t *testing.T) {
+	recorder := &eventRecorder{}
+	handler := &OmahaHandler{Updater: recorder}
+	handler.StartMaintenance(true)
+	if !handler.InMaintenance() {
+		t.Fatal("maintenance mode not enabled")
+	}
+
+	req := NewRequest()
+	app := req.AddApp(testAppID, testAppVer)
+	app.AddUpdateCheck()
+	app.AddPing()
+	for i := 0; i < 3; i++ {
+		app.AddEvent().Type = EventType(i)
+	}
+
+	resp, err := postRequest(handler, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	appResp := resp.GetApp(testAppID)
+	if appResp == nil || appResp.Status != AppOK {
+		t.Fatalf("unexpected response: %#v", resp)
+	}
+	if appResp.UpdateCheck == nil || appResp.UpdateCheck.Status != NoUpdate {
+		t.Errorf("expected noupdate, got %#v", appResp.UpdateCheck)
+	}
+	if appResp.Ping == nil || len(appResp.Events) != 3 {
+		t.Errorf("ping and events not acknowledged: %#v", appResp)
+	}
+	if len(recorder.events) != 0 {
+		t.Fatalf("events passed to updater during maintenance")
+	}
+
+	handler.StopMaintenance()
+	if handler.InMaintenance() {
+		t.Fatal("maintenance mode not disabled")
+	}
+	if len(recorder.events) != 3 {
+		t.Fatalf("expected 3 spooled events, not %d", len(recorder.events))
+	}
+	for i, event := range recorder.events {
+		if event.Type != EventType(i) {
+			t.Errorf("event %d replayed out of order: %d", i, event.Type)
+		}
+	}
+
+	// Back to normal, the updater's error is visible again.
+	resp, err = postRequest(handler, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := resp.Apps[0].UpdateCheck.Status; s != UpdateInternalError {
+		t.Errorf("expected %s, got %s", UpdateInternalError, s)
+	}
+}
+
+func TestHandleMaintenanceHoldoff(t *testing.T) {
+	recorder := &eventRecorder{}
+	handler := &OmahaHandler{
+		Updater:               recorder,
+		MaintenanceRetryAfter: 90 * time.Second,
+		MaxSpooledEvents:      2,
+	}
+
+	req := NewRequest()
+	app := req.AddApp(testAppID, testAppVer)
+	app.AddUpdateCheck()
+	for i := 0; i < 3; i++ {
+		app.AddEvent().Type = EventType(i)
+	}
+	body, err := xml.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("POST", "/v1/update/", bytes.NewReader(body)))
+		return rec
+	}
+
+	if h := post().Header().Get("X-Retry-After"); h != "" {
+		t.Errorf("retry hint outside maintenance: %q", h)
+	}
+
+	handler.StartMaintenance(true)
+	rec := post()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected HTTP status: %d", rec.Code)
+	}
+	if h := rec.Header().Get("X-Retry-After"); h != "90" {
+		t.Errorf("expected X-Retry-After 90, not %q", h)
+	}
+	resp, err := ParseResponse(rec.Header().Get("Content-Type"), rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := resp.Apps[0].UpdateCheck; u == nil || u.Status != NoUpdate {
+		t.Errorf("expected noupdate, got %#v", u)
+	}
+	if len(resp.Apps[0].Events) != 3 {
+		t.Errorf("dropped events not acknowledged: %#v", resp.Apps[0])
+	}
+
+	stats := handler.MaintenanceStats()
+	if stats.Started.IsZero() || !stats.Stopped.IsZero() {
+		t.Errorf("unexpected maintenance period: %+v", stats)
+	}
+	if stats.Requests != 1 || stats.Spooled != 2 || stats.Dropped != 1 {
+		t.Errorf("unexpected maintenance stats: %+v", stats)
+	}
+
+	// Three events from before maintenance and two from the spool.
+	handler.StopMaintenance()
+	if len(recorder.events) != 5 {
+		t.Errorf("expected 5 events, not %d", len(recorder.events))
+	}
+	stats = handler.MaintenanceStats()
+	if stats.Stopped.Before(stats.Started) || stats.Spooled != 0 || stats.Dropped != 1 {
+		t.Errorf("unexpected stats after maintenance: %+v", stats)
+	}
+}
+
+func TestHandleMaintenanceConcurrent(t *testing.T) {
+	recorder := &eventRecorder{}
+	handler := &OmahaHandler{Updater: recorder}
+	handler.StartMaintenance(true)
+
+	req := NewRequest()
+	req.AddApp(testAppID, testAppVer).AddEvent()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := postRequest(handler, req); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	handler.StopMaintenance()
+	wg.Wait()
+
+	// Every event is delivered exactly once, either spooled or directly.
+	if len(recorder.events) != 10 {
+		t.Errorf("expected 10 events, not %d", len(recorder.events))
+	}
+}
+
+func TestHandleInvalidUTF8(t *testing.T) {
+	handler := &OmahaHandler{Updater: UpdaterStub{}}
+	req := httptest.NewRequest("POST", "/v1/update/",
+		strings.NewReader(strings.Replace(invalidUTF8Request,
+			`appid="`, "appid=\"\xff", 1)))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected HTTP status: %d", rec.Code)
+	}
+
+	// ParseResponse is strict so this proves the output is valid.
+	resp, err := ParseResponse(rec.Header().Get("Content-Type"), rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := resp.Apps[0].ID; id != "\uFFFD{87efface-864d-49a5-9bb3-4b050a7c227a}" {
+		t.Errorf("unexpected app id %q", id)
+	}
+}
+
+func gzipRequest(t *testing.T, body string) []byte {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	if _, err := gz.Write([]byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestHandleGzip(t *testing.T) {
+	body := fmt.Sprintf(`<request protocol="3.0"><app appid="%s" version="%s"></app></request>`,
+		testAppID, testAppVer)
+	compressed := gzipRequest(t, body)
+
+	for _, tt := range []struct {
+		name     string
+		encoding string
+		body     []byte
+		status   int
+	}{
+		{"plain", "", []byte(body), http.StatusOK},
+		{"gzip", "gzip", compressed, http.StatusOK},
+		{"empty", "gzip", nil, http.StatusBadRequest},
+		{"truncated", "gzip", compressed[:len(compressed)/2], http.StatusBadRequest},
+		{"not gzip", "gzip", []byte(body), http.StatusBadRequest},
+		{"unknown", "br", compressed, http.StatusUnsupportedMediaType},
+	} {
+		handler := &OmahaHandler{Updater: UpdaterStub{}}
+		req := httptest.NewRequest("POST", "/v1/update/", bytes.NewReader(tt.body))
+		if tt.encoding != "" {
+			req.Header.Set("Content-Encoding", tt.encoding)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != tt.status {
+			t.Errorf("%s: expected HTTP status %d, not %d",
+				tt.name, tt.status, rec.Code)
+		}
+	}
+}
+
+func TestHandleGzipBomb(t *testing.T) {
+	// 16M of zeros compresses to a few kilobytes.
+	bomb := gzipRequest(t, `<request protocol="3.0">`+strings.Repeat("\x00", 16*1024*1024))
+	if len(bomb) >= maxRequestSize {
+		t.Fatalf("compressed bomb is %d bytes", len(bomb))
+	}
+
+	handler := &OmahaHandler{Updater: UpdaterStub{}}
+	req := httptest.NewRequest("POST", "/v1/update/", bytes.NewReader(bomb))
+	req.Header.Set("Content-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected HTTP status %d, not %d",
+			http.StatusRequestEntityTooLarge, rec.Code)
+	}
+}
+
+func TestHandleCompressResponse(t *testing.T) {
+	body := bytes.NewBufferString(`<request protocol="3.0">`)
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(body, `<app appid="{app-%d}" version="1.0.0"><updatecheck/></app>`, i)
+	}
+	body.WriteString(`</request>`)
+	small := fmt.Sprintf(`<request protocol="3.0"><app appid="%s" version="%s"></app></request>`,
+		testAppID, testAppVer)
+
+	for _, tt := range []struct {
+		name     string
+		enabled  bool
+		body     string
+		accept   string
+		encoding string
+	}{
+		{"disabled", false, body.String(), "gzip", ""},
+		{"enabled", true, body.String(), "gzip", "gzip"},
+		{"not accepted", true, body.String(), "", ""},
+		{"refused", true, body.String(), "gzip;q=0, identity", ""},
+		{"wildcard", true, body.String(), "*", "gzip"},
+		{"small", true, small, "gzip", ""},
+	} {
+		handler := &OmahaHandler{
+			Updater:           UpdaterStub{},
+			CompressResponses: tt.enabled,
+		}
+		req := httptest.NewRequest("POST", "/v1/update/", strings.NewReader(tt.body))
+		req.Header.Set("Accept-Encoding", tt.accept)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: expected HTTP status %d, not %d",
+				tt.name, http.StatusOK, rec.Code)
+			continue
+		}
+
+		encoding := rec.Header().Get("Content-Encoding")
+		if encoding != tt.encoding {
+			t.Errorf("%s: expected Content-Encoding %q, not %q",
+				tt.name, tt.encoding, encoding)
+			continue
+		}
+
+		var reader io.Reader = rec.Body
+		if encoding == "gzip" {
+			gz, err := gzip.NewReader(reader)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			reader = gz
+		}
+		if _, err := ParseResponse("", reader); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
+
+func TestHandleMinimalAck(t *testing.T) {
+	full := fmt.Sprintf(`<request protocol="3.0"><app appid="%s" version="%s"><event eventtype="3" eventresult="1"></event></app></request>`,
+		testAppID, testAppVer)
+	minimal := strings.Replace(full, `protocol="3.0"`, `protocol="3.0" minimalack="1"`, 1)
+	mixed := strings.Replace(minimal, `<event`, `<ping active="1"></ping><event`, 1)
+
+	responses := make(map[string]string)
+	for _, tt := range []struct {
+		name    string
+		body    string
+		minimal bool
+	}{
+		{"full", full, false},
+		{"minimal", minimal, true},
+		{"mixed", mixed, false},
+	} {
+		handler := &OmahaHandler{Updater: UpdaterStub{}}
+		req := httptest.NewRequest("POST", "/v1/update/", strings.NewReader(tt.body))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected HTTP status %d, not %d",
+				tt.name, http.StatusOK, rec.Code)
+		}
+		responses[tt.name] = rec.Body.String()
+
+		resp, err := ParseResponse("", rec.Body)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		omahaReq, err := ParseRequest("", strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if err := resp.Validate(omahaReq); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+
+		hasDayStart := resp.DayStart.ElapsedSeconds != ""
+		if resp.MinimalAck != tt.minimal || hasDayStart == tt.minimal {
+			t.Errorf("%s: unexpected response: %s", tt.name, responses[tt.name])
+		}
+		if app := resp.GetApp(testAppID); app == nil || len(app.Events) != 1 {
+			t.Errorf("%s: event not acknowledged: %s", tt.name, responses[tt.name])
+		}
+	}
+
+	saved := len(responses["full"]) - len(responses["minimal"])
+	if saved <= 0 {
+		t.Errorf("minimal response is not smaller:\n%s\n%s",
+			responses["full"], responses["minimal"])
+	}
+	t.Logf("minimal ack saves %d of %d bytes", saved, len(responses["full"]))
+
+	// A minimal response to a request that did not ask for one is invalid.
+	req, _ := ParseRequest("", strings.NewReader(full))
+	resp := NewResponse()
+	resp.MinimalAck = true
+	if err := resp.Validate(req); err == nil {
+		t.Error("unrequested minimal response accepted")
+	}
+}
+
+func TestHandleOnEvent(t *testing.T) {
+	type hookEvent struct {
+		appID string
+		event *EventRequest
+	}
+	var hooked []hookEvent
+
+	recorder := &eventRecorder{}
+	handler := &OmahaHandler{
+		Updater: recorder,
+		OnEvent: func(appID string, event *EventRequest) {
+			if len(recorder.events) != 0 {
+				t.Error("OnEvent called after the Updater")
+			}
+			hooked = append(hooked, hookEvent{appID, event})
+		},
+	}
+
+	req := NewRequest()
+	app := req.AddApp(testAppID, testAppVer)
+	for _, typ := range []EventType{
+		EventTypeUpdateDownloadStarted,
+		EventTypeUpdateDownloadFinished,
+		EventTypeUpdateComplete,
+	} {
+		event := app.AddEvent()
+		event.Type = typ
+		event.Result = EventResultSuccess
+	}
+	other := req.AddApp("{other}", testAppVer)
+	other.AddEvent().Type = EventTypeInstallStarted
+
+	resp, err := postRequest(handler, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(hooked) != 4 {
+		t.Fatalf("expected 4 hooked events, not %d", len(hooked))
+	}
+	for i, e := range hooked[:3] {
+		if e.appID != testAppID || e.event.Type != app.Events[i].Type {
+			t.Errorf("unexpected hooked event %d: %s %#v", i, e.appID, e.event)
+		}
+	}
+	if hooked[3].appID != "{other}" || hooked[3].event.Type != EventTypeInstallStarted {
+		t.Errorf("unexpected hooked event 3: %s %#v", hooked[3].appID, hooked[3].event)
+	}
+	if len(recorder.events) != 4 {
+		t.Errorf("expected 4 recorded events, not %d", len(recorder.events))
+	}
+
+	appResp := resp.GetApp(testAppID)
+	if appResp == nil || appResp.Status != AppOK || len(appResp.Events) != 3 {
+		t.Errorf("unexpected ack: %#v", appResp)
+	}
+	for _, e := range appResp.Events {
+		if e.Status != "ok" {
+			t.Errorf("unexpected event status %q", e.Status)
+		}
+	}
+}
+
+func TestHandleClientIP(t *testing.T) {
+	for _, tt := range []struct {
+		remote     string
+		forwarded  string
+		trustProxy bool
+		expected   string
+	}{
+		{"203.0.113.7:1234", "", false, "203.0.113.7"},
+		{"[2001:db8::1]:1234", "", false, "2001:db8::1"},
+		{"10.0.0.2:1234", "198.51.100.1", false, "10.0.0.2"},
+		{"10.0.0.2:1234", "198.51.100.1", true, "198.51.100.1"},
+		// The client may prepend anything, only the first public
+		// address from the end can be trusted.
+		{"10.0.0.2:1234", "1.2.3.4, 198.51.100.1, 192.168.1.1", true, "198.51.100.1"},
+		{"10.0.0.2:1234", "192.168.1.1, 10.0.0.3", true, "192.168.1.1"},
+		{"10.0.0.2:1234", "198.51.100.1, bogus", true, "10.0.0.2"},
+		{"10.0.0.2:1234", "bogus, 198.51.100.1", true, "198.51.100.1"},
+	} {
+		o := &OmahaHandler{TrustProxy: tt.trustProxy}
+		meta := &RequestMeta{RemoteAddr: tt.remote, ForwardedFor: tt.forwarded}
+		if ip := o.clientIP(meta); ip.String() != tt.expected {
+			t.Errorf("%s %q: expected %s, not %s", tt.remote, tt.forwarded, tt.expected, ip)
+		}
+	}
+}
+
+// mirrorUpdater sends clients in 198.51.100.0/24 to a nearby mirror.
+type mirrorUpdater struct {
+	UpdaterStub
+	meta *RequestMeta
+}
+
+func (m *mirrorUpdater) CheckUpdateMeta(meta *RequestMeta, req *Request, app *AppRequest) (*Update, error) {
+	m.meta = meta
+	u := &Update{ID: app.ID, URL: URL{CodeBase: "https://mirror.example.com/1.1.0/"}}
+	_, local, _ := net.ParseCIDR("198.51.100.0/24")
+	if local.Contains(meta.ClientIP) {
+		u.URL.CodeBase = "https://local.example.com/1.1.0/"
+	}
+	u.Version = "1.1.0"
+	return u, nil
+}
+
+func TestHandleMetaUpdater(t *testing.T) {
+	m := &mirrorUpdater{}
+	s := httptest.NewTLSServer(&OmahaHandler{Updater: m, TrustProxy: true})
+	defer s.Close()
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+
+	for _, tt := range []struct {
+		forwarded string
+		codebase  string
+	}{
+		{"", "https://mirror.example.com/1.1.0/"},
+		{"198.51.100.1", "https://local.example.com/1.1.0/"},
+		{"198.51.100.1, 203.0.113.1", "https://mirror.example.com/1.1.0/"},
+	} {
+		body, err := xml.Marshal(NewUpdateCheckRequest(testAppID, testAppVer))
+		if err != nil {
+			t.Fatal(err)
+		}
+		httpReq, err := http.NewRequest("POST", s.URL+"/v1/update/", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		httpReq.Header.Set("User-Agent", "update_engine")
+		if tt.forwarded != "" {
+			httpReq.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		httpResp, err := client.Do(httpReq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := ParseResponse(httpResp.Header.Get("Content-Type"), httpResp.Body)
+		httpResp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		u := resp.Apps[0].UpdateCheck
+		if u.Status != UpdateOK || len(u.URLs) != 1 || u.URLs[0].CodeBase != tt.codebase {
+			t.Errorf("%q: unexpected update %+v", tt.forwarded, u)
+		}
+		if !m.meta.TLS || m.meta.UserAgent != "update_engine" || m.meta.Received.IsZero() ||
+			m.meta.ForwardedFor != tt.forwarded {
+			t.Errorf("%q: unexpected metadata %+v", tt.forwarded, m.meta)
+		}
+	}
+}
+
+func TestServeExchange(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeExchange(w, r, false, func(ctx context.Context, req *Request) *Response {
+			resp := NewResponse()
+			for _, app := range req.Apps {
+				resp.AddApp(app.ID, AppUnknownID)
+			}
+			return resp
+		})
+	})
+
+	body, err := xml.Marshal(nilRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed := &bytes.Buffer{}
+	gz := gzip.NewWriter(compressed)
+	gz.Write(body)
+	gz.Close()
+
+	req := httptest.NewRequest("POST", "/", compressed)
+	req.Header.Set("Content-Type", "text/xml")
+	req.Header.Set("Content-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("unexpected status %d", rec.Code)
+	}
+	resp, err := ParseResponse(rec.Header().Get("Content-Type"), rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Apps) != 1 || resp.Apps[0].Status != AppUnknownID {
+		t.Errorf("unexpected response %+v", resp.Apps)
+	}
+}
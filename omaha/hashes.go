@@ -0,0 +1,192 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+// Hashes holds the raw digests and size of a payload. Nil digests and
+// a zero size are considered absent and are not verified, since an
+// Action carries no size. Package.VerifyReader rejects required
+// packages without a size before getting here.
+type Hashes struct {
+	SHA1   []byte
+	SHA256 []byte
+	Size   uint64
+}
+
+// FromFile computes all hashes of the named file.
+func (h *Hashes) FromFile(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return h.FromReader(f)
+}
+
+// FromReader computes all hashes of r in a single pass.
+func (h *Hashes) FromReader(r io.Reader) error {
+	h1 := sha1.New()
+	h256 := sha256.New()
+	n, err := io.Copy(io.MultiWriter(h1, h256), r)
+	if err != nil {
+		return err
+	}
+
+	h.SHA1 = h1.Sum(nil)
+	h.SHA256 = h256.Sum(nil)
+	h.Size = uint64(n)
+	return nil
+}
+
+// Verify reads all of r, comparing it against whichever hashes are
+// present. At least one digest must be present.
+func (h *Hashes) Verify(r io.Reader) error {
+	var (
+		h1, h256 hash.Hash
+		writers  []io.Writer
+	)
+	if h.SHA1 != nil {
+		h1 = sha1.New()
+		writers = append(writers, h1)
+	}
+	if h.SHA256 != nil {
+		h256 = sha256.New()
+		writers = append(writers, h256)
+	}
+	if len(writers) == 0 {
+		return PackageHashMismatchError
+	}
+
+	n, err := io.Copy(io.MultiWriter(writers...), r)
+	if err != nil {
+		return err
+	}
+
+	if h.Size != 0 && h.Size != uint64(n) {
+		return PackageSizeMismatchError
+	}
+
+	if h1 != nil && subtle.ConstantTimeCompare(h.SHA1, h1.Sum(nil)) != 1 {
+		return PackageHashMismatchError
+	}
+
+	if h256 != nil && subtle.ConstantTimeCompare(h.SHA256, h256.Sum(nil)) != 1 {
+		return PackageHashMismatchError
+	}
+
+	return nil
+}
+
+// VerifyFile is Verify for the named file.
+func (h *Hashes) VerifyFile(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return h.Verify(f)
+}
+
+// SetHashes fills in the package's size and base64 encoded hashes.
+func (p *Package) SetHashes(h Hashes) {
+	p.SHA1 = encodeHash(h.SHA1)
+	p.SHA256 = encodeHash(h.SHA256)
+	p.Size = PackageSize(h.Size)
+}
+
+// Hashes decodes the package's size and hashes. Missing hashes are
+// left nil; hashes that are not valid base64 digests are an error.
+func (p *Package) Hashes() (Hashes, error) {
+	var (
+		h   = Hashes{Size: uint64(p.Size)}
+		err error
+	)
+	if h.SHA1, err = decodeHash(p.SHA1, sha1.Size); err != nil && err != PackageHashMissingError {
+		return h, err
+	}
+	if h.SHA256, err = decodeHash(p.SHA256, sha256.Size); err != nil && err != PackageHashMissingError {
+		return h, err
+	}
+	return h, nil
+}
+
+// SHA1Sum decodes the package's SHA-1 hash, ignoring any surrounding
+// whitespace. A missing hash is PackageHashMissingError.
+func (p *Package) SHA1Sum() ([]byte, error) {
+	return decodeHash(p.SHA1, sha1.Size)
+}
+
+// SHA256Sum decodes the package's SHA-256 hash, ignoring any
+// surrounding whitespace. A missing hash is PackageHashMissingError.
+func (p *Package) SHA256Sum() ([]byte, error) {
+	return decodeHash(p.SHA256, sha256.Size)
+}
+
+// SetSHA1Sum sets the package's base64 encoded SHA-1 hash.
+func (p *Package) SetSHA1Sum(sum []byte) {
+	p.SHA1 = encodeHash(sum)
+}
+
+// SetHashes fills in the action's base64 encoded SHA-256 hash.
+func (a *Action) SetHashes(h Hashes) {
+	a.SHA256 = encodeHash(h.SHA256)
+}
+
+// Verify checks r against the action's SHA-256 hash.
+func (a *Action) Verify(r io.Reader) error {
+	sum, err := decodeHash(a.SHA256, sha256.Size)
+	if err != nil {
+		return PackageHashMismatchError
+	}
+	h := Hashes{SHA256: sum}
+	return h.Verify(r)
+}
+
+func encodeHash(sum []byte) string {
+	if sum == nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(sum)
+}
+
+// decodeHash decodes a base64 digest of the given size.
+func decodeHash(s string, size int) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, PackageHashMissingError
+	}
+
+	sum, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("omaha: invalid hash %q: %v", s, err)
+	}
+	if len(sum) != size {
+		return nil, fmt.Errorf("omaha: invalid hash %q: %d bytes, expected %d", s, len(sum), size)
+	}
+	return sum, nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+const (
+	testPayload       = "testing\n"
+	testPayloadSHA1   = "mAFznarkTsUpPU4fU9P00tQm2Rw="
+	testPayloadSHA256 = "EqYfThc/s6EcBdZHH3Ryj3YjG0pfzZZnzvOvh6OuTcI="
+)
+
+func TestHashesSet(t *testing.T) {
+	var h Hashes
+	if err := h.FromReader(strings.NewReader(testPayload)); err != nil {
+		t.Fatal(err)
+	}
+
+	var p Package
+	p.SetHashes(h)
+	expect := Package{
+		SHA1:   testPayloadSHA1,
+		SHA256: testPayloadSHA256,
+		Size:   PackageSize(len(testPayload)),
+	}
+	if diff := pretty.Compare(expect, p); diff != "" {
+		t.Errorf("Package hashes differ: %v", diff)
+	}
+
+	var a Action
+	a.SetHashes(h)
+	if a.SHA256 != testPayloadSHA256 {
+		t.Errorf("Unexpected action hash %q", a.SHA256)
+	}
+
+	decoded, err := p.Hashes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := pretty.Compare(h, decoded); diff != "" {
+		t.Errorf("Decoded hashes differ: %v", diff)
+	}
+}
+
+func TestHashesVerify(t *testing.T) {
+	var h Hashes
+	if err := h.FromReader(strings.NewReader(testPayload)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		hashes Hashes
+		err    error
+	}{
+		{"all", h, nil},
+		{"sha1 only", Hashes{SHA1: h.SHA1}, nil},
+		{"sha256 only", Hashes{SHA256: h.SHA256}, nil},
+		{"none", Hashes{Size: h.Size}, PackageHashMismatchError},
+		// A zero size is absent, as for actions, and not checked.
+		{"no size", Hashes{SHA1: h.SHA1, SHA256: h.SHA256}, nil},
+		{"bad size", Hashes{SHA1: h.SHA1, Size: 1}, PackageSizeMismatchError},
+		{"bad sha1", Hashes{SHA1: h.SHA256, SHA256: h.SHA256}, PackageHashMismatchError},
+		{"bad sha256", Hashes{SHA1: h.SHA1, SHA256: h.SHA1}, PackageHashMismatchError},
+	} {
+		err := tt.hashes.Verify(strings.NewReader(testPayload))
+		if err != tt.err {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.err, err)
+		}
+	}
+}
+
+func TestActionVerify(t *testing.T) {
+	a := Action{SHA256: testPayloadSHA256}
+	if err := a.Verify(strings.NewReader(testPayload)); err != nil {
+		t.Error(err)
+	}
+	if err := a.Verify(strings.NewReader("bogus")); err != PackageHashMismatchError {
+		t.Errorf("expected %v, got %v", PackageHashMismatchError, err)
+	}
+
+	a.SHA256 = "not base64!"
+	if err := a.Verify(strings.NewReader(testPayload)); err != PackageHashMismatchError {
+		t.Errorf("expected %v, got %v", PackageHashMismatchError, err)
+	}
+}
+
+func TestPackageSHA1Sum(t *testing.T) {
+	var h Hashes
+	if err := h.FromReader(strings.NewReader(testPayload)); err != nil {
+		t.Fatal(err)
+	}
+
+	var p Package
+	if sum, err := p.SHA1Sum(); err != PackageHashMissingError || sum != nil {
+		t.Errorf("missing hash returned %x, %v", sum, err)
+	}
+	p.SHA1 = " \n"
+	if sum, err := p.SHA1Sum(); err != PackageHashMissingError || sum != nil {
+		t.Errorf("blank hash returned %x, %v", sum, err)
+	}
+	if sum, err := p.SHA256Sum(); err != PackageHashMissingError || sum != nil {
+		t.Errorf("missing SHA-256 hash returned %x, %v", sum, err)
+	}
+
+	// Hashes leaves missing digests out instead of failing.
+	p.SHA256 = testPayloadSHA256
+	if decoded, err := p.Hashes(); err != nil {
+		t.Error(err)
+	} else if decoded.SHA1 != nil || !bytes.Equal(decoded.SHA256, h.SHA256) {
+		t.Errorf("unexpected hashes %+v", decoded)
+	}
+
+	p.SetSHA1Sum(h.SHA1)
+	if p.SHA1 != testPayloadSHA1 {
+		t.Errorf("unexpected hash %q", p.SHA1)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		hash  string
+		valid bool
+	}{
+		{"valid", testPayloadSHA1, true},
+		{"padded", " \t" + testPayloadSHA1 + "\n", true},
+		{"sha256", testPayloadSHA256, false},
+		{"hex", "980173cdaae44ec5293d4e1f53d3f4d2d426d91c", false},
+		{"garbage", "not base64!", false},
+	} {
+		p.SHA1 = tt.hash
+		sum, err := p.SHA1Sum()
+		if !tt.valid {
+			if err == nil {
+				t.Errorf("%s: invalid hash accepted", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if !bytes.Equal(sum, h.SHA1) {
+			t.Errorf("%s: unexpected sum %x", tt.name, sum)
+		}
+	}
+
+	// A padded hash still verifies.
+	p.SHA1 = " " + testPayloadSHA1 + " "
+	p.Size = PackageSize(h.Size)
+	if err := p.VerifyReader(strings.NewReader(testPayload)); err != nil {
+		t.Errorf("padded hash failed verification: %v", err)
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// Omaha exchanges are a single small POST so clients that take
+	// long to send headers or a body are either broken or malicious.
+	DefaultReadHeaderTimeout = 10 * time.Second
+	DefaultReadTimeout       = 30 * time.Second
+	DefaultWriteTimeout      = 30 * time.Second
+	DefaultIdleTimeout       = 90 * time.Second
+	DefaultMaxHeaderBytes    = 16 * 1024
+
+	// DefaultMaxBodyBytes matches the limit OmahaHandler applies itself.
+	DefaultMaxBodyBytes = 1024 * 1024
+)
+
+// HTTPServerOptions overrides the defaults used by NewHTTPServer.
+// Zero values select the defaults.
+type HTTPServerOptions struct {
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+
+	// TLSConfig replaces the default TLS configuration which requires
+	// TLS 1.2 or later.
+	TLSConfig *tls.Config
+}
+
+// DefaultTLSConfig returns the baseline TLS configuration used by
+// NewHTTPServer. A new value is returned on each call so it may be
+// modified freely.
+func DefaultTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+}
+
+// NewHTTPServer returns an http.Server serving handler with timeouts and
+// limits suitable for Omaha traffic. opts may be nil.
+//
+// The server should be started with a listener wrapped by LimitListener
+// to also bound the number of concurrent connections. To serve Omaha
+// from an existing http.ServeMux instead, wrap the handler with
+// LimitBody when registering it and configure the enclosing server's
+// timeouts using the Default constants above.
+func NewHTTPServer(handler http.Handler, opts *HTTPServerOptions) *http.Server {
+	if opts == nil {
+		opts = &HTTPServerOptions{}
+	}
+
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: DefaultReadHeaderTimeout,
+		ReadTimeout:       DefaultReadTimeout,
+		WriteTimeout:      DefaultWriteTimeout,
+		IdleTimeout:       DefaultIdleTimeout,
+		MaxHeaderBytes:    DefaultMaxHeaderBytes,
+		TLSConfig:         opts.TLSConfig,
+	}
+
+	if opts.ReadHeaderTimeout != 0 {
+		srv.ReadHeaderTimeout = opts.ReadHeaderTimeout
+	}
+	if opts.ReadTimeout != 0 {
+		srv.ReadTimeout = opts.ReadTimeout
+	}
+	if opts.WriteTimeout != 0 {
+		srv.WriteTimeout = opts.WriteTimeout
+	}
+	if opts.IdleTimeout != 0 {
+		srv.IdleTimeout = opts.IdleTimeout
+	}
+	if opts.MaxHeaderBytes != 0 {
+		srv.MaxHeaderBytes = opts.MaxHeaderBytes
+	}
+	if srv.TLSConfig == nil {
+		srv.TLSConfig = DefaultTLSConfig()
+	}
+
+	return srv
+}
+
+// LimitBody wraps handler, rejecting request bodies larger than n bytes.
+// If n is zero DefaultMaxBodyBytes is used.
+func LimitBody(handler http.Handler, n int64) http.Handler {
+	if n == 0 {
+		n = DefaultMaxBodyBytes
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, n)
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// LimitListener returns a listener that accepts at most n simultaneous
+// connections from l. Further connections wait in the kernel's backlog
+// until an existing connection is closed.
+func LimitListener(l net.Listener, n int) net.Listener {
+	return &limitListener{
+		Listener: l,
+		sem:      make(chan struct{}, n),
+		done:     make(chan struct{}),
+	}
+}
+
+// errListenerClosed has the text isClosed looks for.
+var errListenerClosed = errors.New("use of closed network connection")
+
+type limitListener struct {
+	net.Listener
+	sem       chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	// Waiting for a free slot must not outlive the listener,
+	// otherwise Serve never returns once closed at the limit.
+	select {
+	case l.sem <- struct{}{}:
+	case <-l.done:
+		return nil, &net.OpError{Op: "accept", Net: l.Addr().Network(), Addr: l.Addr(), Err: errListenerClosed}
+	}
+	c, err := l.Listener.Accept()
+	if err != nil {
+		<-l.sem
+		return nil, err
+	}
+	return &limitConn{Conn: c, release: func() { <-l.sem }}, nil
+}
+
+func (l *limitListener) Close() error {
+	err := l.Listener.Close()
+	l.closeOnce.Do(func() { close(l.done) })
+	return err
+}
+
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
@@ -0,0 +1,180 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewHTTPServerDefaults(t *testing.T) {
+	srv := NewHTTPServer(http.NotFoundHandler(), nil)
+
+	if srv.ReadHeaderTimeout != DefaultReadHeaderTimeout {
+		t.Errorf("ReadHeaderTimeout is %v", srv.ReadHeaderTimeout)
+	}
+	if srv.ReadTimeout != DefaultReadTimeout {
+		t.Errorf("ReadTimeout is %v", srv.ReadTimeout)
+	}
+	if srv.WriteTimeout != DefaultWriteTimeout {
+		t.Errorf("WriteTimeout is %v", srv.WriteTimeout)
+	}
+	if srv.IdleTimeout != DefaultIdleTimeout {
+		t.Errorf("IdleTimeout is %v", srv.IdleTimeout)
+	}
+	if srv.MaxHeaderBytes != DefaultMaxHeaderBytes {
+		t.Errorf("MaxHeaderBytes is %d", srv.MaxHeaderBytes)
+	}
+	if srv.TLSConfig == nil || srv.TLSConfig.MinVersion != tls.VersionTLS12 {
+		t.Errorf("TLSConfig is %#v", srv.TLSConfig)
+	}
+}
+
+func TestNewHTTPServerOptions(t *testing.T) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS11}
+	srv := NewHTTPServer(http.NotFoundHandler(), &HTTPServerOptions{
+		ReadHeaderTimeout: time.Second,
+		MaxHeaderBytes:    1024,
+		TLSConfig:         tlsConfig,
+	})
+
+	if srv.ReadHeaderTimeout != time.Second {
+		t.Errorf("ReadHeaderTimeout is %v", srv.ReadHeaderTimeout)
+	}
+	if srv.MaxHeaderBytes != 1024 {
+		t.Errorf("MaxHeaderBytes is %d", srv.MaxHeaderBytes)
+	}
+	if srv.TLSConfig != tlsConfig {
+		t.Errorf("TLSConfig was not used")
+	}
+	// Unset options keep their defaults.
+	if srv.ReadTimeout != DefaultReadTimeout {
+		t.Errorf("ReadTimeout is %v", srv.ReadTimeout)
+	}
+}
+
+func TestLimitBody(t *testing.T) {
+	handler := LimitBody(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := ioutil.ReadAll(r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		}
+	}), 10)
+
+	for _, tt := range []struct {
+		body   string
+		status int
+	}{
+		{"small", http.StatusOK},
+		{"much too large", http.StatusRequestEntityTooLarge},
+	} {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(tt.body))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%q: expected HTTP status %d, not %d",
+				tt.body, tt.status, rec.Code)
+		}
+	}
+}
+
+func TestLimitListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l = LimitListener(l, 1)
+	defer l.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+	}
+
+	first := <-accepted
+	select {
+	case <-accepted:
+		t.Fatal("second connection accepted while at the limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	first.Close()
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(10 * time.Second):
+		t.Fatal("second connection not accepted after the first closed")
+	}
+}
+
+func TestLimitListenerClose(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l = LimitListener(l, 1)
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	first, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+
+	// At the limit, the next Accept waits for a slot.
+	errc := make(chan error, 1)
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			c.Close()
+		}
+		errc <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	l.Close()
+	select {
+	case err := <-errc:
+		if !isClosed(err) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Accept blocked after Close")
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// JournalRecord is a single exchange recorded by a Journal.
+type JournalRecord struct {
+	Time       time.Time `json:"time"`
+	RemoteAddr string    `json:"remote_addr"`
+	Host       string    `json:"host"`
+	AppIDs     []string  `json:"app_ids"`
+	Request    string    `json:"request"`
+	Response   string    `json:"response"`
+}
+
+func newJournalRecord(meta *RequestMeta, omahaReq *Request, reqBody, respBody []byte) *JournalRecord {
+	rec := &JournalRecord{
+		Time:       time.Now().UTC(),
+		RemoteAddr: meta.RemoteAddr,
+		Host:       meta.Host,
+		Request:    string(reqBody),
+		Response:   string(respBody),
+	}
+	for _, app := range omahaReq.Apps {
+		rec.AppIDs = append(rec.AppIDs, app.ID)
+	}
+	return rec
+}
+
+// Journal appends exchanges to a file as newline delimited JSON.
+// Records are written in the background; if the queue is full because
+// the disk is slow new records are dropped rather than delaying
+// responses.
+type Journal struct {
+	path    string
+	maxSize int64
+
+	file *os.File
+	size int64
+
+	mu      sync.Mutex
+	closed  bool
+	queue   chan *JournalRecord
+	done    chan struct{}
+	dropped uint64
+}
+
+// NewJournal opens the journal at path, appending to any existing file.
+// Once the file exceeds maxSize bytes it is renamed to path.1, replacing
+// any previous one, and a new file is started. A maxSize of zero
+// disables rotation. At most queueLen records wait to be written.
+func NewJournal(path string, maxSize int64, queueLen int) (*Journal, error) {
+	j := &Journal{
+		path:    path,
+		maxSize: maxSize,
+		queue:   make(chan *JournalRecord, queueLen),
+		done:    make(chan struct{}),
+	}
+	if err := j.open(); err != nil {
+		return nil, err
+	}
+
+	go j.run()
+	return j, nil
+}
+
+func (j *Journal) open() error {
+	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	j.file = f
+	j.size = st.Size()
+	return nil
+}
+
+// Record queues rec to be written, dropping it if the queue is full
+// or the journal is closed.
+func (j *Journal) Record(rec *JournalRecord) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.closed {
+		atomic.AddUint64(&j.dropped, 1)
+		return
+	}
+	select {
+	case j.queue <- rec:
+	default:
+		atomic.AddUint64(&j.dropped, 1)
+	}
+}
+
+// Dropped returns the number of records that were not written.
+func (j *Journal) Dropped() uint64 {
+	return atomic.LoadUint64(&j.dropped)
+}
+
+// Close writes any queued records and closes the file.
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	if !j.closed {
+		j.closed = true
+		close(j.queue)
+	}
+	j.mu.Unlock()
+
+	<-j.done
+	return j.file.Close()
+}
+
+func (j *Journal) run() {
+	defer close(j.done)
+	for rec := range j.queue {
+		if err := j.write(rec); err != nil {
+			log.Printf("omaha: Failed writing journal: %v", err)
+			atomic.AddUint64(&j.dropped, 1)
+		}
+	}
+}
+
+func (j *Journal) write(rec *JournalRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if j.maxSize > 0 && j.size > 0 && j.size+int64(len(line)) > j.maxSize {
+		if err := j.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := j.file.Write(line)
+	j.size += int64(n)
+	return err
+}
+
+func (j *Journal) rotate() error {
+	if err := j.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(j.path, j.path+".1"); err != nil {
+		return err
+	}
+	return j.open()
+}
+
+// ReplayMismatch describes a replayed request that got a different
+// response than the one recorded in the journal.
+type ReplayMismatch struct {
+	Record *JournalRecord
+
+	// Canonical forms of the recorded and new responses.
+	Expected string
+	Got      string
+}
+
+// Replay passes each request in a journal to updater, as OmahaHandler
+// would, and reports the requests whose responses differ from the
+// recorded ones. Events and pings are passed to updater too.
+func Replay(r io.Reader, updater Updater) ([]*ReplayMismatch, error) {
+	var (
+		mismatches []*ReplayMismatch
+		handler    = &OmahaHandler{Updater: updater}
+		decoder    = json.NewDecoder(r)
+	)
+	for n := 1; ; n++ {
+		rec := &JournalRecord{}
+		if err := decoder.Decode(rec); err == io.EOF {
+			return mismatches, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("omaha: journal record %d: %v", n, err)
+		}
+
+		omahaReq, _, err := ParseRequestLenient("", strings.NewReader(rec.Request))
+		if err != nil {
+			return nil, fmt.Errorf("omaha: journal record %d: %v", n, err)
+		}
+
+		expected, err := ParseResponse("", strings.NewReader(rec.Response))
+		if err != nil {
+			return nil, fmt.Errorf("omaha: journal record %d: %v", n, err)
+		}
+
+		meta := &RequestMeta{
+			RemoteAddr: rec.RemoteAddr,
+			Host:       rec.Host,
+		}
+		got, _, _ := handler.serveRequest(meta, omahaReq)
+		if EqualResponse(expected, got) {
+			continue
+		}
+
+		m := &ReplayMismatch{Record: rec}
+		if b, err := expected.MarshalCanonical(false); err == nil {
+			m.Expected = string(b)
+		}
+		if b, err := got.MarshalCanonical(false); err == nil {
+			m.Got = string(b)
+		}
+		mismatches = append(mismatches, m)
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestJournal(t *testing.T, maxSize int64) (*Journal, string, func()) {
+	dir, err := ioutil.TempDir("", "go-omaha-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "journal")
+
+	j, err := NewJournal(path, maxSize, 16)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return j, path, func() { os.RemoveAll(dir) }
+}
+
+func readJournal(t *testing.T, path string) []*JournalRecord {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var records []*JournalRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, maxRequestSize*4)
+	for scanner.Scan() {
+		rec := &JournalRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), rec); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func journalRequests(t *testing.T, handler *OmahaHandler) {
+	for _, req := range []*Request{
+		NewUpdateCheckRequest(testAppID, testAppVer),
+		NewPingRequest("{other}", testAppVer),
+	} {
+		if _, err := postRequest(handler, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestJournal(t *testing.T) {
+	j, path, cleanup := newTestJournal(t, 0)
+	defer cleanup()
+
+	handler := &OmahaHandler{Updater: UpdaterStub{}, Journal: j}
+	journalRequests(t, handler)
+	if err := j.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	records := readJournal(t, path)
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, not %d", len(records))
+	}
+	for i, appID := range []string{testAppID, "{other}"} {
+		rec := records[i]
+		if !reflect.DeepEqual(rec.AppIDs, []string{appID}) {
+			t.Errorf("record %d: unexpected app ids %q", i, rec.AppIDs)
+		}
+		if rec.Time.IsZero() || rec.RemoteAddr == "" || rec.Host == "" {
+			t.Errorf("record %d: missing metadata: %#v", i, rec)
+		}
+		if _, err := ParseRequest("", strings.NewReader(rec.Request)); err != nil {
+			t.Errorf("record %d: bad request: %v", i, err)
+		}
+		if _, err := ParseResponse("", strings.NewReader(rec.Response)); err != nil {
+			t.Errorf("record %d: bad response: %v", i, err)
+		}
+	}
+
+	// Records after closing are dropped.
+	j.Record(records[0])
+	if j.Dropped() != 1 {
+		t.Errorf("expected 1 dropped record, not %d", j.Dropped())
+	}
+}
+
+func TestJournalRotate(t *testing.T) {
+	j, path, cleanup := newTestJournal(t, 1)
+	defer cleanup()
+
+	handler := &OmahaHandler{Updater: UpdaterStub{}, Journal: j}
+	journalRequests(t, handler)
+	if err := j.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each record exceeds the limit so each is in its own file.
+	old := readJournal(t, path+".1")
+	cur := readJournal(t, path)
+	if len(old) != 1 || len(cur) != 1 {
+		t.Fatalf("expected 1 record in each file, not %d and %d", len(old), len(cur))
+	}
+	if old[0].AppIDs[0] != testAppID || cur[0].AppIDs[0] != "{other}" {
+		t.Errorf("records rotated out of order")
+	}
+}
+
+func TestJournalQueueFull(t *testing.T) {
+	// No writer is running so the queue never drains.
+	j := &Journal{queue: make(chan *JournalRecord, 1)}
+	j.Record(&JournalRecord{})
+	j.Record(&JournalRecord{})
+	if j.Dropped() != 1 {
+		t.Errorf("expected 1 dropped record, not %d", j.Dropped())
+	}
+}
+
+// updateAll offers the same update to every app.
+type updateAll struct {
+	UpdaterStub
+	update *Update
+}
+
+func (u *updateAll) CheckUpdate(req *Request, app *AppRequest) (*Update, error) {
+	return u.update, nil
+}
+
+func TestReplay(t *testing.T) {
+	j, path, cleanup := newTestJournal(t, 0)
+	defer cleanup()
+
+	handler := &OmahaHandler{Updater: UpdaterStub{}, Journal: j}
+	journalRequests(t, handler)
+	if err := j.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	mismatches, err := Replay(f, UpdaterStub{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 0 {
+		t.Errorf("unexpected mismatches: %#v", mismatches)
+	}
+
+	// Only the update check is affected by a new policy.
+	if _, err := f.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	update := &Update{URL: URL{CodeBase: "/packages/"}}
+	update.Manifest.Version = "2.0.0"
+	mismatches, err = Replay(f, &updateAll{update: update})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 1 {
+		t.Fatalf("expected 1 mismatch, not %d", len(mismatches))
+	}
+	m := mismatches[0]
+	if m.Record.AppIDs[0] != testAppID || m.Expected == m.Got {
+		t.Errorf("unexpected mismatch: %#v", m)
+	}
+}
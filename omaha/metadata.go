@@ -0,0 +1,65 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var (
+	MetadataSignatureInvalidError  = errors.New("metadata signature is not valid base64")
+	MetadataSignatureMismatchError = errors.New("metadata signature does not match")
+	MetadataSizeMismatchError      = errors.New("metadata size is invalid")
+)
+
+// MetadataSizeBytes parses the MetadataSize attribute, the length of
+// the payload's leading metadata, returning false if it is missing or
+// invalid.
+func (a *Action) MetadataSizeBytes() (int64, bool) {
+	size, err := strconv.ParseInt(a.MetadataSize, 10, 64)
+	if err != nil || size <= 0 {
+		return 0, false
+	}
+	return size, true
+}
+
+// VerifyMetadata checks the payload metadata against MetadataSize, if
+// set, and the RSA PKCS #1 v1.5 signature of its SHA-256 digest in
+// MetadataSignatureRsa.
+func (a *Action) VerifyMetadata(metadata []byte, pub *rsa.PublicKey) error {
+	if a.MetadataSize != "" {
+		size, ok := a.MetadataSizeBytes()
+		if !ok || size != int64(len(metadata)) {
+			return MetadataSizeMismatchError
+		}
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(a.MetadataSignatureRsa))
+	if err != nil || len(sig) == 0 {
+		return MetadataSignatureInvalidError
+	}
+
+	sum := sha256.Sum256(metadata)
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig); err != nil {
+		return MetadataSignatureMismatchError
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"testing"
+)
+
+func TestMetadataSizeBytes(t *testing.T) {
+	for _, tt := range []struct {
+		size  string
+		bytes int64
+		ok    bool
+	}{
+		{"", 0, false},
+		{"0", 0, false},
+		{"-1", 0, false},
+		{"abc", 0, false},
+		{"190", 190, true},
+		{"8589934592", 8589934592, true},
+	} {
+		a := &Action{MetadataSize: tt.size}
+		if n, ok := a.MetadataSizeBytes(); n != tt.bytes || ok != tt.ok {
+			t.Errorf("%q: expected %d, %v not %d, %v", tt.size, tt.bytes, tt.ok, n, ok)
+		}
+	}
+}
+
+func TestVerifyMetadata(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadata := []byte("CrAU\x00\x00\x00\x00\x00\x00\x00\x01payload manifest")
+	sum := sha256.Sum256(metadata)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &Action{
+		Event:                ActionEventPostInstall,
+		MetadataSize:         strconv.Itoa(len(metadata)),
+		MetadataSignatureRsa: base64.StdEncoding.EncodeToString(sig),
+	}
+
+	if err := a.VerifyMetadata(metadata, &key.PublicKey); err != nil {
+		t.Errorf("valid metadata rejected: %v", err)
+	}
+
+	tampered := append([]byte{}, metadata...)
+	tampered[len(tampered)-1] ^= 1
+	if err := a.VerifyMetadata(tampered, &key.PublicKey); err != MetadataSignatureMismatchError {
+		t.Errorf("tampered metadata: unexpected error %v", err)
+	}
+	if err := a.VerifyMetadata(metadata, &other.PublicKey); err != MetadataSignatureMismatchError {
+		t.Errorf("wrong key: unexpected error %v", err)
+	}
+	if err := a.VerifyMetadata(metadata[:10], &key.PublicKey); err != MetadataSizeMismatchError {
+		t.Errorf("truncated metadata: unexpected error %v", err)
+	}
+
+	bad := *a
+	bad.MetadataSignatureRsa = "not base64!"
+	if err := bad.VerifyMetadata(metadata, &key.PublicKey); err != MetadataSignatureInvalidError {
+		t.Errorf("invalid signature: unexpected error %v", err)
+	}
+}
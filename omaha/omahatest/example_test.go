@@ -0,0 +1,77 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omahatest_test
+
+import (
+	"fmt"
+
+	"github.com/coreos/go-omaha/omaha"
+	"github.com/coreos/go-omaha/omaha/client"
+	"github.com/coreos/go-omaha/omaha/omahatest"
+)
+
+// releaseUpdater offers a single release to every app.
+type releaseUpdater struct {
+	omaha.UpdaterStub
+	update *omaha.Update
+}
+
+func (u *releaseUpdater) CheckUpdate(req *omaha.Request, app *omaha.AppRequest) (*omaha.Update, error) {
+	return u.update, nil
+}
+
+func ExampleNewTestServer() {
+	s, h := omahatest.NewTestServer()
+	defer s.Close()
+
+	c, err := client.NewAppClient(s.URL, "client-id", "app-id", "1.0.0")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	// The default handler has no updates to offer.
+	if _, err := c.UpdateCheck(); err != nil {
+		fmt.Println(err)
+	}
+
+	// Offer a release with a single package.
+	update := &omaha.Update{
+		ID:  "app-id",
+		URL: omaha.URL{CodeBase: "/packages/"},
+	}
+	update.Version = "1.1.0"
+	pkg := update.AddPackage()
+	pkg.Name = "update.gz"
+	pkg.SHA1 = "+LXvjiaPkeYDLHoNKlf9qbJwvnk="
+	pkg.Size = 1024
+	pkg.Required = true
+	h.Updater = &releaseUpdater{update: update}
+
+	u, err := c.UpdateCheck()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Printf("update %s, version %s\n", string(u.Status), u.Manifest.Version)
+	for _, p := range u.Manifest.Packages {
+		fmt.Println(p.Name, p.Size, p.Required)
+	}
+
+	// Output:
+	// omaha: update status noupdate
+	// update ok, version 1.1.0
+	// update.gz 1024 true
+}
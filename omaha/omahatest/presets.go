@@ -0,0 +1,196 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package omahatest provides utilities for testing Omaha clients and
+// servers, such as a local test server and requests shaped like those
+// sent by real clients.
+package omahatest
+
+import (
+	"strings"
+
+	"github.com/coreos/go-omaha/omaha"
+)
+
+// UpdateEngine describes a CoreOS update_engine 0.4.x client. Blank
+// OS fields default to the values update_engine reports.
+type UpdateEngine struct {
+	AppID     string
+	Version   string
+	Track     string
+	FromTrack string
+	BootID    string
+	MachineID string
+	OEM       string
+	Board     string
+
+	// HardwareClass is the machine's hardware ID, blank on CoreOS.
+	HardwareClass string
+
+	// DeltaOK reports that the client can apply delta payloads.
+	DeltaOK bool
+
+	OSVersion  string
+	OSPlatform string
+	Arch       string
+
+	// Interactive checks are triggered by update_engine_client
+	// rather than the periodic scheduler.
+	Interactive bool
+}
+
+const (
+	updateEngineVersion    = "ChromeOSUpdateEngine-0.1.0.0"
+	updateEngineOSVersion  = "Indy"
+	updateEngineOSPlatform = "Chrome OS"
+	updateEngineArch       = "x86_64"
+	updateEngineLang       = "en-US"
+)
+
+func (u *UpdateEngine) newRequest() (*omaha.Request, *omaha.AppRequest) {
+	r := omaha.NewRequest()
+	r.Version = updateEngineVersion
+	r.UpdaterVersion = updateEngineVersion
+	r.SessionID, r.RequestID = "", ""
+	r.IsMachine = 1
+	r.SetInstallSource(installSource(u.Interactive))
+
+	// The service pack is abused to report the version and arch.
+	r.OS = &omaha.OS{
+		Version:     orDefault(u.OSVersion, updateEngineOSVersion),
+		Platform:    orDefault(u.OSPlatform, updateEngineOSPlatform),
+		ServicePack: u.Version + "_" + orDefault(u.Arch, updateEngineArch),
+	}
+
+	app := r.AddApp(u.AppID, u.Version)
+	app.BootID = u.BootID
+	app.MachineID = u.MachineID
+	app.OEM = u.OEM
+	app.Track = u.Track
+	app.FromTrack = u.FromTrack
+	app.Lang = updateEngineLang
+	app.Board = u.Board
+	app.HardwareClass = u.HardwareClass
+	app.DeltaOK = u.DeltaOK
+	return r, app
+}
+
+// NewUpdateEngineRequest returns an update check. update_engine always
+// pings along with checking; -1 days since the last ping is how it
+// reports never having pinged, adjust the ping for other cases.
+func NewUpdateEngineRequest(u *UpdateEngine) *omaha.Request {
+	r, app := u.newRequest()
+	days := -1
+	ping := app.AddPing()
+	ping.LastActiveReportDays = &days
+	ping.LastReportDays = days
+	app.AddUpdateCheck()
+	return r
+}
+
+// NewUpdateEngineEventRequest returns a request reporting a single
+// event. update_engine reports the result of each step on its own,
+// with only the app's version, tracks, language and board attributes.
+func NewUpdateEngineEventRequest(u *UpdateEngine, event *omaha.EventRequest) *omaha.Request {
+	r, app := u.newRequest()
+	app.BootID = ""
+	app.MachineID = ""
+	app.OEM = ""
+	app.Events = append(app.Events, event)
+	return r
+}
+
+// GoogleUpdate describes a Google Update client, the updater used by
+// Chrome and other Google applications on Windows. Blank identifiers
+// are generated in the same GUID format the client uses.
+type GoogleUpdate struct {
+	// Version of Google Update itself, e.g. "1.3.23.0".
+	Version    string
+	SessionID  string
+	UserID     string
+	RequestID  string
+	TestSource string
+	IsMachine  bool
+
+	// Windows version, e.g. "6.1" for Windows 7, and architecture.
+	OSVersion string
+	Arch      string
+
+	Interactive bool
+}
+
+// GoogleUpdateApp is an application managed by Google Update.
+type GoogleUpdateApp struct {
+	AppID   string
+	Version string
+	Lang    string
+	Brand   string
+	Client  string
+
+	// InstallAge is the number of days since the app was installed.
+	InstallAge string
+
+	// LastReportDays is the number of days since the last ping.
+	LastReportDays int
+}
+
+// NewGoogleUpdateRequest returns an update check for apps. Google
+// Update checks all of its apps at once, reporting a ping for each.
+func NewGoogleUpdateRequest(g *GoogleUpdate, apps ...GoogleUpdateApp) *omaha.Request {
+	r := omaha.NewRequest()
+	r.Version = g.Version
+	r.UpdaterVersion = ""
+	r.SessionID = orDefault(g.SessionID, newGUID())
+	r.UserID = orDefault(g.UserID, newGUID())
+	r.RequestID = orDefault(g.RequestID, newGUID())
+	r.TestSource = g.TestSource
+	if g.IsMachine {
+		r.IsMachine = 1
+	}
+	r.SetInstallSource(installSource(g.Interactive))
+	r.OS = &omaha.OS{
+		Platform: "win",
+		Version:  g.OSVersion,
+		Arch:     g.Arch,
+	}
+
+	for _, a := range apps {
+		app := r.AddApp(a.AppID, a.Version)
+		app.Lang = a.Lang
+		app.Brand = a.Brand
+		app.Client = a.Client
+		app.InstallAge = a.InstallAge
+		app.AddUpdateCheck()
+		app.Ping = &omaha.PingRequest{LastReportDays: a.LastReportDays}
+	}
+	return r
+}
+
+func installSource(interactive bool) string {
+	if interactive {
+		return omaha.InstallSourceOnDemand
+	}
+	return omaha.InstallSourceScheduled
+}
+
+func newGUID() string {
+	return strings.ToUpper(omaha.NewRequestID())
+}
+
+func orDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
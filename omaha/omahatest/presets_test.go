@@ -0,0 +1,137 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omahatest
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+
+	"github.com/coreos/go-omaha/omaha"
+)
+
+// updateEngine matches the client in the update_engine captures.
+var updateEngine = &UpdateEngine{
+	AppID:       "{87efface-864d-49a5-9bb3-4b050a7c227a}",
+	Version:     "ForcedUpdate",
+	Track:       "dev-channel",
+	FromTrack:   "developer-build",
+	BootID:      "{7D52A1CC-7066-40F0-91C7-7CB6A871BFDE}",
+	MachineID:   "{8BDE4C4D-9083-4D61-B41C-3253212C0C37}",
+	OEM:         "ec3000",
+	Board:       "amd64-generic",
+	Interactive: true,
+}
+
+// expectCapture compares r to a request captured from a real client in
+// the top level fixtures directory.
+func expectCapture(t *testing.T, r *omaha.Request, capture string) {
+	f, err := os.Open(filepath.Join("..", "..", "fixtures", capture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	expected, err := omaha.ParseRequest("", f)
+	if err != nil {
+		t.Fatalf("%s: %v", capture, err)
+	}
+	// Only set when parsing.
+	expected.XMLName = xml.Name{}
+	if diff := pretty.Compare(expected, r); diff != "" {
+		t.Errorf("%s differs: %s", capture, diff)
+	}
+}
+
+func TestUpdateEngineRequest(t *testing.T) {
+	// The capture is of the first check after an update was applied.
+	r := NewUpdateEngineRequest(updateEngine)
+	r.Apps[0].Events = []*omaha.EventRequest{{
+		Type:   omaha.EventTypeUpdateComplete,
+		Result: omaha.EventResultSuccessReboot,
+	}}
+	expectCapture(t, r, "update-engine/update/request.xml")
+}
+
+func TestUpdateEngineHardware(t *testing.T) {
+	u := *updateEngine
+	u.HardwareClass = "SAMUS E25-G7R-W35"
+	u.DeltaOK = true
+	raw, err := xml.Marshal(NewUpdateEngineRequest(&u))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(raw), `board="amd64-generic" hardware_class="SAMUS E25-G7R-W35" delta_okay="true"`) {
+		t.Errorf("hardware attributes missing: %s", raw)
+	}
+}
+
+func TestUpdateEngineEventRequest(t *testing.T) {
+	u := *updateEngine
+	u.Track = ""
+	r := NewUpdateEngineEventRequest(&u, &omaha.EventRequest{
+		Type:   omaha.EventTypeUpdateComplete,
+		Result: omaha.EventResultSuccess,
+	})
+	expectCapture(t, r, "update-engine/no-update/request.xml")
+}
+
+func TestGoogleUpdateRequest(t *testing.T) {
+	g := &GoogleUpdate{
+		Version:    "1.3.23.0",
+		SessionID:  "{5FAD27D4-6BFA-4daa-A1B3-5A1F821FEE0F}",
+		UserID:     "{D0BBD725-742D-44ae-8D46-0231E881D58E}",
+		RequestID:  "{C8F6EDF3-B623-4ee6-B2DA-1D08A0B4C665}",
+		TestSource: "ossdev",
+		OSVersion:  "6.1",
+		Arch:       "x64",
+	}
+	r := NewGoogleUpdateRequest(g,
+		GoogleUpdateApp{
+			AppID:          "{430FD4D0-B729-4F61-AA34-91526481799D}",
+			Version:        "1.3.23.0",
+			Lang:           "en",
+			Brand:          "GGLS",
+			Client:         "someclientid",
+			InstallAge:     "39",
+			LastReportDays: 1,
+		},
+		GoogleUpdateApp{
+			AppID:          "{D0AB2EBC-931B-4013-9FEB-C9C4C2225C8C}",
+			Version:        "2.2.2.0",
+			Lang:           "en",
+			Brand:          "GGLS",
+			InstallAge:     "6",
+			LastReportDays: 1,
+		})
+	expectCapture(t, r, "request.xml")
+}
+
+func TestGoogleUpdateGUIDs(t *testing.T) {
+	guid := regexp.MustCompile(`^\{[0-9A-F]{8}-[0-9A-F]{4}-[0-9A-F]{4}-[0-9A-F]{4}-[0-9A-F]{12}\}$`)
+	r := NewGoogleUpdateRequest(&GoogleUpdate{Version: "1.3.23.0"})
+	for _, id := range []string{r.SessionID, r.UserID, r.RequestID} {
+		if !guid.MatchString(id) {
+			t.Errorf("invalid GUID %q", id)
+		}
+	}
+	if r.SessionID == r.RequestID {
+		t.Errorf("identifiers are not unique")
+	}
+}
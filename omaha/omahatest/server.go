@@ -0,0 +1,30 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omahatest
+
+import (
+	"net/http/httptest"
+
+	"github.com/coreos/go-omaha/omaha"
+)
+
+// NewTestServer starts a local Omaha server for tests, answering on any
+// path with the returned handler. The handler's Updater answers every
+// update check with noupdate; replace it or set other handler fields
+// before sending requests. Call Close on the server when done.
+func NewTestServer() (*httptest.Server, *omaha.OmahaHandler) {
+	h := &omaha.OmahaHandler{Updater: omaha.UpdaterStub{}}
+	return httptest.NewServer(h), h
+}
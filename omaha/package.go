@@ -15,27 +15,66 @@
 package omaha
 
 import (
-	"crypto/sha1"
-	"crypto/sha256"
-	"encoding/base64"
+	"encoding/xml"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 )
 
 var (
 	PackageHashMismatchError = errors.New("package hash is invalid")
 	PackageSizeMismatchError = errors.New("package size is invalid")
+	PackageSizeMissingError  = errors.New("package size is missing")
+	PackageHashMissingError  = errors.New("package hash is missing")
 )
 
 // Package represents a single downloadable file.
 type Package struct {
-	Name     string `xml:"name,attr"`
-	SHA1     string `xml:"hash,attr"`
-	SHA256   string `xml:"hash_sha256,attr,omitempty"`
-	Size     uint64 `xml:"size,attr"`
-	Required bool   `xml:"required,attr"`
+	Name     string      `xml:"name,attr"`
+	SHA1     string      `xml:"hash,attr"`
+	SHA256   string      `xml:"hash_sha256,attr,omitempty"` // protocol 3.1
+	Size     PackageSize `xml:"size,attr"`
+	Required bool        `xml:"required,attr"`
+}
+
+// PackageSize is the size of a package in bytes.
+type PackageSize uint64
+
+// UnmarshalXMLAttr rejects sizes that are negative, non-numeric, or
+// too large with a clearer error than encoding/xml's default.
+func (s *PackageSize) UnmarshalXMLAttr(attr xml.Attr) error {
+	n, err := strconv.ParseUint(attr.Value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid size %q: must be a non-negative integer less than 2^64", attr.Value)
+	}
+	*s = PackageSize(n)
+	return nil
+}
+
+// UnmarshalXML includes the package's name in decoding errors.
+func (p *Package) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type pkg Package // prevent recursion
+	if err := d.DecodeElement((*pkg)(p), &start); err != nil {
+		for _, attr := range start.Attr {
+			if attr.Name.Local == "name" {
+				return fmt.Errorf("omaha: package %q: %v", attr.Value, err)
+			}
+		}
+		return fmt.Errorf("omaha: package: %v", err)
+	}
+	return nil
+}
+
+// ValidateSize rejects packages larger than maxAllowed bytes.
+func (p *Package) ValidateSize(maxAllowed uint64) error {
+	if uint64(p.Size) > maxAllowed {
+		return fmt.Errorf("omaha: package %q is %d bytes, limit is %d",
+			p.Name, p.Size, maxAllowed)
+	}
+	return nil
 }
 
 func (p *Package) FromPath(name string) error {
@@ -55,14 +94,12 @@ func (p *Package) FromPath(name string) error {
 }
 
 func (p *Package) FromReader(r io.Reader) error {
-	sha1b64, sha256b64, n, err := multihash(r)
-	if err != nil {
+	var h Hashes
+	if err := h.FromReader(r); err != nil {
 		return err
 	}
 
-	p.SHA1 = sha1b64
-	p.SHA256 = sha256b64
-	p.Size = uint64(n)
+	p.SetHashes(h)
 	return nil
 }
 
@@ -77,35 +114,17 @@ func (p *Package) Verify(dir string) error {
 }
 
 func (p *Package) VerifyReader(r io.Reader) error {
-	sha1b64, sha256b64, n, err := multihash(r)
-	if err != nil {
-		return err
-	}
-
-	if p.Size != uint64(n) {
-		return PackageSizeMismatchError
-	}
-
-	if p.SHA1 != sha1b64 {
+	h, err := p.Hashes()
+	if err != nil || h.SHA1 == nil {
 		return PackageHashMismatchError
 	}
 
-	// Allow SHA256 to be empty since it is a later protocol addition.
-	if p.SHA256 != "" && p.SHA256 != sha256b64 {
-		return PackageHashMismatchError
-	}
-
-	return nil
-}
-
-func multihash(r io.Reader) (sha1b64, sha256b64 string, n int64, err error) {
-	h1 := sha1.New()
-	h256 := sha256.New()
-	if n, err = io.Copy(io.MultiWriter(h1, h256), r); err != nil {
-		return
+	// A zero size is only trusted for optional packages, which may
+	// legitimately be empty; required packages must declare one.
+	if p.Required && h.Size == 0 {
+		return PackageSizeMissingError
 	}
 
-	sha1b64 = base64.StdEncoding.EncodeToString(h1.Sum(nil))
-	sha256b64 = base64.StdEncoding.EncodeToString(h256.Sum(nil))
-	return
+	// SHA256 may be empty since it is a later protocol addition.
+	return h.Verify(r)
 }
@@ -15,6 +15,7 @@
 package omaha
 
 import (
+	"encoding/xml"
 	"strings"
 	"testing"
 
@@ -107,6 +108,21 @@ func TestPackageVerifyBadSize(t *testing.T) {
 
 }
 
+func TestPackageVerifyRequiredNoSize(t *testing.T) {
+	p := Package{
+		Name:     "null",
+		SHA1:     "2jmj7l5rSw0yVb/vlWAYkK/YBwk=",
+		SHA256:   "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=",
+		Size:     0,
+		Required: true,
+	}
+
+	err := p.Verify("/dev")
+	if err != PackageSizeMissingError {
+		t.Errorf("expected %v, got %v", PackageSizeMissingError, err)
+	}
+}
+
 func TestPackageVerifyBadSHA1(t *testing.T) {
 	p := Package{
 		Name:     "null",
@@ -142,3 +158,45 @@ func TestPackageVerifyBadSHA256(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestPackageSize(t *testing.T) {
+	for _, tt := range []struct {
+		size  string
+		valid bool
+		value PackageSize
+	}{
+		{"67546213", true, 67546213},
+		{"0", true, 0},
+		{"18446744073709551615", true, 18446744073709551615},
+		{"-1", false, 0},
+		{"18446744073709551616", false, 0},
+		{"big", false, 0},
+		{"", false, 0},
+	} {
+		var p Package
+		err := xml.Unmarshal([]byte(`<package name="update.gz" size="`+tt.size+`"/>`), &p)
+		if !tt.valid {
+			if err == nil {
+				t.Errorf("size %q accepted", tt.size)
+			} else if !strings.Contains(err.Error(), `"update.gz"`) {
+				t.Errorf("error does not name the package: %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("size %q rejected: %v", tt.size, err)
+		} else if p.Size != tt.value {
+			t.Errorf("size %q decoded as %d", tt.size, p.Size)
+		}
+	}
+}
+
+func TestPackageValidateSize(t *testing.T) {
+	p := Package{Name: "update.gz", Size: 1024}
+	if err := p.ValidateSize(1024); err != nil {
+		t.Error(err)
+	}
+	if err := p.ValidateSize(1023); err == nil {
+		t.Error("oversized package accepted")
+	}
+}
@@ -15,15 +15,22 @@
 package omaha
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"mime"
 	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
 )
 
 // checkContentType verifies the HTTP Content-Type header properly
-// declares the document is XML and UTF-8. Blank is assumed OK.
+// declares the document is XML and UTF-8 or UTF-16. Blank is assumed OK.
 func checkContentType(contentType string) error {
 	if contentType == "" {
 		return nil
@@ -38,17 +45,113 @@ func checkContentType(contentType string) error {
 		return fmt.Errorf("unsupported content type %q", mType)
 	}
 
-	charset, _ := mParams["charset"]
-	if charset != "" && strings.ToLower(charset) != "utf-8" {
+	switch charset := strings.ToLower(mParams["charset"]); charset {
+	case "", "utf-8", "utf-16", "utf-16le", "utf-16be":
+	default:
 		return fmt.Errorf("unsupported content charset %q", charset)
 	}
 
 	return nil
 }
 
+var (
+	utf8BOM    = []byte{0xEF, 0xBB, 0xBF}
+	utf16BEBOM = []byte{0xFE, 0xFF}
+	utf16LEBOM = []byte{0xFF, 0xFE}
+)
+
+// detectUTF16 reports the byte order of a document starting with head
+// if it is UTF-16, recognized by a byte order mark or by the first
+// character being '<' as described in appendix F of the XML spec.
+func detectUTF16(head []byte) binary.ByteOrder {
+	switch {
+	case bytes.HasPrefix(head, utf16BEBOM):
+		return binary.BigEndian
+	case bytes.HasPrefix(head, utf16LEBOM):
+		return binary.LittleEndian
+	case len(head) >= 2 && head[0] == 0 && head[1] == '<':
+		return binary.BigEndian
+	case len(head) >= 2 && head[0] == '<' && head[1] == 0:
+		return binary.LittleEndian
+	}
+	return nil
+}
+
+// toUTF8 strips any byte order mark from a document and converts it
+// from UTF-16 to UTF-8 if needed. Unpaired surrogates become U+FFFD.
+func toUTF8(raw []byte) ([]byte, error) {
+	order := detectUTF16(raw)
+	if order == nil {
+		return bytes.TrimPrefix(raw, utf8BOM), nil
+	}
+	if len(raw)%2 != 0 {
+		return nil, errors.New("omaha: truncated UTF-16 document")
+	}
+
+	units := make([]uint16, len(raw)/2)
+	for i := range units {
+		units[i] = order.Uint16(raw[i*2:])
+	}
+	if len(units) != 0 && units[0] == 0xFEFF {
+		units = units[1:]
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, len(units)))
+	for _, r := range utf16.Decode(units) {
+		buf.WriteRune(r)
+	}
+	return buf.Bytes(), nil
+}
+
+// prepareReader applies toUTF8 to the document read from r. Only
+// UTF-16 documents are read into memory.
+func prepareReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(3)
+	if bytes.Equal(head, utf8BOM) {
+		br.Discard(len(utf8BOM))
+		return br, nil
+	}
+	if detectUTF16(head) == nil {
+		return br, nil
+	}
+
+	raw, err := ioutil.ReadAll(br)
+	if err != nil {
+		return nil, err
+	}
+	raw, err = toUTF8(raw)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(raw), nil
+}
+
+// newDecoder returns a decoder for a document prepared by toUTF8.
+func newDecoder(r io.Reader) *xml.Decoder {
+	d := xml.NewDecoder(r)
+	d.CharsetReader = charsetReader
+	return d
+}
+
+// charsetReader accepts encodings declared by documents toUTF8 has
+// already converted. UTF-16 documents are undecodable otherwise so a
+// UTF-16 declaration is taken to be accurate.
+func charsetReader(label string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(label) {
+	case "utf-16", "utf-16le", "utf-16be", "us-ascii":
+		return input, nil
+	}
+	return nil, fmt.Errorf("omaha: unsupported document encoding %q", label)
+}
+
 // parseReqOrResp parses Request and Response objects.
 func parseReqOrResp(r io.Reader, v interface{}) error {
-	decoder := xml.NewDecoder(r)
+	r, err := prepareReader(r)
+	if err != nil {
+		return err
+	}
+	decoder := newDecoder(r)
 	if err := decoder.Decode(v); err != nil {
 		return err
 	}
@@ -63,9 +166,32 @@ func parseReqOrResp(r io.Reader, v interface{}) error {
 		panic(fmt.Errorf("unexpected type %T", v))
 	}
 
-	if protocol != "3.0" {
+	switch protocol {
+	case ProtocolV30, ProtocolV31:
+	default:
 		return fmt.Errorf("unsupported omaha protocol: %q", protocol)
 	}
 
 	return nil
 }
+
+// sanitizeUTF8 replaces each invalid UTF-8 byte with U+FFFD,
+// reporting whether any replacements were made.
+func sanitizeUTF8(b []byte) ([]byte, bool) {
+	if utf8.Valid(b) {
+		return b, false
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, len(b)+16))
+	for len(b) > 0 {
+		r, size := utf8.DecodeRune(b)
+		if r == utf8.RuneError && size == 1 {
+			buf.WriteRune(utf8.RuneError)
+		} else {
+			buf.Write(b[:size])
+		}
+		b = b[size:]
+	}
+
+	return buf.Bytes(), true
+}
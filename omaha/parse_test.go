@@ -15,10 +15,21 @@
 package omaha
 
 import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"path/filepath"
 	"strings"
 	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
 )
 
+// Attribute captured from a vendor firmware sending Latin-1 instead of UTF-8.
+const invalidUTF8Request = "<request protocol=\"3.0\">" +
+	"<app appid=\"{87efface-864d-49a5-9bb3-4b050a7c227a}\" oem=\"Caf\xe9\xff\"></app>" +
+	"</request>"
+
 func TestCheckContentType(t *testing.T) {
 	for _, tt := range []struct {
 		ct string
@@ -33,6 +44,8 @@ func TestCheckContentType(t *testing.T) {
 		{"text/xml; charset=utf-8", true},
 		{"text/xml; charset=UTF-8", true},
 		{"text/xml; charset=ascii", false},
+		{"text/xml; charset=UTF-16", true},
+		{"text/xml; charset=iso-8859-1", false},
 	} {
 		err := checkContentType(tt.ct)
 		if tt.ok && err != nil {
@@ -53,3 +66,132 @@ func TestParseBadVersion(t *testing.T) {
 		t.Errorf("Wrong error: %v", err)
 	}
 }
+
+func TestParseInvalidUTF8(t *testing.T) {
+	if _, err := ParseRequest("", strings.NewReader(invalidUTF8Request)); err == nil {
+		t.Error("invalid UTF-8 was accepted")
+	}
+
+	r, replaced, err := ParseRequestLenient("", strings.NewReader(invalidUTF8Request))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !replaced {
+		t.Error("replacement not reported")
+	}
+	if oem := r.Apps[0].OEM; oem != "Caf\uFFFD\uFFFD" {
+		t.Errorf("unexpected OEM %q", oem)
+	}
+
+	r, replaced, err = ParseRequestLenient("", strings.NewReader("<request protocol=\"3.0\"><app oem=\"Caf\u00e9\"></app></request>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replaced {
+		t.Error("valid UTF-8 was replaced")
+	}
+	if oem := r.Apps[0].OEM; oem != "Caf\u00e9" {
+		t.Errorf("unexpected OEM %q", oem)
+	}
+}
+
+func TestParseEncodings(t *testing.T) {
+	plain, err := ioutil.ReadFile(filepath.Join("..", "fixtures", "request.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := ParseRequest("", bytes.NewReader(plain))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsers := map[string]func(raw []byte) (*Request, error){
+		"ParseRequest": func(raw []byte) (*Request, error) {
+			return ParseRequest("", bytes.NewReader(raw))
+		},
+		"ParseRequestLenient": func(raw []byte) (*Request, error) {
+			r, _, err := ParseRequestLenient("", bytes.NewReader(raw))
+			return r, err
+		},
+		"RequestParser": func(raw []byte) (*Request, error) {
+			return NewRequestParser().Parse("", bytes.NewReader(raw))
+		},
+	}
+
+	for _, tt := range []struct {
+		fixture   string
+		namespace string
+	}{
+		{"utf8-bom-crlf.xml", ""},
+		{"utf16le-bom.xml", ""},
+		{"utf16be-bom.xml", ""},
+		{"utf16le.xml", ""},
+		{"xmlns.xml", GoogleUpdateRequestNamespace},
+	} {
+		raw, err := ioutil.ReadFile(filepath.Join("..", "fixtures", "encoding", tt.fixture))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, parse := range parsers {
+			r, err := parse(raw)
+			if err != nil {
+				t.Errorf("%s %s: %v", name, tt.fixture, err)
+				continue
+			}
+			if r.XMLName.Space != tt.namespace {
+				t.Errorf("%s %s: namespace %q", name, tt.fixture, r.XMLName.Space)
+			}
+			r.SetNamespace("")
+			if diff := pretty.Compare(expected, r); diff != "" {
+				t.Errorf("%s %s: %s", name, tt.fixture, diff)
+			}
+		}
+	}
+}
+
+func TestParseNamespaceRoundTrip(t *testing.T) {
+	raw, err := ioutil.ReadFile(filepath.Join("..", "fixtures", "encoding", "xmlns.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := ParseRequest("", bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := xml.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(out, []byte(`<request xmlns="`+GoogleUpdateRequestNamespace+`"`)) {
+		t.Errorf("namespace not preserved: %.80s", out)
+	}
+
+	out, err = xml.Marshal(r.SetNamespace(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(out, []byte("xmlns")) {
+		t.Errorf("namespace not dropped: %.80s", out)
+	}
+}
+
+func TestParseUnsupportedEncoding(t *testing.T) {
+	raw, err := ioutil.ReadFile(filepath.Join("..", "fixtures", "encoding", "latin1.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ParseRequest("", bytes.NewReader(raw))
+	if err == nil || !strings.Contains(err.Error(), `unsupported document encoding "ISO-8859-1"`) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	_, err = NewRequestParser().Parse("", bytes.NewReader(raw))
+	if err == nil || !strings.Contains(err.Error(), `unsupported document encoding "ISO-8859-1"`) {
+		t.Errorf("RequestParser: unexpected error: %v", err)
+	}
+
+	// An odd number of bytes cannot be UTF-16.
+	if _, err := ParseRequest("", bytes.NewReader([]byte("\xff\xfe<\x00r"))); err == nil {
+		t.Error("truncated UTF-16 accepted")
+	}
+}
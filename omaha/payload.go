@@ -0,0 +1,97 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Payload describes the package an update installs, collected from
+// the update's URLs, first required package and postinstall action.
+type Payload struct {
+	// URLs the package may be downloaded from, in order of preference.
+	URLs []string
+
+	Name string
+	Size uint64
+	SHA1 string
+
+	// SHA256 is from the package, or from the postinstall action
+	// in protocol 3.0 responses, which have it nowhere else.
+	SHA256 string
+
+	// From the postinstall action.
+	IsDelta               bool
+	DisablePayloadBackoff bool
+	Deadline              string
+	MetadataSize          string
+	MetadataSignature     string
+
+	// Package is the manifest entry, for verifying the download.
+	Package *Package
+}
+
+// Payload returns the update's payload. Responses missing any of the
+// pieces update_engine needs are an error.
+func (u *UpdateResponse) Payload() (*Payload, error) {
+	if u.Status != UpdateOK {
+		return nil, fmt.Errorf("omaha: no update available: %s", u.Status)
+	}
+	if len(u.URLs) == 0 {
+		return nil, errors.New("omaha: update has no urls")
+	}
+	if u.Manifest == nil {
+		return nil, errors.New("omaha: update has no manifest")
+	}
+
+	var pkg *Package
+	for _, p := range u.Manifest.Packages {
+		if p.Required {
+			pkg = p
+			break
+		}
+	}
+	if pkg == nil {
+		return nil, errors.New("omaha: update has no required package")
+	}
+
+	action, ok := u.Manifest.Action(ActionEventPostInstall)
+	if !ok {
+		return nil, errors.New("omaha: update has no postinstall action")
+	}
+
+	p := &Payload{
+		URLs:                  make([]string, len(u.URLs)),
+		Name:                  pkg.Name,
+		Size:                  uint64(pkg.Size),
+		SHA1:                  pkg.SHA1,
+		SHA256:                pkg.SHA256,
+		IsDelta:               action.IsDeltaPayload,
+		DisablePayloadBackoff: action.DisablePayloadBackoff,
+		Deadline:              action.Deadline,
+		MetadataSize:          action.MetadataSize,
+		MetadataSignature:     action.MetadataSignatureRsa,
+		Package:               pkg,
+	}
+	if p.SHA256 == "" {
+		// 3.0 responses only carry it in the action.
+		p.SHA256 = action.SHA256
+	}
+	for i, url := range u.URLs {
+		p.URLs[i] = url.CodeBase + pkg.Name
+	}
+	return p, nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+const samplePayloadResponse = `<?xml version="1.0" encoding="UTF-8"?>
+<response protocol="3.0" server="go-omaha">
+ <daystart elapsed_seconds="0"></daystart>
+ <app appid="{e96281a6-d1af-4bde-9a0a-97b76e56dc57}" status="ok">
+  <updatecheck status="ok">
+   <urls>
+    <url codebase="https://a.example.com/1.1.0/"></url>
+    <url codebase="https://b.example.com/1.1.0/"></url>
+   </urls>
+   <manifest version="1.1.0">
+    <packages>
+     <package name="extras.tgz" hash="q0PRb6WTSK2Y0z+TyxBXtxN8yB0=" size="1024" required="false"></package>
+     <package name="update.gz" hash="+LXvjiaPkeYDLHoNKlf9qbJwvnk=" size="67546213" required="true"></package>
+    </packages>
+    <actions>
+     <action event="install" run="update.gz"></action>
+     <action event="postinstall" sha256="wlTsmCTjJm/Ws1m7jzRI7PCPCTbgj2MaOlsL9wNhOkY=" IsDeltaPayload="true" MetadataSize="190" MetadataSignatureRsa="c2lnbmF0dXJl" deadline="now"></action>
+    </actions>
+   </manifest>
+  </updatecheck>
+ </app>
+</response>
+`
+
+func TestUpdatePayload(t *testing.T) {
+	resp, err := ParseResponse("", strings.NewReader(samplePayloadResponse))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := resp.Apps[0].UpdateCheck
+	p, err := u.Payload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &Payload{
+		URLs: []string{
+			"https://a.example.com/1.1.0/update.gz",
+			"https://b.example.com/1.1.0/update.gz",
+		},
+		Name:              "update.gz",
+		Size:              67546213,
+		SHA1:              "+LXvjiaPkeYDLHoNKlf9qbJwvnk=",
+		SHA256:            "wlTsmCTjJm/Ws1m7jzRI7PCPCTbgj2MaOlsL9wNhOkY=",
+		IsDelta:           true,
+		Deadline:          "now",
+		MetadataSize:      "190",
+		MetadataSignature: "c2lnbmF0dXJl",
+		Package:           u.Manifest.Packages[1],
+	}
+	if diff := pretty.Compare(expected, p); diff != "" {
+		t.Errorf("unexpected payload: %s", diff)
+	}
+	if p.Package != u.Manifest.Packages[1] {
+		t.Errorf("payload refers to the wrong package")
+	}
+}
+
+func TestUpdatePayloadIncomplete(t *testing.T) {
+	for _, tt := range []struct {
+		modify func(u *UpdateResponse)
+		err    string
+	}{
+		{func(u *UpdateResponse) { u.Status = NoUpdate }, "no update available"},
+		{func(u *UpdateResponse) { u.URLs = nil }, "no urls"},
+		{func(u *UpdateResponse) { u.Manifest = nil }, "no manifest"},
+		{func(u *UpdateResponse) { u.Manifest.Packages[1].Required = false }, "no required package"},
+		{func(u *UpdateResponse) { u.Manifest.Actions = u.Manifest.Actions[:1] }, "no postinstall action"},
+	} {
+		resp, err := ParseResponse("", strings.NewReader(samplePayloadResponse))
+		if err != nil {
+			t.Fatal(err)
+		}
+		u := resp.Apps[0].UpdateCheck
+		tt.modify(u)
+		if _, err := u.Payload(); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("expected error containing %q, got %v", tt.err, err)
+		}
+	}
+}
+
+func TestUpdatePayloadFixture(t *testing.T) {
+	f, err := os.Open("../fixtures/update-engine/update/response.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	resp, err := ParseResponse("", f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := resp.Apps[0].UpdateCheck.Payload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.SHA1 != "+LXvjiaPkeYDLHoNKlf9qbJwvnk=" || p.SHA256 != "0VAlQW3RE99SGtSB5R4m08antAHO8XDoBMKDyxQT/Mg=" {
+		t.Errorf("unexpected digests %q %q", p.SHA1, p.SHA256)
+	}
+}
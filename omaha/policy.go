@@ -0,0 +1,147 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// PolicyResponse applies rollout policy to an Update before an Updater
+// returns it from CheckUpdate:
+//
+//	policy := omaha.NewPolicyResponse(update).Mandatory().ThrottlePercent(10)
+//	...
+//	func (u *myUpdater) CheckUpdate(req *omaha.Request, app *omaha.AppRequest) (*omaha.Update, error) {
+//		return policy.Apply(req, app)
+//	}
+//
+// The Update given to NewPolicyResponse is not modified.
+type PolicyResponse struct {
+	update         *Update
+	deadline       string
+	disableBackoff bool
+	percent        int
+	err            error
+}
+
+func NewPolicyResponse(update *Update) *PolicyResponse {
+	return &PolicyResponse{update: update, percent: 100}
+}
+
+// Mandatory asks clients to install the update immediately, without
+// backing off between failed downloads.
+func (p *PolicyResponse) Mandatory() *PolicyResponse {
+	return p.DeadlineIn(0).DisableBackoff()
+}
+
+// DeadlineIn asks clients to install the update within d. A d of zero
+// or less means now.
+func (p *PolicyResponse) DeadlineIn(d time.Duration) *PolicyResponse {
+	if d <= 0 {
+		p.deadline = "now"
+	} else {
+		p.deadline = strconv.FormatInt(int64((d+time.Second-1)/time.Second), 10)
+	}
+	return p
+}
+
+// DisableBackoff sets DisablePayloadBackoff on the postinstall action.
+func (p *PolicyResponse) DisableBackoff() *PolicyResponse {
+	p.disableBackoff = true
+	return p
+}
+
+// ThrottlePercent offers the update to only percent of machines. Each
+// machine is consistently in or out of the rollout for a given app and
+// version, based on its machineid, bootid, or the request's userid.
+// A percent outside 0 to 100 is reported by Err and Apply.
+func (p *PolicyResponse) ThrottlePercent(percent int) *PolicyResponse {
+	if percent < 0 || percent > 100 {
+		p.err = fmt.Errorf("omaha: invalid throttle percent %d", percent)
+		return p
+	}
+	p.percent = percent
+	return p
+}
+
+// Err returns the first error in building the policy, if any.
+func (p *PolicyResponse) Err() error {
+	return p.err
+}
+
+// Apply returns the update with the policy applied for the requesting
+// app, or NoUpdate if the app is outside the rollout. An invalid policy
+// is returned as an error for every request rather than offering the
+// update to machines it was not meant for.
+func (p *PolicyResponse) Apply(req *Request, app *AppRequest) (*Update, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	if p.percent < 100 && rolloutBucket(p.update, req, app) >= p.percent {
+		return nil, NoUpdate
+	}
+	if p.deadline == "" && !p.disableBackoff {
+		return p.update, nil
+	}
+
+	u := *p.update
+	u.Actions = make([]*Action, len(p.update.Actions))
+	copy(u.Actions, p.update.Actions)
+
+	var action *Action
+	for i, a := range u.Actions {
+		if a.Event == ActionEventPostInstall {
+			c := *a
+			action, u.Actions[i] = &c, &c
+			break
+		}
+	}
+	if action == nil {
+		action = u.AddAction(ActionEventPostInstall)
+	}
+
+	if p.deadline != "" {
+		action.Deadline = p.deadline
+	}
+	if p.disableBackoff {
+		action.DisablePayloadBackoff = true
+	}
+	return &u, nil
+}
+
+// rolloutBucket assigns the machine making the request to one of 100
+// buckets. The hash must not change between releases or machines would
+// move in and out of partial rollouts on a server upgrade. Machines
+// without any identifier are placed last so they only get updates
+// offered to everyone.
+func rolloutBucket(update *Update, req *Request, app *AppRequest) int {
+	id := app.MachineID
+	if id == "" {
+		id = app.BootID
+	}
+	if id == "" {
+		id = req.UserID
+	}
+	if id == "" {
+		return 100
+	}
+
+	sum := sha256.Sum256([]byte(update.ID + "\n" + update.Version + "\n" + id))
+	return int(binary.BigEndian.Uint64(sum[:8]) % 100)
+}
@@ -0,0 +1,145 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newPolicyUpdate() *Update {
+	u := &Update{ID: testAppID}
+	u.Version = "1.1.0"
+	u.AddAction(ActionEventInstall)
+	u.AddAction(ActionEventPostInstall).SHA256 = "sum"
+	return u
+}
+
+func TestPolicyResponse(t *testing.T) {
+	update := newPolicyUpdate()
+	req := NewUpdateCheckRequest(testAppID, testAppVer)
+	app := req.Apps[0]
+
+	for _, tt := range []struct {
+		policy   *PolicyResponse
+		deadline string
+		backoff  bool
+	}{
+		{NewPolicyResponse(update), "", false},
+		{NewPolicyResponse(update).Mandatory(), "now", true},
+		{NewPolicyResponse(update).DeadlineIn(90 * time.Minute), "5400", false},
+		{NewPolicyResponse(update).DeadlineIn(1500 * time.Millisecond), "2", false},
+		{NewPolicyResponse(update).DisableBackoff(), "", true},
+	} {
+		u, err := tt.policy.Apply(req, app)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, ok := u.Action(ActionEventPostInstall)
+		if !ok {
+			t.Fatal("postinstall action missing")
+		}
+		if a.Deadline != tt.deadline || a.DisablePayloadBackoff != tt.backoff || a.SHA256 != "sum" {
+			t.Errorf("unexpected action %+v", a)
+		}
+		if len(u.Actions) != 2 {
+			t.Errorf("expected 2 actions, not %d", len(u.Actions))
+		}
+	}
+
+	// The original update is shared between requests so it must not
+	// be modified.
+	if a, _ := update.Action(ActionEventPostInstall); a.Deadline != "" || a.DisablePayloadBackoff {
+		t.Errorf("original update modified: %+v", a)
+	}
+
+	// An action is added if the update has none.
+	bare := &Update{ID: testAppID}
+	u, err := NewPolicyResponse(bare).Mandatory().Apply(req, app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, ok := u.Action(ActionEventPostInstall); !ok || a.Deadline != "now" {
+		t.Errorf("postinstall action not added: %+v", u.Actions)
+	}
+	if len(bare.Actions) != 0 {
+		t.Errorf("original update modified: %+v", bare.Actions)
+	}
+}
+
+func TestPolicyThrottle(t *testing.T) {
+	update := newPolicyUpdate()
+	for _, percent := range []int{0, 10, 50, 90, 100} {
+		policy := NewPolicyResponse(update).ThrottlePercent(percent)
+		const machines = 10000
+		updated := 0
+		for i := 0; i < machines; i++ {
+			req := NewUpdateCheckRequest(testAppID, testAppVer)
+			req.Apps[0].MachineID = fmt.Sprintf("%032x", i)
+			u, err := policy.Apply(req, req.Apps[0])
+			if err == nil && u != nil {
+				updated++
+			} else if err != NoUpdate {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			// The same machine always gets the same answer.
+			if u2, _ := policy.Apply(req, req.Apps[0]); (u2 == nil) != (u == nil) {
+				t.Fatalf("machine %d flipped", i)
+			}
+		}
+
+		expected := machines * percent / 100
+		if updated < expected-machines/50 || updated > expected+machines/50 {
+			t.Errorf("%d%%: %d of %d machines updated", percent, updated, machines)
+		}
+	}
+}
+
+func TestPolicyThrottleInvalid(t *testing.T) {
+	for _, percent := range []int{-1, 101} {
+		policy := NewPolicyResponse(newPolicyUpdate()).ThrottlePercent(percent)
+		if policy.Err() == nil {
+			t.Errorf("%d%%: no error", percent)
+		}
+		req := NewUpdateCheckRequest(testAppID, testAppVer)
+		if u, err := policy.Apply(req, req.Apps[0]); err == nil || err == NoUpdate || u != nil {
+			t.Errorf("%d%%: Apply returned %v, %v", percent, u, err)
+		}
+	}
+}
+
+func TestPolicyThrottleStable(t *testing.T) {
+	update := newPolicyUpdate()
+	req := NewUpdateCheckRequest(testAppID, testAppVer)
+	app := req.Apps[0]
+
+	// These values must never change, see rolloutBucket.
+	for _, tt := range []struct {
+		machineID, bootID, userID string
+		bucket                    int
+	}{
+		{"8BDE4C4D-9083-4D61-B41C-3253212C0C37", "", "", 49},
+		{"", "7D52A1CC-7066-40F0-91C7-7CB6A871BFDE", "", 15},
+		{"", "", "{D0BBD725-742D-44ae-8D46-0231E881D58E}", 42},
+		{"", "", "", 100},
+	} {
+		app.MachineID, app.BootID, req.UserID = tt.machineID, tt.bootID, tt.userID
+		if b := rolloutBucket(update, req, app); b != tt.bucket {
+			t.Errorf("%+v: bucket %d", tt, b)
+		}
+	}
+}
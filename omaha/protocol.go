@@ -23,31 +23,75 @@
 package omaha
 
 import (
+	"bytes"
 	"encoding/xml"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"strconv"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+// Protocol versions understood by this package. 3.0 is the version spoken
+// by update_engine; 3.1 adds a few attributes, most notably moving the
+// package SHA-256 hash from the postinstall action to the package itself.
+const (
+	ProtocolV30 = "3.0"
+	ProtocolV31 = "3.1"
+)
+
+// Namespaces used by GoogleUpdate and some other servers. Parsing accepts
+// documents with or without a namespace, recording it in XMLName.Space.
+// Marshaling emits the recorded namespace again unless it is cleared
+// with SetNamespace("").
+const (
+	GoogleUpdateRequestNamespace  = "http://www.google.com/update2/request"
+	GoogleUpdateResponseNamespace = "http://www.google.com/update2/response"
 )
 
 // Request sent by the Omaha client
 type Request struct {
-	XMLName       xml.Name      `xml:"request" json:"-"`
-	OS            *OS           `xml:"os"`
-	Apps          []*AppRequest `xml:"app"`
-	Protocol      string        `xml:"protocol,attr"`
-	InstallSource string        `xml:"installsource,attr,omitempty"`
-	IsMachine     int           `xml:"ismachine,attr,omitempty"`
-	RequestID     string        `xml:"requestid,attr,omitempty"`
-	SessionID     string        `xml:"sessionid,attr,omitempty"`
-	TestSource    string        `xml:"testsource,attr,omitempty"`
-	UserID        string        `xml:"userid,attr,omitempty"`
-	Version       string        `xml:"version,attr,omitempty"`
+	XMLName  xml.Name      `xml:"request" json:"-"`
+	OS       *OS           `xml:"os"`
+	Apps     []*AppRequest `xml:"app"`
+	Protocol string        `xml:"protocol,attr"`
+	Version  string        `xml:"version,attr,omitempty"`
 
 	// update engine extension, duplicates the version attribute.
 	UpdaterVersion string `xml:"updaterversion,attr,omitempty"`
+
+	// GoogleUpdate extension, the version of the updater's shell.
+	ShellVersion string `xml:"shell_version,attr,omitempty"`
+
+	// Attributes are ordered as update_engine sends them so captured
+	// requests encode identically.
+	InstallSource string `xml:"installsource,attr,omitempty"`
+	IsMachine     int    `xml:"ismachine,attr,omitempty"`
+	SessionID     string `xml:"sessionid,attr,omitempty"`
+	UserID        string `xml:"userid,attr,omitempty"`
+	TestSource    string `xml:"testsource,attr,omitempty"`
+	RequestID     string `xml:"requestid,attr,omitempty"`
+
+	// go-omaha extension, asks for a minimal response if the request
+	// only contains events.
+	MinimalAck bool `xml:"minimalack,attr,omitempty"`
 }
 
+// UpdaterVersion is the updaterversion attribute NewRequest sets,
+// identifying the client software to servers. Programs building their
+// own requests should set it to their name and version.
+var UpdaterVersion = "go-omaha"
+
+// NewRequest creates a protocol 3.0 request for the local platform with
+// UpdaterVersion and fresh request and session IDs.
 func NewRequest() *Request {
 	return &Request{
-		Protocol: "3.0",
+		Protocol:       ProtocolV30,
+		UpdaterVersion: UpdaterVersion,
+		SessionID:      NewRequestID(),
+		RequestID:      NewRequestID(),
 		// TODO(marineam) set a default client Version
 		OS: &OS{
 			Platform: LocalPlatform(),
@@ -57,9 +101,87 @@ func NewRequest() *Request {
 	}
 }
 
+// NewUpdateCheckRequest creates a request for a single app containing
+// an update check and a ping, the shape update_engine uses to poll for
+// updates.
+func NewUpdateCheckRequest(appID, version string) *Request {
+	r := NewRequest()
+	app := r.AddApp(appID, version)
+	app.AddUpdateCheck()
+	app.AddPing()
+	return r
+}
+
+// NewPingRequest creates a request for a single app containing only a
+// ping, for reporting activity without checking for updates. The ping
+// marks the app active; callers that track rollcalls should also set
+// the ping's LastReportDays.
+func NewPingRequest(appID, version string) *Request {
+	r := NewRequest()
+	app := r.AddApp(appID, version)
+	app.AddPing()
+	return r
+}
+
+// NewEventRequest creates a request for a single app containing only
+// the given events, the shape used to report download and install
+// progress.
+func NewEventRequest(appID, version string, events ...*EventRequest) *Request {
+	r := NewRequest()
+	app := r.AddApp(appID, version)
+	app.Events = append(app.Events, events...)
+	return r
+}
+
+// ValidateOptions relaxes the checks made by Request.Validate.
+type ValidateOptions struct {
+	// AllowMixed permits an app to contain both an update check and
+	// events. Some servers reject such requests but CoreUpdate expects
+	// update checks to be accompanied by an event.
+	AllowMixed bool
+}
+
+// Validate checks that the request has a known protocol version and
+// install source, and that each app has an id. Unless opts allows it
+// apps may not mix an update check with events. opts may be nil.
+func (r *Request) Validate(opts *ValidateOptions) error {
+	if opts == nil {
+		opts = &ValidateOptions{}
+	}
+
+	switch r.Protocol {
+	case ProtocolV30, ProtocolV31:
+	default:
+		return fmt.Errorf("omaha: unsupported protocol %q", r.Protocol)
+	}
+
+	switch r.InstallSource {
+	case "", InstallSourceScheduled, InstallSourceOnDemand:
+	default:
+		return fmt.Errorf("omaha: unknown install source %q", r.InstallSource)
+	}
+
+	if len(r.Apps) == 0 {
+		return fmt.Errorf("omaha: request has no apps")
+	}
+
+	for i, app := range r.Apps {
+		if app.ID == "" {
+			return fmt.Errorf("omaha: app %d has no id", i)
+		}
+		if app.UpdateCheck != nil && len(app.Events) != 0 && !opts.AllowMixed {
+			return fmt.Errorf("omaha: app %s mixes an update check with events", app.ID)
+		}
+	}
+
+	return nil
+}
+
 // ParseRequest verifies and returns the parsed Request document.
 // The MIME Content-Type header may be provided to sanity check its
-// value; if blank it is assumed to be XML in UTF-8.
+// value; if blank it is assumed to be XML in UTF-8. Documents may start
+// with a byte order mark and may be UTF-16, other encodings and
+// documents that are not valid UTF-8 are rejected.
 func ParseRequest(contentType string, body io.Reader) (*Request, error) {
 	if err := checkContentType(contentType); err != nil {
 		return nil, err
@@ -73,6 +195,83 @@ func ParseRequest(contentType string, body io.Reader) (*Request, error) {
 	return r, nil
 }
 
+// ParseRequestLenient is ParseRequest for documents that may contain
+// invalid UTF-8, such as attributes copied from buggy firmware. Invalid
+// bytes are replaced with U+FFFD, indicated by returning replaced true.
+func ParseRequestLenient(contentType string, body io.Reader) (r *Request, replaced bool, err error) {
+	raw, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if raw, err = toUTF8(raw); err != nil {
+		return nil, false, err
+	}
+	raw, replaced = sanitizeUTF8(raw)
+	r, err = ParseRequest(contentType, bytes.NewReader(raw))
+	return r, replaced, err
+}
+
+// EventOnly reports whether every app in the request only has events.
+func (r *Request) EventOnly() bool {
+	for _, app := range r.Apps {
+		if app.Ping != nil || app.UpdateCheck != nil || len(app.Events) == 0 {
+			return false
+		}
+	}
+	return len(r.Apps) != 0
+}
+
+// SetNamespace sets the XML namespace of the request element,
+// for servers that require one. A blank namespace emits a bare element.
+func (r *Request) SetNamespace(ns string) *Request {
+	r.XMLName = xml.Name{Space: ns, Local: "request"}
+	return r
+}
+
+// MarshalXML emits the namespace set in XMLName, if any.
+func (r *Request) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	type request Request // prevent recursion
+	start = xml.StartElement{Name: xml.Name{Space: r.XMLName.Space, Local: "request"}}
+	return e.EncodeElement((*request)(r), start)
+}
+
+// SetInstallSource marks the request as a scheduled or on demand check.
+// src should be InstallSourceScheduled, InstallSourceOnDemand, or blank;
+// Validate rejects other values.
+func (r *Request) SetInstallSource(src string) *Request {
+	r.InstallSource = src
+	return r
+}
+
+// NewRequestID returns a random identifier in the braced GUID form
+// Omaha clients use for request and session IDs.
+func NewRequestID() string {
+	return "{" + uuid.NewV4().String() + "}"
+}
+
+// SetRequestID sets the identifier servers log for each request,
+// generating a new one if id is blank. Retries of a request should
+// keep the same identifier.
+func (r *Request) SetRequestID(id string) *Request {
+	if id == "" {
+		id = NewRequestID()
+	}
+	r.RequestID = id
+	return r
+}
+
+// SetSessionID sets the identifier shared by related requests, such as
+// an update check and the events reporting its progress, generating a
+// new one if id is blank.
+func (r *Request) SetSessionID(id string) *Request {
+	if id == "" {
+		id = NewRequestID()
+	}
+	r.SessionID = id
+	return r
+}
+
 func (r *Request) AddApp(id, version string) *AppRequest {
 	a := &AppRequest{ID: id, Version: version}
 	r.Apps = append(r.Apps, a)
@@ -92,25 +291,27 @@ type AppRequest struct {
 	Ping        *PingRequest    `xml:"ping"`
 	UpdateCheck *UpdateRequest  `xml:"updatecheck"`
 	Events      []*EventRequest `xml:"event" json:",omitempty"`
+	Data        []*Data         `xml:"data" json:",omitempty"`
 	ID          string          `xml:"appid,attr,omitempty"`
-	Client      string          `xml:"client,attr,omitempty"`
-	InstallAge  string          `xml:"installage,attr,omitempty"`
-	Lang        string          `xml:"lang,attr,omitempty"`
-	NextVersion string          `xml:"nextversion,attr,omitempty"`
-	Version     string          `xml:"version,attr,omitempty"`
-
-	// update engine extensions
-	Board     string `xml:"board,attr,omitempty"`
-	DeltaOK   bool   `xml:"delta_okay,attr,omitempty"`
-	FromTrack string `xml:"from_track,attr,omitempty"`
-	Track     string `xml:"track,attr,omitempty"`
-
-	// coreos update engine extensions
-	AlephVersion string `xml:"alephversion,attr,omitempty"`
-	BootID       string `xml:"bootid,attr,omitempty"`
-	MachineID    string `xml:"machineid,attr,omitempty"`
-	OEM          string `xml:"oem,attr,omitempty"`
-	OEMVersion   string `xml:"oemversion,attr,omitempty"`
+
+	// Attributes are ordered as update_engine sends them so captured
+	// requests encode identically, with extensions marked by origin.
+	BootID        string `xml:"bootid,attr,omitempty"`       // coreos update engine
+	MachineID     string `xml:"machineid,attr,omitempty"`    // coreos update engine
+	OEM           string `xml:"oem,attr,omitempty"`          // coreos update engine
+	OEMVersion    string `xml:"oemversion,attr,omitempty"`   // coreos update engine
+	AlephVersion  string `xml:"alephversion,attr,omitempty"` // coreos update engine
+	Version       string `xml:"version,attr,omitempty"`
+	NextVersion   string `xml:"nextversion,attr,omitempty"`
+	Track         string `xml:"track,attr,omitempty"`      // update engine
+	FromTrack     string `xml:"from_track,attr,omitempty"` // update engine
+	Lang          string `xml:"lang,attr,omitempty"`
+	Brand         string `xml:"brand,attr,omitempty"`
+	Board         string `xml:"board,attr,omitempty"`          // update engine
+	HardwareClass string `xml:"hardware_class,attr,omitempty"` // update engine
+	DeltaOK       bool   `xml:"delta_okay,attr,omitempty"`     // update engine
+	Client        string `xml:"client,attr,omitempty"`
+	InstallAge    string `xml:"installage,attr,omitempty"`
 }
 
 func (a *AppRequest) AddUpdateCheck() *UpdateRequest {
@@ -129,8 +330,19 @@ func (a *AppRequest) AddEvent() *EventRequest {
 	return event
 }
 
+// AddData requests the named data, for example the install parameters
+// identified by index.
+func (a *AppRequest) AddData(name, index string) *Data {
+	data := &Data{Name: name, Index: index}
+	a.Data = append(a.Data, data)
+	return data
+}
+
 type UpdateRequest struct {
 	TargetVersionPrefix string `xml:"targetversionprefix,attr,omitempty"`
+
+	// protocol 3.1 extension
+	RollbackAllowed bool `xml:"rollback_allowed,attr,omitempty"`
 }
 
 type PingRequest struct {
@@ -142,7 +354,7 @@ type PingRequest struct {
 type EventRequest struct {
 	Type            EventType   `xml:"eventtype,attr"`
 	Result          EventResult `xml:"eventresult,attr"`
-	ErrorCode       int         `xml:"errorcode,attr,omitempty"`
+	ErrorCode       ErrorCode   `xml:"errorcode,attr,omitempty"`
 	NextVersion     string      `xml:"nextversion,attr,omitempty"`
 	PreviousVersion string      `xml:"previousversion,attr,omitempty"`
 }
@@ -154,11 +366,22 @@ type Response struct {
 	Apps     []*AppResponse `xml:"app"`
 	Protocol string         `xml:"protocol,attr"`
 	Server   string         `xml:"server,attr"`
+
+	// go-omaha extension, a response to a MinimalAck request which
+	// omits daystart and the server attribute.
+	MinimalAck bool `xml:"minimalack,attr,omitempty"`
+}
+
+// minimalResponse is the encoding of a Response with MinimalAck set.
+type minimalResponse struct {
+	Apps       []*AppResponse `xml:"app"`
+	Protocol   string         `xml:"protocol,attr"`
+	MinimalAck bool           `xml:"minimalack,attr"`
 }
 
 func NewResponse() *Response {
 	return &Response{
-		Protocol: "3.0",
+		Protocol: ProtocolV30,
 		Server:   "go-omaha",
 		DayStart: DayStart{ElapsedSeconds: "0"},
 	}
@@ -180,6 +403,73 @@ func ParseResponse(contentType string, body io.Reader) (*Response, error) {
 	return r, nil
 }
 
+// SetNamespace sets the XML namespace of the response element,
+// for clients that require one. A blank namespace emits a bare element.
+func (r *Response) SetNamespace(ns string) *Response {
+	r.XMLName = xml.Name{Space: ns, Local: "response"}
+	return r
+}
+
+// MarshalXML omits all protocol 3.1 attributes from 3.0 responses,
+// reduces MinimalAck responses to the apps and emits the namespace set
+// in XMLName, if any.
+func (r *Response) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	type response Response // prevent recursion
+	if r.Protocol == ProtocolV30 {
+		r = r.stripV31()
+	}
+	start = xml.StartElement{Name: xml.Name{Space: r.XMLName.Space, Local: "response"}}
+	if r.MinimalAck {
+		return e.EncodeElement(&minimalResponse{
+			Apps:       r.Apps,
+			Protocol:   r.Protocol,
+			MinimalAck: true,
+		}, start)
+	}
+	return e.EncodeElement((*response)(r), start)
+}
+
+// Validate checks that the response is an acceptable answer to req.
+// Minimal responses are only allowed if req asked for one.
+func (r *Response) Validate(req *Request) error {
+	if r.MinimalAck && !(req.MinimalAck && req.EventOnly()) {
+		return fmt.Errorf("omaha: unexpected minimal response")
+	}
+	return nil
+}
+
+// stripV31 returns a copy of the response without any protocol 3.1
+// attributes. Only the elements that need modification are copied.
+func (r *Response) stripV31() *Response {
+	c := *r
+	c.Apps = make([]*AppResponse, len(r.Apps))
+	for i, app := range r.Apps {
+		c.Apps[i] = app
+		if app.UpdateCheck == nil {
+			continue
+		}
+
+		u := *app.UpdateCheck
+		u.Rollback = false
+		if u.Manifest != nil {
+			m := *u.Manifest
+			m.Arguments = ""
+			m.Packages = make([]*Package, len(u.Manifest.Packages))
+			for j, pkg := range u.Manifest.Packages {
+				p := *pkg
+				p.SHA256 = ""
+				m.Packages[j] = &p
+			}
+			u.Manifest = &m
+		}
+
+		a := *app
+		a.UpdateCheck = &u
+		c.Apps[i] = &a
+	}
+	return &c
+}
+
 type DayStart struct {
 	ElapsedSeconds string `xml:"elapsed_seconds,attr"`
 }
@@ -190,6 +480,15 @@ func (r *Response) AddApp(id string, status AppStatus) *AppResponse {
 	return a
 }
 
+// AddApps adds an app for each id, all with the same status.
+func (r *Response) AddApps(ids []string, status AppStatus) []*AppResponse {
+	apps := make([]*AppResponse, len(ids))
+	for i, id := range ids {
+		apps[i] = r.AddApp(id, status)
+	}
+	return apps
+}
+
 func (r *Response) GetApp(id string) *AppResponse {
 	for _, app := range r.Apps {
 		if app.ID == id {
@@ -203,6 +502,7 @@ type AppResponse struct {
 	Ping        *PingResponse    `xml:"ping"`
 	UpdateCheck *UpdateResponse  `xml:"updatecheck"`
 	Events      []*EventResponse `xml:"event" json:",omitempty"`
+	Data        []*Data          `xml:"data" json:",omitempty"`
 	ID          string           `xml:"appid,attr,omitempty"`
 	Status      AppStatus        `xml:"status,attr,omitempty"`
 }
@@ -223,10 +523,55 @@ func (a *AppResponse) AddEvent() *EventResponse {
 	return event
 }
 
+// AddData answers a data request with the given value.
+func (a *AppResponse) AddData(name, index, value string) *Data {
+	data := &Data{Name: name, Index: index, Status: DataOK, Value: value}
+	a.Data = append(a.Data, data)
+	return data
+}
+
+// AddNoData answers a data request that has no data available.
+func (a *AppResponse) AddNoData(name, index string) *Data {
+	data := &Data{Name: name, Index: index, Status: DataNoData}
+	a.Data = append(a.Data, data)
+	return data
+}
+
+// Names of the data an app may request.
+const (
+	DataNameInstall   = "install"
+	DataNameUntrusted = "untrusted"
+)
+
+// Data carries install parameters or other untrusted data for an app.
+// Requests name the data they want and responses carry it as text.
+type Data struct {
+	Name   string     `xml:"name,attr,omitempty"`
+	Index  string     `xml:"index,attr,omitempty"`
+	Status DataStatus `xml:"status,attr,omitempty"`
+	Value  string     `xml:",chardata"`
+}
+
 type UpdateResponse struct {
 	URLs     []*URL       `xml:"urls>url" json:",omitempty"`
 	Manifest *Manifest    `xml:"manifest"`
 	Status   UpdateStatus `xml:"status,attr,omitempty"`
+
+	// protocol 3.1 extension
+	Rollback bool `xml:"_rollback,attr,omitempty"`
+}
+
+// IsMandatory reports whether an available update has a deadline.
+func (u *UpdateResponse) IsMandatory() bool {
+	if u.Status != UpdateOK || u.Manifest == nil {
+		return false
+	}
+	for _, a := range u.Manifest.Actions {
+		if _, ok := a.DeadlineDuration(); ok {
+			return true
+		}
+	}
+	return false
 }
 
 func (u *UpdateResponse) AddURL(codebase string) *URL {
@@ -249,8 +594,8 @@ type EventResponse struct {
 }
 
 type OS struct {
-	Platform    string `xml:"platform,attr,omitempty"`
 	Version     string `xml:"version,attr,omitempty"`
+	Platform    string `xml:"platform,attr,omitempty"`
 	ServicePack string `xml:"sp,attr,omitempty"`
 	Arch        string `xml:"arch,attr,omitempty"`
 }
@@ -263,6 +608,9 @@ type Manifest struct {
 	Packages []*Package `xml:"packages>package"`
 	Actions  []*Action  `xml:"actions>action"`
 	Version  string     `xml:"version,attr"`
+
+	// protocol 3.1 extension
+	Arguments string `xml:"arguments,attr,omitempty"`
 }
 
 func (m *Manifest) AddPackage() *Package {
@@ -286,6 +634,49 @@ func (m *Manifest) AddAction(event string) *Action {
 	return a
 }
 
+// Action finds the first action for the given event.
+func (m *Manifest) Action(event string) (*Action, bool) {
+	for _, a := range m.Actions {
+		if a.Event == event {
+			return a, true
+		}
+	}
+	return nil, false
+}
+
+// DeltaActionFrom finds the postinstall action for a delta payload that
+// can be applied to an install of the given previous version.
+func (m *Manifest) DeltaActionFrom(previousVersion string) (*Action, bool) {
+	if previousVersion == "" {
+		return nil, false
+	}
+	for _, a := range m.Actions {
+		if a.Event == ActionEventPostInstall && a.IsDeltaPayload &&
+			a.PreviousVersion == previousVersion {
+			return a, true
+		}
+	}
+	return nil, false
+}
+
+// FullAction finds the postinstall action for a full, non-delta, payload.
+func (m *Manifest) FullAction() (*Action, bool) {
+	for _, a := range m.Actions {
+		if a.Event == ActionEventPostInstall && !a.IsDeltaPayload {
+			return a, true
+		}
+	}
+	return nil, false
+}
+
+// Events an Action may be associated with.
+const (
+	ActionEventPreInstall  = "preinstall"
+	ActionEventInstall     = "install"
+	ActionEventPostInstall = "postinstall"
+	ActionEventUpdate      = "update"
+)
+
 type Action struct {
 	Event string `xml:"event,attr"`
 
@@ -301,4 +692,29 @@ type Action struct {
 	Deadline              string `xml:"deadline,attr,omitempty"`
 	MoreInfo              string `xml:"MoreInfo,attr,omitempty"`
 	Prompt                bool   `xml:"Prompt,attr,omitempty"`
+
+	// go-omaha extension, the version a delta payload applies to.
+	PreviousVersion string `xml:"previousversion,attr,omitempty"`
+}
+
+// PayloadBackoffDisabled reports whether clients should retry failed
+// payload downloads immediately. It is false for a nil action so the
+// result of Manifest.Action may be used directly.
+func (a *Action) PayloadBackoffDisabled() bool {
+	return a != nil && a.DisablePayloadBackoff
+}
+
+// DeadlineDuration parses the deadline attribute, either "now" or a
+// number of seconds, returning false if it is missing or invalid.
+func (a *Action) DeadlineDuration() (time.Duration, bool) {
+	if a.Deadline == "now" {
+		return 0, true
+	}
+
+	secs, err := strconv.ParseUint(a.Deadline, 10, 32)
+	if err != nil {
+		return 0, false
+	}
+
+	return time.Duration(secs) * time.Second, true
 }
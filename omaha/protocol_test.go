@@ -15,11 +15,16 @@
 package omaha
 
 import (
+	"bytes"
 	"encoding/xml"
 	"fmt"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+	"github.com/satori/go.uuid"
 )
 
 const (
@@ -53,6 +58,54 @@ const (
 </updatecheck>
 </app>
 </response>
+`
+	sampleRequestV31 = `<?xml version="1.0" encoding="UTF-8"?>
+<request protocol="3.1" version="1.3.33.7" ismachine="1" installsource="scheduler">
+<os platform="win" version="10.0" arch="x64"></os>
+<app appid="{87efface-864d-49a5-9bb3-4b050a7c227a}" version="1.0.0.0" lang="en-US">
+<ping active="1" r="1"></ping>
+<updatecheck targetversionprefix="1." rollback_allowed="true"></updatecheck>
+</app>
+</request>
+`
+	sampleResponseV31 = `<?xml version="1.0" encoding="UTF-8"?>
+<response protocol="3.1" server="prod">
+<daystart elapsed_seconds="49008"/>
+<app appid="{87efface-864d-49a5-9bb3-4b050a7c227a}" status="ok">
+<ping status="ok"/>
+<updatecheck status="ok" _rollback="true">
+<urls>
+<url codebase="http://kam:8080/static/"/>
+</urls>
+<manifest version="1.0.0.0" arguments="--rollback">
+<packages>
+<package name="setup.exe" hash="+LXvjiaPkeYDLHoNKlf9qbJwvnk=" hash_sha256="0VAlQW3RE99SGtSB5R4m08antAHO8XDoBMKDyxQT/Mg=" size="67546213" required="true"/>
+</packages>
+<actions>
+<action event="install"/>
+</actions>
+</manifest>
+</updatecheck>
+</app>
+</response>
+`
+	sampleRequestGoogle = `<?xml version="1.0" encoding="UTF-8"?>
+<request xmlns="http://www.google.com/update2/request" protocol="3.0" version="1.3.33.7" shell_version="1.3.33.5" ismachine="1" sessionid="{5FAD27D4-6BFA-4daa-A1B3-5A1F821FEE0F}" requestid="{C8F6EDF3-B623-4ee6-B2DA-1D08A0B4C665}">
+<os platform="win" version="6.1" sp="" arch="x64"/>
+<app appid="{430FD4D0-B729-4F61-AA34-91526481799D}" version="1.2.23.0" lang="en" brand="GGLS">
+<updatecheck/>
+<ping r="-2"/>
+</app>
+</request>
+`
+	sampleResponseGoogle = `<?xml version="1.0" encoding="UTF-8"?>
+<response xmlns="http://www.google.com/update2/response" protocol="3.0" server="prod">
+<daystart elapsed_seconds="56508" elapsed_days="2557"/>
+<app appid="{430FD4D0-B729-4F61-AA34-91526481799D}" status="ok">
+<updatecheck status="noupdate"/>
+<ping status="ok"/>
+</app>
+</response>
 `
 )
 
@@ -146,7 +199,307 @@ func TestOmahaResponseWithUpdate(t *testing.T) {
 	}
 
 	if !reflect.DeepEqual(parsed, expected) {
-		t.Errorf("parsed != expected\n%s\n%s", parsed, expected)
+		t.Errorf("parsed != expected: %s", pretty.Compare(expected, parsed))
+	}
+}
+
+func TestOmahaRoundTrip(t *testing.T) {
+	for _, sample := range []string{
+		sampleRequest,
+		sampleRequestV31,
+	} {
+		parsed, err := ParseRequest("", strings.NewReader(sample))
+		if err != nil {
+			t.Fatalf("ParseRequest failed: %v", err)
+		}
+
+		raw, err := xml.Marshal(parsed)
+		if err != nil {
+			t.Fatalf("Marshal failed: %v", err)
+		}
+
+		reparsed, err := ParseRequest("", bytes.NewReader(raw))
+		if err != nil {
+			t.Fatalf("ParseRequest failed: %v", err)
+		}
+
+		if !reflect.DeepEqual(parsed, reparsed) {
+			t.Errorf("request round trip failed: %s",
+				pretty.Compare(parsed, reparsed))
+		}
+	}
+
+	for _, sample := range []string{
+		sampleResponse,
+		sampleResponseV31,
+	} {
+		parsed, err := ParseResponse("", strings.NewReader(sample))
+		if err != nil {
+			t.Fatalf("ParseResponse failed: %v", err)
+		}
+
+		raw, err := xml.Marshal(parsed)
+		if err != nil {
+			t.Fatalf("Marshal failed: %v", err)
+		}
+
+		reparsed, err := ParseResponse("", bytes.NewReader(raw))
+		if err != nil {
+			t.Fatalf("ParseResponse failed: %v", err)
+		}
+
+		if !reflect.DeepEqual(parsed, reparsed) {
+			t.Errorf("response round trip failed: %s",
+				pretty.Compare(parsed, reparsed))
+		}
+	}
+}
+
+func TestOmahaResponseV31(t *testing.T) {
+	parsed, err := ParseResponse("", strings.NewReader(sampleResponseV31))
+	if err != nil {
+		t.Fatalf("ParseResponse failed: %v", err)
+	}
+
+	u := parsed.Apps[0].UpdateCheck
+	if !u.Rollback {
+		t.Error("Expected rollback")
+	}
+	if u.Manifest.Arguments != "--rollback" {
+		t.Error("Unexpected arguments", u.Manifest.Arguments)
+	}
+	if u.Manifest.Packages[0].SHA256 != "0VAlQW3RE99SGtSB5R4m08antAHO8XDoBMKDyxQT/Mg=" {
+		t.Error("Unexpected SHA256", u.Manifest.Packages[0].SHA256)
+	}
+
+	// Downgrading to 3.0 must drop the 3.1 attributes.
+	parsed.Protocol = ProtocolV30
+	raw, err := xml.Marshal(parsed)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	for _, attr := range []string{"_rollback", "arguments", "hash_sha256"} {
+		if bytes.Contains(raw, []byte(attr)) {
+			t.Errorf("3.0 response includes %s: %s", attr, raw)
+		}
+	}
+
+	// The original response must not be modified.
+	if !u.Rollback || u.Manifest.Arguments == "" || u.Manifest.Packages[0].SHA256 == "" {
+		t.Error("Marshal modified the response")
+	}
+}
+
+func TestOmahaData(t *testing.T) {
+	const value = `{"brand": "A&B", "expr": "a < b"}`
+
+	req := NewRequest()
+	app := req.AddApp(testAppID, testAppVer)
+	app.AddData(DataNameInstall, "verboselogging")
+	app.AddData(DataNameUntrusted, "")
+
+	raw, err := xml.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsedReq, err := ParseRequest("", bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := pretty.Compare(app.Data, parsedReq.Apps[0].Data); diff != "" {
+		t.Errorf("request round trip failed: %s", diff)
+	}
+
+	resp := NewResponse()
+	appResp := resp.AddApp(testAppID, AppOK)
+	appResp.AddData(DataNameInstall, "verboselogging", value)
+	appResp.AddNoData(DataNameInstall, "missing")
+
+	raw, err = xml.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(raw, []byte("A&amp;B")) || !bytes.Contains(raw, []byte("a &lt; b")) {
+		t.Errorf("data not escaped: %s", raw)
+	}
+	parsedResp, err := ParseResponse("", bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := pretty.Compare(appResp.Data, parsedResp.Apps[0].Data); diff != "" {
+		t.Errorf("response round trip failed: %s", diff)
+	}
+
+	// Apps without data must not gain an element.
+	raw, err = xml.Marshal(nilResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("<data")) {
+		t.Errorf("empty data encoded: %s", raw)
+	}
+}
+
+func TestRequestInstallSource(t *testing.T) {
+	r := NewRequest()
+	raw, err := xml.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("installsource")) {
+		t.Errorf("unset install source included: %s", raw)
+	}
+
+	if r.SetInstallSource(InstallSourceOnDemand) != r {
+		t.Error("SetInstallSource did not return the request")
+	}
+	raw, err = xml.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(raw, []byte(`installsource="ondemandupdate"`)) {
+		t.Errorf("install source missing: %s", raw)
+	}
+
+}
+
+func TestRequestID(t *testing.T) {
+	r := NewRequest()
+	if r.UpdaterVersion != UpdaterVersion {
+		t.Errorf("unexpected updaterversion %q", r.UpdaterVersion)
+	}
+	for _, id := range []string{r.RequestID, r.SessionID} {
+		if !strings.HasPrefix(id, "{") || !strings.HasSuffix(id, "}") {
+			t.Errorf("%q is not a braced GUID", id)
+		}
+		if _, err := uuid.FromString(id); err != nil {
+			t.Errorf("%q is not a UUID: %v", id, err)
+		}
+	}
+	if r.RequestID == r.SessionID {
+		t.Errorf("generated IDs are not unique: %q", r.RequestID)
+	}
+
+	r.SetRequestID("").SetSessionID("")
+	if r.RequestID == "" || r.SessionID == "" {
+		t.Error("blank IDs not replaced")
+	}
+
+	r.SetRequestID("{C8F6EDF3-B623-4ee6-B2DA-1D08A0B4C665}")
+	if r.RequestID != "{C8F6EDF3-B623-4ee6-B2DA-1D08A0B4C665}" {
+		t.Errorf("RequestID not overridden: %q", r.RequestID)
+	}
+}
+
+func TestManifestDeltaAction(t *testing.T) {
+	m := &Manifest{Version: "1.1.0"}
+	full := m.AddAction("postinstall")
+	delta := m.AddAction("postinstall")
+	delta.IsDeltaPayload = true
+	delta.PreviousVersion = "1.0.0"
+
+	if a, ok := m.FullAction(); !ok || a != full {
+		t.Errorf("FullAction returned %#v", a)
+	}
+
+	if a, ok := m.DeltaActionFrom("1.0.0"); !ok || a != delta {
+		t.Errorf("DeltaActionFrom(1.0.0) returned %#v", a)
+	}
+
+	for _, v := range []string{"", "0.9.0", "1.1.0"} {
+		if a, ok := m.DeltaActionFrom(v); ok {
+			t.Errorf("DeltaActionFrom(%q) returned %#v", v, a)
+		}
+	}
+
+	m.Actions = m.Actions[1:]
+	if a, ok := m.FullAction(); ok {
+		t.Errorf("FullAction returned %#v", a)
+	}
+}
+
+func TestManifestAction(t *testing.T) {
+	m := &Manifest{Version: "1.1.0"}
+	events := []string{
+		ActionEventPreInstall,
+		ActionEventInstall,
+		ActionEventPostInstall,
+		ActionEventUpdate,
+	}
+	var actions []*Action
+	for _, event := range events {
+		actions = append(actions, m.AddAction(event))
+	}
+	second := m.AddAction(ActionEventPostInstall)
+
+	for i, event := range events {
+		if m.Actions[i].Event != event {
+			t.Errorf("action %d is %q, not %q", i, m.Actions[i].Event, event)
+		}
+		if a, ok := m.Action(event); !ok || a != actions[i] {
+			t.Errorf("Action(%q) returned %#v", event, a)
+		}
+	}
+	if m.Actions[4] != second {
+		t.Errorf("duplicate action not appended")
+	}
+
+	if a, ok := m.Action("bogus"); ok {
+		t.Errorf("Action(bogus) returned %#v", a)
+	}
+}
+
+func TestActionPayloadBackoff(t *testing.T) {
+	for _, tt := range []struct {
+		attr     string
+		disabled bool
+	}{
+		{``, false},
+		{` DisablePayloadBackoff="false"`, false},
+		{` DisablePayloadBackoff="true"`, true},
+	} {
+		m := &Manifest{}
+		raw := `<manifest><actions><action event="postinstall"` + tt.attr + `></action></actions></manifest>`
+		if err := xml.Unmarshal([]byte(raw), m); err != nil {
+			t.Fatal(err)
+		}
+		a, _ := m.Action(ActionEventPostInstall)
+		if a.PayloadBackoffDisabled() != tt.disabled {
+			t.Errorf("%q: expected disabled %v", tt.attr, tt.disabled)
+		}
+	}
+
+	var a *Action
+	if a.PayloadBackoffDisabled() {
+		t.Error("nil action disabled backoff")
+	}
+}
+
+func TestActionDeadline(t *testing.T) {
+	for _, tt := range []struct {
+		deadline string
+		duration time.Duration
+		ok       bool
+	}{
+		{"", 0, false},
+		{"now", 0, true},
+		{"0", 0, true},
+		{"3600", time.Hour, true},
+		{"-1", 0, false},
+		{"tomorrow", 0, false},
+	} {
+		a := Action{Deadline: tt.deadline}
+		d, ok := a.DeadlineDuration()
+		if d != tt.duration || ok != tt.ok {
+			t.Errorf("%q parsed to %v, %t", tt.deadline, d, ok)
+		}
+
+		u := UpdateResponse{Status: UpdateOK, Manifest: &Manifest{}}
+		u.Manifest.Actions = append(u.Manifest.Actions, &a)
+		if u.IsMandatory() != tt.ok {
+			t.Errorf("%q mandatory is %t", tt.deadline, u.IsMandatory())
+		}
 	}
 }
 
@@ -216,6 +569,9 @@ func ExampleNewResponse() {
 func ExampleNewRequest() {
 	request := NewRequest()
 	request.Version = ""
+	request.UpdaterVersion = ""
+	request.SessionID = ""
+	request.RequestID = ""
 	request.OS = &OS{
 		Platform:    "Chrome OS",
 		Version:     "Indy",
@@ -238,10 +594,207 @@ func ExampleNewRequest() {
 	// Output:
 	// <?xml version="1.0" encoding="UTF-8"?>
 	// <request protocol="3.0">
-	//  <os platform="Chrome OS" version="Indy" sp="ForcedUpdate_x86_64"></os>
+	//  <os version="Indy" platform="Chrome OS" sp="ForcedUpdate_x86_64"></os>
 	//  <app appid="{27BD862E-8AE8-4886-A055-F7F1A6460627}" version="1.0.0.0">
 	//   <updatecheck></updatecheck>
 	//   <event eventtype="1" eventresult="0"></event>
 	//  </app>
 	// </request>
 }
+
+func TestRequestGetApp(t *testing.T) {
+	r := NewRequest()
+	first := r.AddApp("{a}", "1.0.0")
+	r.AddApp("{b}", "1.0.0")
+	r.AddApp("{a}", "2.0.0")
+
+	if app := r.GetApp("{a}"); app != first {
+		t.Errorf("expected first app, got %#v", app)
+	}
+	if app := r.GetApp("{b}"); app == nil || app.ID != "{b}" {
+		t.Errorf("unexpected app %#v", app)
+	}
+	if app := r.GetApp("{c}"); app != nil {
+		t.Errorf("unexpected app %#v", app)
+	}
+}
+
+func TestResponseGetApp(t *testing.T) {
+	r := NewResponse()
+	apps := r.AddApps([]string{"{a}", "{b}", "{a}"}, AppOK)
+	if len(apps) != 3 || len(r.Apps) != 3 {
+		t.Fatalf("expected 3 apps, got %d and %d", len(apps), len(r.Apps))
+	}
+	for i, app := range apps {
+		if app != r.Apps[i] || app.Status != AppOK {
+			t.Errorf("unexpected app %d: %#v", i, app)
+		}
+	}
+
+	if app := r.GetApp("{a}"); app != apps[0] {
+		t.Errorf("expected first app, got %#v", app)
+	}
+	if app := r.GetApp("{b}"); app != apps[1] {
+		t.Errorf("unexpected app %#v", app)
+	}
+	if app := r.GetApp("{c}"); app != nil {
+		t.Errorf("unexpected app %#v", app)
+	}
+}
+
+func TestOmahaNamespace(t *testing.T) {
+	req, err := ParseRequest("", strings.NewReader(sampleRequestGoogle))
+	if err != nil {
+		t.Fatalf("ParseRequest failed: %v", err)
+	}
+	if req.XMLName.Space != GoogleUpdateRequestNamespace {
+		t.Errorf("Unexpected namespace %q", req.XMLName.Space)
+	}
+	if req.ShellVersion != "1.3.33.5" {
+		t.Errorf("Unexpected shell version %q", req.ShellVersion)
+	}
+
+	resp, err := ParseResponse("", strings.NewReader(sampleResponseGoogle))
+	if err != nil {
+		t.Fatalf("ParseResponse failed: %v", err)
+	}
+	if resp.XMLName.Space != GoogleUpdateResponseNamespace {
+		t.Errorf("Unexpected namespace %q", resp.XMLName.Space)
+	}
+	if app := resp.GetApp("{430FD4D0-B729-4F61-AA34-91526481799D}"); app == nil ||
+		app.UpdateCheck == nil || app.UpdateCheck.Status != NoUpdate {
+		t.Errorf("Unexpected response: %s", pretty.Sprint(resp))
+	}
+
+	for _, tt := range []struct {
+		ns     string
+		expect string
+	}{
+		{GoogleUpdateRequestNamespace, `<request xmlns="` + GoogleUpdateRequestNamespace + `" `},
+		{"", `<request protocol=`},
+	} {
+		raw, err := xml.Marshal(req.SetNamespace(tt.ns))
+		if err != nil {
+			t.Fatalf("Marshal failed: %v", err)
+		}
+		if !bytes.HasPrefix(raw, []byte(tt.expect)) {
+			t.Errorf("Expected %q prefix: %s", tt.expect, raw)
+		}
+
+		reparsed, err := ParseRequest("", bytes.NewReader(raw))
+		if err != nil {
+			t.Fatalf("ParseRequest failed: %v", err)
+		}
+		if !reflect.DeepEqual(req, reparsed) {
+			t.Errorf("request round trip failed: %s",
+				pretty.Compare(req, reparsed))
+		}
+	}
+
+	for _, tt := range []struct {
+		ns     string
+		expect string
+	}{
+		{GoogleUpdateResponseNamespace, `<response xmlns="` + GoogleUpdateResponseNamespace + `" `},
+		{"", `<response protocol=`},
+	} {
+		raw, err := xml.Marshal(resp.SetNamespace(tt.ns))
+		if err != nil {
+			t.Fatalf("Marshal failed: %v", err)
+		}
+		if !bytes.HasPrefix(raw, []byte(tt.expect)) {
+			t.Errorf("Expected %q prefix: %s", tt.expect, raw)
+		}
+
+		reparsed, err := ParseResponse("", bytes.NewReader(raw))
+		if err != nil {
+			t.Fatalf("ParseResponse failed: %v", err)
+		}
+		if !reflect.DeepEqual(resp, reparsed) {
+			t.Errorf("response round trip failed: %s",
+				pretty.Compare(resp, reparsed))
+		}
+	}
+}
+
+func TestRequestShapes(t *testing.T) {
+	event := &EventRequest{
+		Type:   EventTypeUpdateDownloadFinished,
+		Result: EventResultSuccess,
+	}
+
+	for _, tt := range []struct {
+		name   string
+		req    *Request
+		expect string
+	}{
+		{"updatecheck", NewUpdateCheckRequest("{a}", "1.0.0"),
+			`<request protocol="3.0"><os platform="test" arch="test"></os><app appid="{a}" version="1.0.0"><ping active="1"></ping><updatecheck></updatecheck></app></request>`},
+		{"ping", NewPingRequest("{a}", "1.0.0"),
+			`<request protocol="3.0"><os platform="test" arch="test"></os><app appid="{a}" version="1.0.0"><ping active="1"></ping></app></request>`},
+		{"event", NewEventRequest("{a}", "1.0.0", event),
+			`<request protocol="3.0"><os platform="test" arch="test"></os><app appid="{a}" version="1.0.0"><event eventtype="14" eventresult="1"></event></app></request>`},
+	} {
+		// Replace the host dependent and generated values.
+		tt.req.OS = &OS{Platform: "test", Arch: "test"}
+		tt.req.UpdaterVersion, tt.req.SessionID, tt.req.RequestID = "", "", ""
+
+		raw, err := xml.Marshal(tt.req)
+		if err != nil {
+			t.Fatalf("%s: Marshal failed: %v", tt.name, err)
+		}
+		if string(raw) != tt.expect {
+			t.Errorf("%s: unexpected XML\ngot:  %s\nwant: %s",
+				tt.name, raw, tt.expect)
+		}
+
+		if err := tt.req.Validate(nil); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
+
+func TestRequestValidate(t *testing.T) {
+	mixed := NewUpdateCheckRequest("{a}", "1.0.0")
+	mixed.Apps[0].AddEvent()
+	if err := mixed.Validate(nil); err == nil {
+		t.Error("mixed request accepted")
+	}
+	if err := mixed.Validate(&ValidateOptions{AllowMixed: true}); err != nil {
+		t.Errorf("mixed request rejected: %v", err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		req  *Request
+	}{
+		{"no apps", NewRequest()},
+		{"no id", NewPingRequest("", "1.0.0")},
+		{"bad protocol", &Request{Protocol: "2.0", Apps: []*AppRequest{{ID: "{a}"}}}},
+		{"bad install source", NewPingRequest("{a}", "1.0.0").SetInstallSource("bogus")},
+	} {
+		if err := tt.req.Validate(&ValidateOptions{AllowMixed: true}); err == nil {
+			t.Errorf("%s: request accepted", tt.name)
+		}
+	}
+}
+
+func TestNewPingRequest(t *testing.T) {
+	req := NewPingRequest("{a}", "1.0.0")
+	req.Apps[0].Ping.LastReportDays = 3
+
+	raw, err := xml.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(raw, []byte("<updatecheck")) {
+		t.Errorf("ping request includes an update check: %s", raw)
+	}
+	if bytes.Contains(raw, []byte("<event")) {
+		t.Errorf("ping request includes an event: %s", raw)
+	}
+	if !bytes.Contains(raw, []byte(`<ping active="1" r="3">`)) {
+		t.Errorf("ping request is missing the ping: %s", raw)
+	}
+}
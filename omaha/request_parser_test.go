@@ -0,0 +1,250 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+const sampleRequestMulti = `<?xml version="1.0" encoding="UTF-8"?>
+<request protocol="3.0" ismachine=" 1 " minimalack="true">
+<!-- comments and unknown elements are ignored -->
+<unknown><app appid="nested"/></unknown>
+<app appid="{a}" version="1.0.0" delta_okay="true" hardware_class="">
+<ping active="1" a="" r="3"><unknown/></ping>
+<updatecheck targetversionprefix="1." rollback_allowed="1"></updatecheck>
+<event eventtype="3" eventresult="0" errorcode="2503"></event>
+<event eventtype="13" eventresult="1" previousversion="0.9.0"></event>
+<data name="install" index="verbose">A&amp;B <![CDATA[a < b]]><x>skipped</x></data>
+</app>
+<app appid="{b}" version="2.0.0"><event eventtype="14" eventresult="1"/></app>
+<os platform="first"/>
+<os version="second"/>
+</request>
+`
+
+func parserSamples(t *testing.T) []string {
+	samples := []string{
+		sampleRequest,
+		sampleRequestV31,
+		sampleRequestGoogle,
+		sampleRequestMulti,
+		`<request protocol="3.0"></request>`,
+	}
+	for _, tt := range goldenCaptures {
+		if tt.response {
+			continue
+		}
+		raw, err := ioutil.ReadFile(filepath.Join("..", "fixtures", tt.capture))
+		if err != nil {
+			t.Fatal(err)
+		}
+		samples = append(samples, string(raw))
+	}
+	return samples
+}
+
+func TestRequestParserRoundTrip(t *testing.T) {
+	samples := parserSamples(t)
+	p := NewRequestParser()
+	reused := &Request{}
+
+	// Go through the samples twice, in different orders, so each
+	// is parsed into a Request left over from another.
+	for i := 0; i < 2*len(samples); i++ {
+		sample := samples[(i*3)%len(samples)]
+		expected, err := ParseRequest("", strings.NewReader(sample))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := p.ParseInto("", strings.NewReader(sample), reused); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(expected, reused) {
+			t.Errorf("ParseInto differs from ParseRequest: %s",
+				pretty.Compare(expected, reused))
+		}
+
+		// The result must survive the usual round trip too.
+		raw, err := xml.Marshal(reused)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reparsed, err := p.Parse("", strings.NewReader(string(raw)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(reused, reparsed) {
+			t.Errorf("request round trip failed: %s",
+				pretty.Compare(reused, reparsed))
+		}
+	}
+}
+
+func TestRequestParserErrors(t *testing.T) {
+	p := NewRequestParser()
+	for _, tt := range []struct {
+		contentType string
+		body        string
+	}{
+		{"", ""},
+		{"", `<response protocol="3.0"></response>`},
+		{"", `<request protocol="2.0"></request>`},
+		{"", `<request protocol="3.0" ismachine="yes"></request>`},
+		{"", `<request protocol="3.0"><app><ping r="x"/></app></request>`},
+		{"", `<request protocol="3.0"><app><event eventtype="x"/></app></request>`},
+		{"", `<request protocol="3.0"><app></request>`},
+		{"", invalidUTF8Request},
+		{"application/json", `<request protocol="3.0"></request>`},
+	} {
+		_, expected := ParseRequest(tt.contentType, strings.NewReader(tt.body))
+		_, err := p.Parse(tt.contentType, strings.NewReader(tt.body))
+		if expected == nil || err == nil {
+			t.Errorf("%q: expected errors, got %v and %v", tt.body, expected, err)
+		} else if err.Error() != expected.Error() {
+			t.Errorf("%q: expected error %q, not %q", tt.body, expected, err)
+		}
+	}
+}
+
+func BenchmarkParseRequest(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := ParseRequest("", strings.NewReader(sampleRequest)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRequestParser(b *testing.B) {
+	b.ReportAllocs()
+	p := NewRequestParser()
+	r := &Request{}
+	for i := 0; i < b.N; i++ {
+		if err := p.ParseInto("", strings.NewReader(sampleRequest), r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMarshalRequest(b *testing.B) {
+	r, err := ParseRequest("", strings.NewReader(sampleRequest))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := xml.Marshal(r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// fillAttrs sets every XML attribute and character data field of the
+// struct v, and of the structs it holds, to a distinct non-zero value.
+// Slices get two elements so repeated elements are covered.
+func fillAttrs(t *testing.T, v reflect.Value, n *int) {
+	typ := v.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		f, field := typ.Field(i), v.Field(i)
+		tag := f.Tag.Get("xml")
+		switch {
+		case f.Name == "XMLName":
+		case strings.HasSuffix(tag, ",chardata") || strings.Contains(tag, ",attr"):
+			*n++
+			setAttr(t, f.Name, field, *n)
+		case field.Kind() == reflect.Ptr && field.Type().Elem().Kind() == reflect.Struct:
+			field.Set(reflect.New(field.Type().Elem()))
+			fillAttrs(t, field.Elem(), n)
+		case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Ptr:
+			elems := reflect.MakeSlice(field.Type(), 2, 2)
+			for j := 0; j < elems.Len(); j++ {
+				elems.Index(j).Set(reflect.New(field.Type().Elem().Elem()))
+				fillAttrs(t, elems.Index(j).Elem(), n)
+			}
+			field.Set(elems)
+		default:
+			t.Fatalf("%s.%s: unsupported field", typ.Name(), f.Name)
+		}
+	}
+}
+
+func setAttr(t *testing.T, name string, field reflect.Value, n int) {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(fmt.Sprintf("value-%d", n))
+	case reflect.Int:
+		field.SetInt(int64(n))
+	case reflect.Bool:
+		field.SetBool(true)
+	case reflect.Ptr:
+		p := reflect.New(field.Type().Elem())
+		setAttr(t, name, p.Elem(), n)
+		field.Set(p)
+	default:
+		t.Fatalf("%s: unsupported attribute kind %s", name, field.Kind())
+	}
+}
+
+// TestRequestParserAllAttrs catches fields added to the request types
+// but not to the hand written decoder.
+func TestRequestParserAllAttrs(t *testing.T) {
+	var n int
+	filled := &Request{}
+	fillAttrs(t, reflect.ValueOf(filled).Elem(), &n)
+	filled.XMLName = xml.Name{Local: "request"}
+	filled.Protocol = ProtocolV31
+
+	raw, err := xml.Marshal(filled)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &Request{}
+	if err := xml.Unmarshal(raw, expected); err != nil {
+		t.Fatal(err)
+	}
+	if diff := pretty.Compare(filled, expected); diff != "" {
+		t.Fatalf("attributes lost by encoding/xml: %s", diff)
+	}
+
+	parsed, err := NewRequestParser().Parse("", strings.NewReader(string(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expected, parsed) {
+		t.Errorf("RequestParser differs from xml.Unmarshal: %s",
+			pretty.Compare(expected, parsed))
+	}
+
+	parsed, err = ParseRequest("", strings.NewReader(string(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expected, parsed) {
+		t.Errorf("ParseRequest differs from xml.Unmarshal: %s",
+			pretty.Compare(expected, parsed))
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+)
+
+// ResponseBuilder assembles a Response one app at a time:
+//
+//	resp, err := omaha.BuildResponse().
+//		App("{id}").Update("2.0.0").
+//		URL("https://example.com/2.0.0/").
+//		Package("update.gz", size, sha256sum).SHA1(sha1sum).Done().
+//		App("{other}").NoUpdate().Done().
+//		Build()
+//
+// Mistakes such as an update without a package are reported by Build
+// instead of producing a response clients cannot use.
+type ResponseBuilder struct {
+	resp *Response
+	err  error
+}
+
+// AppBuilder adds elements to a single app in a ResponseBuilder.
+type AppBuilder struct {
+	b   *ResponseBuilder
+	app *AppResponse
+}
+
+func BuildResponse() *ResponseBuilder {
+	return &ResponseBuilder{resp: NewResponse()}
+}
+
+// Protocol sets the protocol version of the response, ProtocolV30 by
+// default. Version 3.0 clients need every package's SHA-1 digest.
+func (b *ResponseBuilder) Protocol(version string) *ResponseBuilder {
+	if version != ProtocolV30 && version != ProtocolV31 {
+		if b.err == nil {
+			b.err = fmt.Errorf("omaha: unsupported protocol %q", version)
+		}
+		return b
+	}
+	b.resp.Protocol = version
+	return b
+}
+
+// App adds an app with status ok.
+func (b *ResponseBuilder) App(id string) *AppBuilder {
+	return &AppBuilder{b: b, app: b.resp.AddApp(id, AppOK)}
+}
+
+// Build checks and returns the response. The builder must not be
+// used afterwards.
+func (b *ResponseBuilder) Build() (*Response, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	for _, app := range b.resp.Apps {
+		if err := checkAppResponse(b.resp.Protocol, app); err != nil {
+			return nil, err
+		}
+	}
+	return b.resp, nil
+}
+
+func checkAppResponse(protocol string, app *AppResponse) error {
+	u := app.UpdateCheck
+	if u == nil || u.Status != UpdateOK {
+		return nil
+	}
+	if u.Manifest == nil {
+		return fmt.Errorf("omaha: app %q: update has no manifest", app.ID)
+	}
+	if len(u.URLs) == 0 {
+		return fmt.Errorf("omaha: app %q: update has no URLs", app.ID)
+	}
+	if len(u.Manifest.Packages) == 0 {
+		return fmt.Errorf("omaha: app %q: update has no packages", app.ID)
+	}
+	// hash_sha256 is dropped when encoding 3.0 responses.
+	if protocol != ProtocolV31 {
+		for _, pkg := range u.Manifest.Packages {
+			if pkg.SHA1 == "" {
+				return fmt.Errorf("omaha: app %q: package %q has no SHA-1 digest for protocol %s",
+					app.ID, pkg.Name, protocol)
+			}
+		}
+	}
+	return nil
+}
+
+// fail records the first error for Build to return.
+func (a *AppBuilder) fail(format string, args ...interface{}) *AppBuilder {
+	if a.b.err == nil {
+		args = append([]interface{}{a.app.ID}, args...)
+		a.b.err = fmt.Errorf("omaha: app %q: "+format, args...)
+	}
+	return a
+}
+
+// Status overrides the app status, e.g. AppUnknownID.
+func (a *AppBuilder) Status(status AppStatus) *AppBuilder {
+	a.app.Status = status
+	return a
+}
+
+// Update offers version to the client. URL and Package must follow.
+func (a *AppBuilder) Update(version string) *AppBuilder {
+	if a.app.UpdateCheck != nil {
+		return a.fail("duplicate updatecheck")
+	}
+	a.app.AddUpdateCheck(UpdateOK).AddManifest(version)
+	return a
+}
+
+// NoUpdate responds to the update check with noupdate.
+func (a *AppBuilder) NoUpdate() *AppBuilder {
+	if a.app.UpdateCheck != nil {
+		return a.fail("duplicate updatecheck")
+	}
+	a.app.AddUpdateCheck(NoUpdate)
+	return a
+}
+
+// updateManifest returns the manifest added by Update, if any.
+func (a *AppBuilder) updateManifest() *Manifest {
+	if u := a.app.UpdateCheck; u != nil && u.Status == UpdateOK {
+		return u.Manifest
+	}
+	return nil
+}
+
+// URL adds a codebase the update's packages can be downloaded from.
+func (a *AppBuilder) URL(codebase string) *AppBuilder {
+	if a.updateManifest() == nil {
+		return a.fail("URL %q without an update", codebase)
+	}
+	a.app.UpdateCheck.AddURL(codebase)
+	return a
+}
+
+// Package adds a required package to the update given its size and
+// SHA-256 digest. Protocol 3.0 clients only understand SHA-1 so unless
+// the response is for protocol 3.1 SHA1 must be called too, otherwise
+// Build fails. The first package's SHA-256 digest also goes in an
+// update_engine style postinstall action, where 3.0 clients read it.
+func (a *AppBuilder) Package(name string, size uint64, sum []byte) *AppBuilder {
+	m := a.updateManifest()
+	if m == nil {
+		return a.fail("package %q without an update", name)
+	}
+	if len(sum) != sha256.Size {
+		return a.fail("package %q: invalid SHA-256 digest", name)
+	}
+	pkg := m.AddPackage()
+	pkg.Name = name
+	pkg.Size = PackageSize(size)
+	pkg.SHA256 = encodeHash(sum)
+	pkg.Required = true
+
+	if _, ok := m.Action(ActionEventPostInstall); !ok {
+		act := m.AddAction(ActionEventPostInstall)
+		act.SHA256 = pkg.SHA256
+	}
+	return a
+}
+
+// SHA1 sets the SHA-1 digest of the package added last.
+func (a *AppBuilder) SHA1(sum []byte) *AppBuilder {
+	m := a.updateManifest()
+	if m == nil || len(m.Packages) == 0 {
+		return a.fail("SHA-1 digest without a package")
+	}
+	if len(sum) != sha1.Size {
+		return a.fail("package %q: invalid SHA-1 digest", m.Packages[len(m.Packages)-1].Name)
+	}
+	m.Packages[len(m.Packages)-1].SHA1 = encodeHash(sum)
+	return a
+}
+
+// Ping acknowledges the app's ping.
+func (a *AppBuilder) Ping() *AppBuilder {
+	a.app.AddPing()
+	return a
+}
+
+// Events acknowledges n events.
+func (a *AppBuilder) Events(n int) *AppBuilder {
+	for i := 0; i < n; i++ {
+		a.app.AddEvent()
+	}
+	return a
+}
+
+// Done returns to the ResponseBuilder to add another app or build.
+func (a *AppBuilder) Done() *ResponseBuilder {
+	return a.b
+}
@@ -0,0 +1,181 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestBuildResponse(t *testing.T) {
+	sum1 := sha1.Sum([]byte("update"))
+	sum256 := sha256.Sum256([]byte("update"))
+
+	expected := NewResponse()
+	a := expected.AddApp("{a}", AppOK)
+	a.AddPing()
+	u := a.AddUpdateCheck(UpdateOK)
+	u.AddURL("https://example.com/1/")
+	u.AddURL("https://example.com/2/")
+	m := u.AddManifest("2.0.0")
+	pkg := m.AddPackage()
+	pkg.Name = "update.gz"
+	pkg.Size = 42
+	pkg.SHA1 = encodeHash(sum1[:])
+	pkg.SHA256 = encodeHash(sum256[:])
+	pkg.Required = true
+	m.AddAction(ActionEventPostInstall).SHA256 = pkg.SHA256
+	b := expected.AddApp("{b}", AppOK)
+	b.AddUpdateCheck(NoUpdate)
+	b.AddEvent()
+	b.AddEvent()
+	expected.AddApp("{c}", AppUnknownID)
+
+	resp, err := BuildResponse().
+		App("{a}").Ping().Update("2.0.0").
+		URL("https://example.com/1/").
+		URL("https://example.com/2/").
+		Package("update.gz", 42, sum256[:]).SHA1(sum1[:]).Done().
+		App("{b}").NoUpdate().Events(2).Done().
+		App("{c}").Status(AppUnknownID).Done().
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := pretty.Compare(expected, resp); diff != "" {
+		t.Errorf("unexpected response: %s", diff)
+	}
+}
+
+func TestBuildResponseV30Payload(t *testing.T) {
+	sum1 := sha1.Sum([]byte("update"))
+	sum256 := sha256.Sum256([]byte("update"))
+	built, err := BuildResponse().
+		App("{a}").Update("2.0.0").
+		URL("https://example.com/").
+		Package("update.gz", 42, sum256[:]).SHA1(sum1[:]).Done().
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := xml.Marshal(built)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ParseResponse("", bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := resp.Apps[0].UpdateCheck
+	p, err := u.Payload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Name != "update.gz" || p.Size != 42 || p.SHA1 != encodeHash(sum1[:]) ||
+		p.SHA256 != encodeHash(sum256[:]) {
+		t.Errorf("unexpected payload %+v", p)
+	}
+	// 3.0 carries the SHA-256 digest only in the postinstall action.
+	if act, _ := u.Manifest.Action(ActionEventPostInstall); act.SHA256 != encodeHash(sum256[:]) {
+		t.Errorf("unexpected postinstall action %+v", act)
+	}
+}
+
+func TestBuildResponseV31(t *testing.T) {
+	sum := sha256.Sum256([]byte("update"))
+	resp, err := BuildResponse().Protocol(ProtocolV31).
+		App("{a}").Update("2.0.0").
+		URL("https://example.com/").
+		Package("update.gz", 42, sum[:]).Done().
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Protocol != ProtocolV31 {
+		t.Errorf("unexpected protocol %q", resp.Protocol)
+	}
+	if pkg := resp.Apps[0].UpdateCheck.Manifest.Packages[0]; pkg.SHA256 != encodeHash(sum[:]) {
+		t.Errorf("unexpected package %+v", pkg)
+	}
+}
+
+func TestBuildResponseInvalid(t *testing.T) {
+	sum := sha256.Sum256([]byte("update"))
+	for _, tt := range []struct {
+		name string
+		b    *ResponseBuilder
+		err  string
+	}{
+		{
+			name: "no url",
+			b:    BuildResponse().App("{a}").Update("2.0.0").Package("a", 1, sum[:]).Done(),
+			err:  "update has no URLs",
+		},
+		{
+			name: "no package",
+			b:    BuildResponse().App("{a}").Update("2.0.0").URL("https://example.com/").Done(),
+			err:  "update has no packages",
+		},
+		{
+			name: "package without update",
+			b:    BuildResponse().App("{a}").NoUpdate().Package("a", 1, sum[:]).Done(),
+			err:  `package "a" without an update`,
+		},
+		{
+			name: "short digest",
+			b:    BuildResponse().App("{a}").Update("2.0.0").Package("a", 1, sum[:20]).Done(),
+			err:  "invalid SHA-256 digest",
+		},
+		{
+			// 3.0 encoding drops hash_sha256 leaving no digest.
+			name: "no SHA-1",
+			b: BuildResponse().App("{a}").Update("2.0.0").
+				URL("https://example.com/").Package("a", 1, sum[:]).Done(),
+			err: `package "a" has no SHA-1 digest for protocol 3.0`,
+		},
+		{
+			name: "unknown protocol",
+			b:    BuildResponse().Protocol("2.0"),
+			err:  `unsupported protocol "2.0"`,
+		},
+		{
+			name: "two updatechecks",
+			b:    BuildResponse().App("{a}").NoUpdate().Update("2.0.0").Done(),
+			err:  "duplicate updatecheck",
+		},
+		{
+			// Only the second app is broken.
+			name: "second app",
+			b: BuildResponse().
+				App("{a}").NoUpdate().Done().
+				App("{b}").Update("2.0.0").Done(),
+			err: `app "{b}": update has no URLs`,
+		},
+	} {
+		resp, err := tt.b.Build()
+		if err == nil {
+			t.Errorf("%s: expected error, got %+v", tt.name, resp)
+		} else if !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: expected error containing %q, not %q", tt.name, tt.err, err)
+		}
+	}
+}
@@ -27,10 +27,11 @@ func NewServer(addr string, updater Updater) (*Server, error) {
 
 	mux := http.NewServeMux()
 
-	srv := &http.Server{
-		Addr:    addr,
-		Handler: mux,
-	}
+	srv := NewHTTPServer(mux, nil)
+	srv.Addr = addr
+	// Mux may also serve packages, as TrivialServer does, which can
+	// take far longer to download than an Omaha exchange takes.
+	srv.WriteTimeout = 0
 
 	s := &Server{
 		Updater: updater,
@@ -39,9 +40,9 @@ func NewServer(addr string, updater Updater) (*Server, error) {
 		srv:     srv,
 	}
 
-	h := &OmahaHandler{s}
-	mux.Handle("/v1/update", h)
-	mux.Handle("/v1/update/", h)
+	s.Handler = &OmahaHandler{Updater: s}
+	mux.Handle("/v1/update", s.Handler)
+	mux.Handle("/v1/update/", s.Handler)
 
 	return s, nil
 }
@@ -49,12 +50,23 @@ func NewServer(addr string, updater Updater) (*Server, error) {
 type Server struct {
 	Updater
 
-	Mux *http.ServeMux
+	Mux     *http.ServeMux
+	Handler *OmahaHandler
 
 	l   net.Listener
 	srv *http.Server
 }
 
+// CheckUpdateMeta forwards to the embedded Updater's CheckUpdateMeta if
+// it is a MetaUpdater, or CheckUpdate otherwise, so Handler reaches
+// whichever Updater the Server currently holds.
+func (s *Server) CheckUpdateMeta(meta *RequestMeta, req *Request, app *AppRequest) (*Update, error) {
+	if mu, ok := s.Updater.(MetaUpdater); ok {
+		return mu.CheckUpdateMeta(meta, req, app)
+	}
+	return s.Updater.CheckUpdate(req, app)
+}
+
 func (s *Server) Serve() error {
 	err := s.srv.Serve(s.l)
 	if isClosed(err) {
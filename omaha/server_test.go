@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"encoding/xml"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"sync"
 	"testing"
@@ -112,3 +113,99 @@ func TestServerRequestResponse(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+// codebaseUpdater is a plain Updater offering an update at codebase.
+type codebaseUpdater struct {
+	UpdaterStub
+	codebase string
+}
+
+func (c codebaseUpdater) CheckUpdate(req *Request, app *AppRequest) (*Update, error) {
+	u := &Update{ID: app.ID, URL: URL{CodeBase: c.codebase}}
+	u.Version = "1.1.0"
+	return u, nil
+}
+
+func TestServerUpdaters(t *testing.T) {
+	s, err := NewServer("127.0.0.1:0", UpdaterStub{})
+	if err != nil {
+		t.Fatalf("failed to create omaha server: %v", err)
+	}
+	go s.Serve()
+	defer s.Destroy()
+
+	// Replacing the Server's Updater takes effect immediately.
+	m := &mirrorUpdater{}
+	for _, tt := range []struct {
+		name     string
+		updater  Updater
+		codebase string
+	}{
+		{"relative", codebaseUpdater{codebase: "/packages/"}, fmt.Sprintf("http://%s/packages/", s.Addr())},
+		{"absolute", codebaseUpdater{codebase: "https://mirror.example.com/1.1.0/"}, "https://mirror.example.com/1.1.0/"},
+		{"meta", m, "https://mirror.example.com/1.1.0/"},
+	} {
+		s.Updater = tt.updater
+
+		buf, err := mkUpdateReq()
+		if err != nil {
+			t.Fatal(err)
+		}
+		endpoint := fmt.Sprintf("http://%s/v1/update/", s.Addr())
+		res, err := http.Post(endpoint, "text/xml", buf)
+		if err != nil {
+			t.Fatalf("%s: failed to post: %v", tt.name, err)
+		}
+		resp, err := ParseResponse(res.Header.Get("Content-Type"), res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		u := resp.Apps[0].UpdateCheck
+		if u == nil || u.Status != UpdateOK || len(u.URLs) != 1 || u.URLs[0].CodeBase != tt.codebase {
+			t.Errorf("%s: unexpected update %+v", tt.name, u)
+		}
+	}
+	if m.meta == nil || m.meta.ClientIP == nil {
+		t.Errorf("MetaUpdater not called with metadata: %+v", m.meta)
+	}
+}
+
+func TestServerSlowDownload(t *testing.T) {
+	s, err := NewServer("127.0.0.1:0", UpdaterStub{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.srv.WriteTimeout != 0 {
+		t.Errorf("WriteTimeout is %v", s.srv.WriteTimeout)
+	}
+	// Shrink the remaining exchange timeouts so the download below
+	// outlasts them.
+	s.srv.ReadHeaderTimeout = 100 * time.Millisecond
+	s.srv.ReadTimeout = 100 * time.Millisecond
+
+	const chunks = 5
+	s.Mux.HandleFunc("/packages/update.gz", func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < chunks; i++ {
+			w.Write(bytes.Repeat([]byte{'x'}, 1024))
+			w.(http.Flusher).Flush()
+			time.Sleep(100 * time.Millisecond)
+		}
+	})
+	go s.Serve()
+	defer s.Destroy()
+
+	res, err := http.Get(fmt.Sprintf("http://%s/packages/update.gz", s.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("download cut off after %d bytes: %v", len(body), err)
+	}
+	if len(body) != chunks*1024 {
+		t.Errorf("downloaded %d bytes", len(body))
+	}
+}
@@ -18,8 +18,6 @@ import (
 	"fmt"
 	"net/http"
 	"path"
-
-	"github.com/blang/semver"
 )
 
 const pkg_prefix = "/packages/"
@@ -35,17 +33,12 @@ func (tu *trivialUpdater) CheckUpdate(req *Request, app *AppRequest) (*Update, e
 		return nil, NoUpdate
 	}
 
-	v1, err := semver.Make(app.Version)
-	if err != nil {
-		return nil, err
-	}
-
-	v2, err := semver.Make(tu.Manifest.Version)
+	needed, err := app.NeedsUpdate(tu.Manifest.Version)
 	if err != nil {
 		return nil, err
 	}
 
-	if v1.LT(v2) {
+	if needed {
 		return &tu.Update, nil
 	}
 
@@ -107,7 +100,7 @@ func (ts *TrivialServer) AddPackage(file, name string) error {
 	// Insert the update_engine style postinstall action if
 	// this is the first (and probably only) package.
 	if len(ts.tu.Manifest.Actions) == 0 {
-		act := ts.tu.Manifest.AddAction("postinstall")
+		act := ts.tu.Manifest.AddAction(ActionEventPostInstall)
 		act.DisablePayloadBackoff = true
 		act.SHA256 = pkg.SHA256
 	}
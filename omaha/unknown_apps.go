@@ -0,0 +1,133 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// UnknownAppCache remembers app IDs the Updater rejected as unknown so
+// repeated requests for them do not reach the Updater. Entries expire
+// after a TTL and the least recently used are evicted when full.
+// Anything registering new apps should call Forget for their IDs.
+type UnknownAppCache struct {
+	ttl     time.Duration
+	size    int
+	now     func() time.Time
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+
+	// gen changes whenever an entry is forgotten so lookups that
+	// raced with Forget are not added afterwards.
+	gen uint64
+
+	hits   uint64
+	misses uint64
+}
+
+type unknownApp struct {
+	id      string
+	expires time.Time
+}
+
+// UnknownAppCacheStats counts cache lookups for metrics.
+type UnknownAppCacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int
+}
+
+// NewUnknownAppCache creates a cache holding up to size app IDs for ttl.
+func NewUnknownAppCache(ttl time.Duration, size int) *UnknownAppCache {
+	if size <= 0 {
+		panic("omaha: unknown app cache size must be positive")
+	}
+	return &UnknownAppCache{
+		ttl:     ttl,
+		size:    size,
+		now:     time.Now,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// lookup reports whether id is cached as unknown, returning the
+// generation to pass to add otherwise.
+func (c *UnknownAppCache) lookup(id string) (bool, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[id]; ok {
+		if c.now().Before(e.Value.(*unknownApp).expires) {
+			c.lru.MoveToFront(e)
+			c.hits++
+			return true, c.gen
+		}
+		c.remove(e)
+	}
+	c.misses++
+	return false, c.gen
+}
+
+// add caches id as unknown unless Forget was called since lookup.
+func (c *UnknownAppCache) add(id string, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+
+	expires := c.now().Add(c.ttl)
+	if e, ok := c.entries[id]; ok {
+		e.Value.(*unknownApp).expires = expires
+		c.lru.MoveToFront(e)
+		return
+	}
+
+	c.entries[id] = c.lru.PushFront(&unknownApp{id: id, expires: expires})
+	if c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *UnknownAppCache) remove(e *list.Element) {
+	c.lru.Remove(e)
+	delete(c.entries, e.Value.(*unknownApp).id)
+}
+
+// Forget removes ids from the cache, for use when apps are registered.
+func (c *UnknownAppCache) Forget(ids ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for _, id := range ids {
+		if e, ok := c.entries[id]; ok {
+			c.remove(e)
+		}
+	}
+}
+
+// Stats returns the number of lookups that hit and missed the cache.
+func (c *UnknownAppCache) Stats() UnknownAppCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return UnknownAppCacheStats{
+		Hits:    c.hits,
+		Misses:  c.misses,
+		Entries: c.lru.Len(),
+	}
+}
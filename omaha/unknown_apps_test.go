@@ -0,0 +1,151 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// registry only knows registered apps. If block is set CheckApp waits
+// on it after deciding an app is unknown.
+type registry struct {
+	UpdaterStub
+	mu      sync.Mutex
+	apps    map[string]bool
+	checks  int
+	checked chan struct{}
+	block   chan struct{}
+}
+
+func (r *registry) CheckApp(req *Request, app *AppRequest) error {
+	r.mu.Lock()
+	r.checks++
+	known := r.apps[app.ID]
+	block := r.block
+	r.mu.Unlock()
+
+	if block != nil {
+		r.checked <- struct{}{}
+		<-block
+	}
+	if !known {
+		return AppUnknownID
+	}
+	return nil
+}
+
+func (r *registry) register(c *UnknownAppCache, id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.apps[id] = true
+	c.Forget(id)
+}
+
+func (r *registry) numChecks() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.checks
+}
+
+func checkAppStatus(t *testing.T, o *OmahaHandler, id, installSource string, expected AppStatus) {
+	req := NewRequest()
+	req.InstallSource = installSource
+	req.AddApp(id, testAppVer)
+	resp, _, _ := o.serveRequest(&RequestMeta{}, req)
+	if status := resp.Apps[0].Status; status != expected {
+		t.Errorf("%s: expected status %q, not %q", id, expected, status)
+	}
+}
+
+func TestUnknownAppCache(t *testing.T) {
+	r := &registry{apps: make(map[string]bool)}
+	cache := NewUnknownAppCache(time.Minute, 2)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	o := &OmahaHandler{Updater: r, UnknownApps: cache}
+
+	checkAppStatus(t, o, "{typo}", InstallSourceScheduled, AppUnknownID)
+	checkAppStatus(t, o, "{typo}", InstallSourceScheduled, AppUnknownID)
+	if n := r.numChecks(); n != 1 {
+		t.Errorf("expected 1 check, not %d", n)
+	}
+	if s := cache.Stats(); s.Hits != 1 || s.Misses != 1 || s.Entries != 1 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+
+	// Interactive requests bypass the cache.
+	checkAppStatus(t, o, "{typo}", InstallSourceOnDemand, AppUnknownID)
+	if n := r.numChecks(); n != 2 {
+		t.Errorf("expected 2 checks, not %d", n)
+	}
+
+	// Registration invalidates the cached miss.
+	r.register(cache, "{typo}")
+	checkAppStatus(t, o, "{typo}", InstallSourceScheduled, AppOK)
+
+	// Entries expire.
+	checkAppStatus(t, o, "{other}", InstallSourceScheduled, AppUnknownID)
+	now = now.Add(2 * time.Minute)
+	checks := r.numChecks()
+	checkAppStatus(t, o, "{other}", InstallSourceScheduled, AppUnknownID)
+	if n := r.numChecks(); n != checks+1 {
+		t.Errorf("expired entry was used")
+	}
+
+	// The least recently used entry is evicted.
+	checkAppStatus(t, o, "{a}", InstallSourceScheduled, AppUnknownID)
+	checkAppStatus(t, o, "{other}", InstallSourceScheduled, AppUnknownID)
+	checkAppStatus(t, o, "{b}", InstallSourceScheduled, AppUnknownID)
+	checks = r.numChecks()
+	checkAppStatus(t, o, "{other}", InstallSourceScheduled, AppUnknownID)
+	checkAppStatus(t, o, "{a}", InstallSourceScheduled, AppUnknownID)
+	if n := r.numChecks(); n != checks+1 {
+		t.Errorf("expected only {a} to be evicted, got %d checks", n-checks)
+	}
+}
+
+func TestUnknownAppCacheRegisterRace(t *testing.T) {
+	r := &registry{
+		apps:    make(map[string]bool),
+		checked: make(chan struct{}),
+		block:   make(chan struct{}),
+	}
+	cache := NewUnknownAppCache(time.Minute, 10)
+	o := &OmahaHandler{Updater: r, UnknownApps: cache}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		checkAppStatus(t, o, "{new}", InstallSourceScheduled, AppUnknownID)
+	}()
+
+	// Register the app after CheckApp decided it is unknown but
+	// before the result is cached.
+	<-r.checked
+	r.register(cache, "{new}")
+	close(r.block)
+	<-done
+
+	r.mu.Lock()
+	r.block = nil
+	r.mu.Unlock()
+
+	checkAppStatus(t, o, "{new}", InstallSourceScheduled, AppOK)
+	if s := cache.Stats(); s.Entries != 0 {
+		t.Errorf("stale miss cached: %+v", s)
+	}
+}
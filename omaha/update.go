@@ -46,7 +46,8 @@ func (u *Update) URLs(prefixes []string) []*URL {
 }
 
 // Updater provides a common interface for any backend that can respond to
-// update requests made to an Omaha server.
+// update requests made to an Omaha server. A relative codebase in the
+// Update returned by CheckUpdate is served from the server's own host.
 type Updater interface {
 	CheckApp(req *Request, app *AppRequest) error
 	CheckUpdate(req *Request, app *AppRequest) (*Update, error)
@@ -54,6 +55,16 @@ type Updater interface {
 	Ping(req *Request, app *AppRequest)
 }
 
+// MetaUpdater may be implemented by an Updater that needs to know how a
+// request arrived, for example to pick a download mirror close to the
+// client. OmahaHandler calls CheckUpdateMeta instead of CheckUpdate if
+// it is implemented. As with CheckUpdate, absolute codebase URLs in the
+// returned Update are used as is rather than being made relative to the
+// server's host.
+type MetaUpdater interface {
+	CheckUpdateMeta(meta *RequestMeta, req *Request, app *AppRequest) (*Update, error)
+}
+
 type UpdaterStub struct{}
 
 func (u UpdaterStub) CheckApp(req *Request, app *AppRequest) error {
@@ -0,0 +1,119 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/blang/semver"
+)
+
+// Version is a CoreOS style version such as 1235.6.0 or
+// 1235.6.0+2017-01-31-1420. The build suffix is kept but ignored
+// when comparing versions.
+type Version struct {
+	semver.Version
+}
+
+// ParseVersion parses a CoreOS style dotted version.
+func ParseVersion(s string) (Version, error) {
+	v, err := semver.Make(s)
+	if err != nil {
+		return Version{}, fmt.Errorf("omaha: invalid version %q: %v", s, err)
+	}
+	return Version{v}, nil
+}
+
+// Compare returns -1, 0, or 1 if a is older than, equal to, or newer
+// than b.
+func Compare(a, b Version) int {
+	return a.Version.Compare(b.Version)
+}
+
+// MatchesTargetPrefix reports whether candidate is within the version
+// prefix requested by an update check's targetversionprefix. The prefix
+// only matches whole dotted components, so "2191." and "2191" both
+// match "2191.5.0" but "219" does not. Pre-release and build suffixes
+// are not part of the prefix so "2191.5.0" matches "2191.5.0-rc.1" too.
+// An empty prefix matches anything.
+func MatchesTargetPrefix(candidate, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, ".")
+	if prefix == "" || candidate == prefix {
+		return true
+	}
+	if i := strings.IndexAny(candidate, "-+"); i >= 0 {
+		candidate = candidate[:i]
+	}
+	return candidate == prefix || strings.HasPrefix(candidate, prefix+".")
+}
+
+// Track is the name of an update channel.
+type Track string
+
+// Tracks used by CoreOS. Other names are allowed as custom tracks.
+const (
+	TrackAlpha  Track = "alpha"
+	TrackBeta   Track = "beta"
+	TrackStable Track = "stable"
+)
+
+var trackRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// ParseTrack accepts the known track names or a custom name made of
+// letters, digits, '.', '_' and '-'.
+func ParseTrack(s string) (Track, error) {
+	if !trackRegexp.MatchString(s) {
+		return "", fmt.Errorf("omaha: invalid track %q", s)
+	}
+	return Track(s), nil
+}
+
+// Known reports whether t is one of the standard tracks.
+func (t Track) Known() bool {
+	switch t {
+	case TrackAlpha, TrackBeta, TrackStable:
+		return true
+	}
+	return false
+}
+
+// SwitchingTrack reports whether the app is moving to a new track,
+// in which case the new track's release should be installed even if
+// it is older than the current version.
+func (a *AppRequest) SwitchingTrack() bool {
+	return a.FromTrack != "" && a.FromTrack != a.Track
+}
+
+// NeedsUpdate reports whether latest should be installed: if it is
+// newer than the app's version or, when switching tracks, if it differs.
+func (a *AppRequest) NeedsUpdate(latest string) (bool, error) {
+	current, err := ParseVersion(a.Version)
+	if err != nil {
+		return false, err
+	}
+
+	target, err := ParseVersion(latest)
+	if err != nil {
+		return false, err
+	}
+
+	cmp := Compare(current, target)
+	if a.SwitchingTrack() {
+		return cmp != 0, nil
+	}
+	return cmp < 0, nil
+}
@@ -0,0 +1,312 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+// versionSamples are version strings seen from real clients, with
+// whether ParseVersion accepts them. Only CoreOS style versions parse.
+var versionSamples = []struct {
+	version string
+	valid   bool
+}{
+	{"0.4.3", true},                            // update_engine
+	{"1235.6.0", true},                         // CoreOS
+	{"1235.6.0+2017-01-31-1420", true},         // CoreOS developer build
+	{"1298.1.0", true},                         // CoreOS
+	{"2191.5.0", true},                         // Flatcar
+	{"2605.12.0", true},                        // Flatcar
+	{"3033.2.4", true},                         // Flatcar
+	{"3227.0.0+dev-flatcar-master-4242", true}, // Flatcar developer build
+	{"3277.1.0-nightly-20220908-2100", true},   // Flatcar nightly
+	{"3374.2.0-rc.1", true},                    // release candidate
+	{"1235.6.0-rc1", true},                     // release candidate
+	{"60.0.3112.101", false},                   // Chrome
+	{"1.3.33.7", false},                        // Omaha client
+	{"ForcedUpdate", false},                    // update_engine
+	{"", false},
+}
+
+// testVersion generates parseable versions, mostly from a small set of
+// components so equal and adjacent versions are common.
+type testVersion string
+
+func (testVersion) Generate(r *rand.Rand, size int) reflect.Value {
+	if r.Intn(4) == 0 {
+		for {
+			s := versionSamples[r.Intn(len(versionSamples))]
+			if s.valid {
+				return reflect.ValueOf(testVersion(s.version))
+			}
+		}
+	}
+
+	components := []string{"0", "1", "10"}
+	v := components[r.Intn(len(components))] + "." +
+		components[r.Intn(len(components))] + "." +
+		components[r.Intn(len(components))]
+	pre := []string{"", "", "alpha", "rc1", "rc.2", "rc.10"}
+	if p := pre[r.Intn(len(pre))]; p != "" {
+		v += "-" + p
+	}
+	build := []string{"", "", "2017-01-31", "dev.1"}
+	if b := build[r.Intn(len(build))]; b != "" {
+		v += "+" + b
+	}
+	return reflect.ValueOf(testVersion(v))
+}
+
+func (v testVersion) parse(t *testing.T) Version {
+	parsed, err := ParseVersion(string(v))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+// targetPrefix truncates the dotted components of v to make a
+// targetversionprefix, optionally with a trailing dot.
+func targetPrefix(v testVersion, n uint8, dot bool) string {
+	core := strings.FieldsFunc(string(v), func(c rune) bool { return c == '-' || c == '+' })[0]
+	parts := strings.Split(core, ".")
+	p := strings.Join(parts[:int(n)%(len(parts)+1)], ".")
+	if p != "" && dot {
+		p += "."
+	}
+	return p
+}
+
+func TestVersionSamples(t *testing.T) {
+	for _, tt := range versionSamples {
+		s := tt.version
+		v, err := ParseVersion(s)
+		if !tt.valid {
+			if err == nil {
+				t.Errorf("%q: accepted as %q", s, v)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", s, err)
+			continue
+		}
+		again, err := ParseVersion(v.String())
+		if err != nil {
+			t.Errorf("%q: String returned unparseable %q", s, v)
+		} else if again.String() != v.String() || Compare(v, again) != 0 {
+			t.Errorf("%q: round trip returned %q", s, again)
+		}
+		if !MatchesTargetPrefix(s, s) {
+			t.Errorf("%q does not match itself as a prefix", s)
+		}
+	}
+}
+
+func TestVersionOrderProperties(t *testing.T) {
+	err := quick.Check(func(a, b, c testVersion) bool {
+		va, vb, vc := a.parse(t), b.parse(t), c.parse(t)
+		if Compare(va, va) != 0 {
+			return false
+		}
+		if Compare(va, vb) != -Compare(vb, va) {
+			return false
+		}
+		if Compare(va, vb) <= 0 && Compare(vb, vc) <= 0 && Compare(va, vc) > 0 {
+			return false
+		}
+		return true
+	}, &quick.Config{MaxCount: 2000})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVersionStringProperties(t *testing.T) {
+	err := quick.Check(func(a, b testVersion) bool {
+		va, vb := a.parse(t), b.parse(t)
+		ra, rb := testVersion(va.String()).parse(t), testVersion(vb.String()).parse(t)
+		return ra.String() == va.String() &&
+			Compare(ra, rb) == Compare(va, vb)
+	}, &quick.Config{MaxCount: 2000})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTargetPrefixProperties(t *testing.T) {
+	err := quick.Check(func(a, b, c testVersion, n uint8, dot bool) bool {
+		// Derive the prefix from one of the versions so it matches
+		// more often than not.
+		prefix := targetPrefix(a, n, dot)
+		vs := []testVersion{a, b, c}
+		for i := range vs {
+			for j := i + 1; j < len(vs); j++ {
+				if Compare(vs[i].parse(t), vs[j].parse(t)) > 0 {
+					vs[i], vs[j] = vs[j], vs[i]
+				}
+			}
+		}
+
+		match := func(v testVersion) bool {
+			m := MatchesTargetPrefix(string(v), prefix)
+			if m != MatchesTargetPrefix(string(v), strings.TrimSuffix(prefix, ".")) {
+				t.Errorf("%q: trailing dot of %q changes the result", v, prefix)
+			}
+			return m
+		}
+
+		// A version is within any prefix of its own components.
+		if !match(a) {
+			t.Logf("%q does not match %q", prefix, a)
+			return false
+		}
+
+		// The versions matching a prefix are a contiguous range.
+		if match(vs[0]) && match(vs[2]) && !match(vs[1]) {
+			t.Logf("%q matches %q and %q but not %q", prefix, vs[0], vs[2], vs[1])
+			return false
+		}
+		return true
+	}, &quick.Config{MaxCount: 5000})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVersionCompare(t *testing.T) {
+	for _, tt := range []struct {
+		a, b string
+		cmp  int
+	}{
+		{"1235.6.0", "1235.6.0", 0},
+		{"1235.6.0", "1235.6.1", -1},
+		{"1235.10.0", "1235.9.0", 1},
+		{"1235.6.0", "1298.0.0", -1},
+		{"1235.6.0+2017-01-31-1420", "1235.6.0", 0},
+		{"1235.6.0-rc1", "1235.6.0", -1},
+	} {
+		a, err := ParseVersion(tt.a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ParseVersion(tt.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cmp := Compare(a, b); cmp != tt.cmp {
+			t.Errorf("Compare(%s, %s) = %d, expected %d", tt.a, tt.b, cmp, tt.cmp)
+		}
+	}
+
+	for _, bad := range []string{"", "ForcedUpdate", "1.0", "1.0.0.0"} {
+		if _, err := ParseVersion(bad); err == nil {
+			t.Errorf("invalid version %q accepted", bad)
+		}
+	}
+}
+
+func TestMatchesTargetPrefix(t *testing.T) {
+	for _, tt := range []struct {
+		candidate, prefix string
+		match             bool
+	}{
+		{"2191.5.0", "", true},
+		{"2191.5.0", "2191.", true},
+		{"2191.5.0", "2191", true},
+		{"2191.5.0", "2191.5.", true},
+		{"2191.5.0", "2191.5.0", true},
+		{"2191.0", "219", false},
+		{"2191.0", "219.", false},
+		{"2191.50.0", "2191.5", false},
+		{"2192.0.0", "2191.", false},
+		{"2191.5.0-rc.1", "2191.5.0", true},
+		{"2191.5.0+2017-01-31-1420", "2191.5.0", true},
+		{"2191.5.0+build.2191.6", "2191.6", false},
+		{"60.0.3112.101", "60.0.", true},
+		{"60.0.3112.101", "60.0.311", false},
+	} {
+		if m := MatchesTargetPrefix(tt.candidate, tt.prefix); m != tt.match {
+			t.Errorf("MatchesTargetPrefix(%q, %q) = %v, expected %v",
+				tt.candidate, tt.prefix, m, tt.match)
+		}
+	}
+}
+
+func TestParseTrack(t *testing.T) {
+	for _, tt := range []struct {
+		track string
+		valid bool
+		known bool
+	}{
+		{"stable", true, true},
+		{"beta", true, true},
+		{"alpha", true, true},
+		{"dev-channel", true, false},
+		{"", false, false},
+		{"-stable", false, false},
+		{"stable channel", false, false},
+	} {
+		track, err := ParseTrack(tt.track)
+		if (err == nil) != tt.valid {
+			t.Errorf("ParseTrack(%q) returned %v", tt.track, err)
+		}
+		if track.Known() != tt.known {
+			t.Errorf("%q known is %v", tt.track, track.Known())
+		}
+	}
+}
+
+func TestNeedsUpdate(t *testing.T) {
+	for _, tt := range []struct {
+		version   string
+		fromTrack string
+		track     string
+		latest    string
+		needed    bool
+	}{
+		{"1235.6.0", "", "stable", "1235.6.0", false},
+		{"1235.6.0", "", "stable", "1235.7.0", true},
+		{"1235.7.0", "", "stable", "1235.6.0", false},
+		{"1235.7.0", "stable", "stable", "1235.6.0", false},
+		// moving from beta back to an older stable release
+		{"1298.1.0", "beta", "stable", "1235.6.0", true},
+		{"1235.6.0", "beta", "stable", "1235.6.0", false},
+	} {
+		app := &AppRequest{
+			Version:   tt.version,
+			FromTrack: tt.fromTrack,
+			Track:     tt.track,
+		}
+		needed, err := app.NeedsUpdate(tt.latest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if needed != tt.needed {
+			t.Errorf("%s (%s -> %s) needs %s: %v, expected %v", tt.version,
+				tt.fromTrack, tt.track, tt.latest, needed, tt.needed)
+		}
+	}
+
+	app := &AppRequest{Version: "ForcedUpdate"}
+	if _, err := app.NeedsUpdate("1235.6.0"); err == nil {
+		t.Error("invalid version accepted")
+	}
+}